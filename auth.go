@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// API key authentication. Keys are listed in a config file by the sha256 of
+// their value, so the file never holds anything that can be used to make
+// requests. Each key has an id, which is what shows up in access logs, and a
+// set of scopes saying which routes it may use.
+//
+// With no key file or JWKS loaded, posts can be read by anyone, as before,
+// but routes that write or administer the server are refused, since there's
+// no way to tell who is allowed to use them.
+
+const scopeUserPostsRead = "user-posts:read"
+const scopePostsWrite = "posts:write"
+const scopeAdmin = "admin"
+
+var knownScopes = map[string]bool{
+	scopeUserPostsRead: true,
+	scopePostsWrite: true,
+	scopeAdmin: true,
+}
+
+type ApiKey struct {
+	Id string `json:"id"`
+	// "sha256:" followed by the hex digest of the key
+	Hash string `json:"hash"`
+	Scopes []string `json:"scopes"`
+}
+
+type apiKeyFile struct {
+	Keys []ApiKey `json:"keys"`
+}
+
+type apiKeyStore struct {
+	// Keyed by hash
+	keys map[string]ApiKey
+}
+
+// Keys in use. nil means authentication is off.
+var apiKeys *apiKeyStore
+
+func hashApiKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return "sha256:" + hex.EncodeToString(hash[:])
+}
+
+func loadApiKeys(path string) (*apiKeyStore, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file := apiKeyFile{}
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid key file %s: %v", path, err)
+	}
+
+	store := &apiKeyStore{ keys: map[string]ApiKey{} }
+	ids := map[string]bool{}
+	for _, key := range file.Keys {
+		if key.Id == "" || ids[key.Id] {
+			return nil, fmt.Errorf("Invalid key file %s: key ids must be present and unique", path)
+		}
+		ids[key.Id] = true
+
+		digest, ok := strings.CutPrefix(key.Hash, "sha256:")
+		if _, err := hex.DecodeString(digest); !ok || err != nil || len(digest) != 64 {
+			return nil, fmt.Errorf("Invalid key file %s: hash of key %s must be sha256:{hex}", path, key.Id)
+		}
+
+		for _, scope := range key.Scopes {
+			if !knownScopes[scope] {
+				return nil, fmt.Errorf("Invalid key file %s: unknown scope %s for key %s", path, scope, key.Id)
+			}
+		}
+
+		store.keys[strings.ToLower(key.Hash)] = key
+	}
+	return store, nil
+}
+
+func (store *apiKeyStore) lookup(key string) (ApiKey, bool) {
+	apiKey, ok := store.keys[hashApiKey(key)]
+	return apiKey, ok
+}
+
+// Who is making a request, as far as authentication could tell
+type principal struct {
+	// Set for API keys
+	keyId string
+	// Set for bearer tokens
+	subject string
+	claims map[string]interface{}
+
+	scopes map[string]bool
+	// Only userId's posts may be read
+	userOnly bool
+	userId int
+
+	// Credentials were sent, but didn't check out
+	invalid bool
+	reason string
+}
+
+// How the principal is shown in access logs
+func (p *principal) describe() string {
+	if p == nil || p.invalid {
+		return "key=- sub=-"
+	}
+
+	keyId, subject := p.keyId, p.subject
+	if keyId == "" {
+		keyId = "-"
+	}
+	if subject == "" {
+		subject = "-"
+	}
+	return "key=" + keyId + " sub=" + subject
+}
+
+func authEnabled() bool {
+	return apiKeys != nil || jwtAuth != nil
+}
+
+type principalKey struct{}
+
+func requestPrincipal(r *http.Request) *principal {
+	p, _ := r.Context().Value(principalKey{}).(*principal)
+	return p
+}
+
+func keyPrincipal(key string) *principal {
+	apiKey, ok := apiKeys.lookup(key)
+	if !ok {
+		return &principal{ invalid: true, reason: "The API key sent is not valid" }
+	}
+
+	p := &principal{ keyId: apiKey.Id, scopes: map[string]bool{} }
+	for _, scope := range apiKey.Scopes {
+		p.scopes[scope] = true
+	}
+	return p
+}
+
+// Work out who is making each request. Nothing is refused here, that's left
+// to requireScope on each route.
+func authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p *principal
+
+		authorization := r.Header.Get("Authorization")
+		token, bearer := strings.CutPrefix(authorization, "Bearer ")
+		key := r.Header.Get("X-API-Key")
+
+		if jwtAuth != nil && bearer {
+			p = bearerPrincipal(strings.TrimSpace(token))
+		} else if apiKeys != nil && key != "" {
+			p = keyPrincipal(key)
+		}
+
+		if p == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	})
+}
+
+// Ask for whichever credentials are accepted
+func writeUnauthorized(w http.ResponseWriter, detail string) {
+	if apiKeys != nil {
+		w.Header().Add("WWW-Authenticate", `ApiKey header="X-API-Key"`)
+	}
+	if jwtAuth != nil {
+		w.Header().Add("WWW-Authenticate", `Bearer error="invalid_token"`)
+	}
+	writeProblem(w, 401, "Unauthorized", detail)
+}
+
+// Why the request may not use a route needing scope, or nil if it may
+func scopeProblem(r *http.Request, scope string, perUser bool) *Problem {
+	if !authEnabled() {
+		if scope == scopeUserPostsRead {
+			return nil
+		}
+		return &Problem{ Status: 403, Title: "Forbidden", Detail: fmt.Sprintf("The %s scope needs API keys or bearer tokens to be configured", scope) }
+	}
+
+	p := requestPrincipal(r)
+	if p == nil {
+		return &Problem{ Status: 401, Title: "Unauthorized", Detail: "Send an API key in the X-API-Key header, or a bearer token" }
+	}
+	if p.invalid {
+		return &Problem{ Status: 401, Title: "Unauthorized", Detail: p.reason }
+	}
+
+	if !p.scopes[scope] {
+		return &Problem{ Status: 403, Title: "Forbidden", Detail: fmt.Sprintf("These credentials do not have the %s scope", scope) }
+	}
+
+	// Routes that aren't about a single user are off limits to tokens for
+	// one
+	if p.userOnly && !perUser {
+		return userProblem(p)
+	}
+
+	return nil
+}
+
+// Why the request may not read userId's posts, or nil if it may
+func userPostsProblem(r *http.Request, userId int) *Problem {
+	p := requestPrincipal(r)
+	if p != nil && p.userOnly && p.userId != userId {
+		return userProblem(p)
+	}
+	return nil
+}
+
+func userProblem(p *principal) *Problem {
+	return &Problem{ Status: 403, Title: "Forbidden", Detail: fmt.Sprintf("This token may only read posts of user %d", p.userId) }
+}
+
+func checkScope(w http.ResponseWriter, r *http.Request, scope string, perUser bool) bool {
+	problem := scopeProblem(r, scope, perUser)
+	if problem == nil {
+		return true
+	}
+
+	if problem.Status == 401 {
+		writeUnauthorized(w, problem.Detail)
+	} else {
+		writeProblem(w, problem.Status, problem.Title, problem.Detail)
+	}
+	return false
+}
+
+// Only let requests through that were made with credentials holding scope
+func requireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if checkScope(w, r, scope, false) {
+			next(w, r)
+		}
+	}
+}
+
+// Like requireScope, but for routes about a single user, which also let
+// through tokens for one user. The handler must check the user with
+// requireUser.
+func requireUserScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if checkScope(w, r, scope, true) {
+			next(w, r)
+		}
+	}
+}
+
+// Refuse the request if it was made with a token for a different user
+func requireUser(w http.ResponseWriter, r *http.Request, userId int) bool {
+	problem := userPostsProblem(r, userId)
+	if problem != nil {
+		writeProblem(w, problem.Status, problem.Title, problem.Detail)
+		return false
+	}
+	return true
+}
+
+// Records the status written, for access logs. Flushing and hijacking are
+// passed through, as the event streams and websockets rely on them.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(data []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = 200
+	}
+	return sw.ResponseWriter.Write(data)
+}
+
+func (sw *statusWriter) Flush() {
+	if flusher, ok := sw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (sw *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := sw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("Hijacking not supported")
+	}
+	if sw.status == 0 {
+		sw.status = 101
+	}
+	return hijacker.Hijack()
+}
+
+// Log each request once it's done, along with who made it
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ ResponseWriter: w }
+		next.ServeHTTP(sw, r)
+
+		if sw.status == 0 {
+			sw.status = 200
+		}
+		log.Printf(
+			"%s %s %s %d %s %s %s",
+			r.RemoteAddr, r.Method, r.URL.RequestURI(), sw.status,
+			time.Since(start).Round(time.Microsecond), requestPrincipal(r).describe(),
+			requestClientIdentity(r).describe(),
+		)
+	})
+}
+
+// The keygen command makes a new key, printing it along with the entry to add
+// to the key file
+func runKeygenCommand(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("keygen", flag.ExitOnError)
+	id := flags.String("id", "", "Id of the key, as shown in access logs")
+	scopes := flags.String("scopes", scopeUserPostsRead, "Comma separated scopes the key is allowed")
+	flags.Parse(args)
+
+	if *id == "" {
+		return fmt.Errorf("id is required")
+	}
+
+	apiKey := ApiKey{ Id: *id, Scopes: []string{} }
+	for _, scope := range strings.Split(*scopes, ",") {
+		scope = strings.TrimSpace(scope)
+		if !knownScopes[scope] {
+			return fmt.Errorf("Unknown scope %s", scope)
+		}
+		apiKey.Scopes = append(apiKey.Scopes, scope)
+	}
+
+	key := randomId(32)
+	apiKey.Hash = hashApiKey(key)
+
+	entry, err := json.MarshalIndent(apiKey, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "Key: %s\n\nAdd to the key file:\n%s\n", key, entry)
+	return nil
+}
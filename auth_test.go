@@ -0,0 +1,175 @@
+package main
+
+import (
+	"testing"
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Load keys for the rest of the test, returning the plain keys by id
+func useApiKeys(t *testing.T, scopes map[string][]string) map[string]string {
+	file := apiKeyFile{}
+	plain := map[string]string{}
+	for id, keyScopes := range scopes {
+		key := randomId(16)
+		plain[id] = key
+		file.Keys = append(file.Keys, ApiKey{ id, hashApiKey(key), keyScopes })
+	}
+
+	path := filepath.Join(t.TempDir(), "keys.json")
+	data, _ := json.Marshal(file)
+	os.WriteFile(path, data, 0644)
+
+	store, err := loadApiKeys(path)
+	if err != nil {
+		t.Fatalf("Failed to load keys: %v", err)
+	}
+
+	prev := apiKeys
+	apiKeys = store
+	t.Cleanup(func() { apiKeys = prev })
+	return plain
+}
+
+func TestLoadApiKeysInvalid(t *testing.T) {
+	hash := hashApiKey("key")
+	files := map[string]string{
+		"duplicate id": `{"keys": [{"id": "a", "hash": "` + hash + `"}, {"id": "a", "hash": "` + hash + `"}]}`,
+		"plain key": `{"keys": [{"id": "a", "hash": "key"}]}`,
+		"unknown scope": `{"keys": [{"id": "a", "hash": "` + hash + `", "scopes": ["everything"]}]}`,
+	}
+
+	for name, contents := range files {
+		path := filepath.Join(t.TempDir(), "keys.json")
+		os.WriteFile(path, []byte(contents), 0644)
+
+		_, err := loadApiKeys(path)
+		if err == nil {
+			t.Fatalf("%s: expected key file to be rejected", name)
+		}
+	}
+}
+
+func TestRequireScope(t *testing.T) {
+	keys := useApiKeys(t, map[string][]string{
+		"reader": { scopeUserPostsRead },
+		"writer": { scopeUserPostsRead, scopePostsWrite },
+	})
+
+	handler := authenticate(requireScope(scopePostsWrite, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(204)
+	}))
+
+	tests := []struct {
+		name string
+		key string
+		status int
+	}{
+		{ "missing", "", 401 },
+		{ "invalid", "nope", 401 },
+		{ "missing scope", keys["reader"], 403 },
+		{ "allowed", keys["writer"], 204 },
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("POST", "/v1/posts/1", nil)
+		if test.key != "" {
+			req.Header.Set("X-API-Key", test.key)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != test.status {
+			t.Fatalf("%s: expected %d, got %d", test.name, test.status, rec.Code)
+		}
+		if rec.Code >= 400 && rec.Header().Get("Content-Type") != "application/problem+json" {
+			t.Fatalf("%s: expected problem response, got %s", test.name, rec.Header().Get("Content-Type"))
+		}
+		if rec.Code == 401 && rec.Header().Get("WWW-Authenticate") == "" {
+			t.Fatalf("%s: expected WWW-Authenticate header", test.name)
+		}
+	}
+}
+
+func TestRequireScopeDisabled(t *testing.T) {
+	tests := []struct {
+		scope string
+		status int
+	}{
+		// Reading stays open without a key file, as it was before keys
+		{ scopeUserPostsRead, 204 },
+		// Anything else is refused, as nobody can be trusted with it
+		{ scopePostsWrite, 403 },
+		{ scopeAdmin, 403 },
+	}
+
+	for _, test := range tests {
+		handler := authenticate(requireScope(test.scope, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(204)
+		}))
+
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/v1/admin/hedging", nil)
+		req.Header.Set("X-API-Key", "anything")
+		handler.ServeHTTP(rec, req)
+		if rec.Code != test.status {
+			t.Fatalf("%s: expected %d without a key file, got %d", test.scope, test.status, rec.Code)
+		}
+	}
+}
+
+func TestLogRequests(t *testing.T) {
+	keys := useApiKeys(t, map[string][]string{ "reporting": { scopeUserPostsRead } })
+
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+
+	handler := authenticate(logRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Streaming handlers still see a flusher
+		if _, ok := w.(http.Flusher); !ok {
+			t.Errorf("Expected writer to support flushing")
+		}
+		writeError(w, 404, "Not found")
+	})))
+
+	req := httptest.NewRequest("GET", "/v1/user-posts/11", nil)
+	req.Header.Set("X-API-Key", keys["reporting"])
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	line := out.String()
+	if !strings.Contains(line, "GET /v1/user-posts/11 404") || !strings.Contains(line, "key=reporting") {
+		t.Fatalf("Got unexpected access log: %s", line)
+	}
+	if strings.Contains(line, keys["reporting"]) {
+		t.Fatalf("Expected key itself to be kept out of logs")
+	}
+}
+
+func TestClientIdAuthenticated(t *testing.T) {
+	keys := useApiKeys(t, map[string][]string{ "reporting": { scopeUserPostsRead } })
+
+	ids := []string{}
+	handler := authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, _ := clientId(r)
+		ids = append(ids, id)
+	}))
+
+	for _, key := range []string{ keys["reporting"], "made-up" } {
+		req := httptest.NewRequest("GET", "/v1/user-posts/1", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set("X-API-Key", key)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// Made up keys don't get a bucket of their own
+	if ids[0] != "key:reporting" || ids[1] != "ip:10.0.0.1" {
+		t.Fatalf("Got unexpected client ids: %v", ids)
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Where upstream data comes from. Everything that reads or writes upstream
+// data goes through the configured Backend, addressed by the upstream's paths
+// such as "/users/1" or "/posts?userId=1", and gets back parsed json and a
+// status as if from the upstream. Validation stays with the callers, so it is
+// the same whichever backend is used.
+type Backend interface {
+	get(ctx context.Context, path string) (interface{}, int, error)
+	send(ctx context.Context, method string, path string, body interface{}) (interface{}, int, error)
+}
+
+var backend Backend = &httpBackend{}
+
+// Read from the configured backend
+func fetchJson(ctx context.Context, path string) (interface{}, int, error) {
+	return backend.get(ctx, path)
+}
+
+// Write to the configured backend
+func sendJson(ctx context.Context, method string, path string, body interface{}) (interface{}, int, error) {
+	return backend.send(ctx, method, path, body)
+}
+
+// The real upstream. Requests are spread over the pool's upstreams if there
+// is one, and otherwise all go to baseUrl.
+type httpBackend struct {
+	pool *upstreamPool
+}
+
+func (hb *httpBackend) get(ctx context.Context, path string) (interface{}, int, error) {
+	fetch := func(ctx context.Context) (interface{}, int, error) {
+		return hb.send(ctx, "GET", path, nil)
+	}
+
+	if hedgeEnabled {
+		return hedges.do(ctx, path, fetch)
+	}
+	return fetch(ctx)
+}
+
+func (hb *httpBackend) send(ctx context.Context, method string, path string, body interface{}) (interface{}, int, error) {
+	if hb.pool != nil {
+		return hb.pool.request(ctx, method, path, body)
+	}
+
+	err := upstreamLimiter.wait(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	return requestJson(ctx, method, baseUrl + path, body)
+}
+
+// Collections of records held in memory, answering requests the way the
+// upstream does. Writes are applied for real, unless the backend is read
+// only, as it is when serving fixtures.
+type memoryBackend struct {
+	mu sync.Mutex
+	collections map[string][]interface{}
+	readOnly bool
+	// When the collections were loaded, or last written to
+	modified time.Time
+}
+
+func newMemoryBackend(collections map[string][]interface{}) *memoryBackend {
+	if collections == nil {
+		collections = map[string][]interface{}{}
+	}
+	for _, name := range snapshotCollections {
+		if collections[name] == nil {
+			collections[name] = []interface{}{}
+		}
+	}
+	return &memoryBackend{ collections: collections, modified: time.Now() }
+}
+
+func (mem *memoryBackend) lastModified() time.Time {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	return mem.modified
+}
+
+func recordInt(record interface{}, key string) (int, bool) {
+	data, ok := record.(map[string]interface{})
+	if !ok {
+		return 0, false
+	}
+	val, err := indexInt(data, key)
+	return val, err == nil
+}
+
+// Records in a collection whose key matches val. Records without the key, or
+// with a non-integer value, never match. Must be called with the lock held.
+func (mem *memoryBackend) find(name string, key string, val int) []interface{} {
+	found := []interface{}{}
+	for _, record := range mem.collections[name] {
+		if id, ok := recordInt(record, key); ok && id == val {
+			found = append(found, record)
+		}
+	}
+	return found
+}
+
+// Split a path into its collection name and the parts after it. ok is false
+// if there is no such collection.
+func (mem *memoryBackend) route(path string) (string, []string, url.Values, bool) {
+	parsed, err := url.Parse(path)
+	if err != nil {
+		return "", nil, nil, false
+	}
+
+	parts := strings.Split(strings.Trim(parsed.Path, "/"), "/")
+	_, ok := mem.collections[parts[0]]
+	return parts[0], parts[1:], parsed.Query(), ok
+}
+
+func (mem *memoryBackend) get(ctx context.Context, path string) (interface{}, int, error) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	name, rest, query, ok := mem.route(path)
+	if !ok {
+		return nil, 404, nil
+	}
+
+	switch len(rest) {
+	// A whole collection, optionally filtered on a single field such as
+	// ?userId=1
+	case 0:
+		if len(query) == 0 {
+			return append([]interface{}{}, mem.collections[name]...), 200, nil
+		}
+		if len(query) > 1 {
+			return nil, 400, nil
+		}
+
+		for key := range query {
+			val, err := strconv.Atoi(query.Get(key))
+			if err != nil {
+				return []interface{}{}, 200, nil
+			}
+			return mem.find(name, key, val), 200, nil
+		}
+
+	// A single record by id
+	case 1:
+		id, err := strconv.Atoi(rest[0])
+		if err != nil {
+			return nil, 404, nil
+		}
+
+		found := mem.find(name, "id", id)
+		if len(found) == 0 {
+			return nil, 404, nil
+		}
+		return found[0], 200, nil
+
+	// Nested collections, such as /posts/1/comments
+	case 2:
+		id, err := strconv.Atoi(rest[0])
+		if err != nil || len(mem.find(name, "id", id)) == 0 {
+			return nil, 404, nil
+		}
+
+		child := rest[1]
+		if _, ok := mem.collections[child]; !ok {
+			return nil, 404, nil
+		}
+		return mem.find(child, strings.TrimSuffix(name, "s") + "Id", id), 200, nil
+	}
+
+	return nil, 404, nil
+}
+
+func (mem *memoryBackend) send(ctx context.Context, method string, path string, body interface{}) (interface{}, int, error) {
+	if mem.readOnly {
+		return nil, 0, fmt.Errorf("Cannot %s to a read only backend", method)
+	}
+
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	// Failed writes count too. That only makes the time later than it needs
+	// to be, never earlier.
+	mem.modified = time.Now()
+
+	name, rest, _, ok := mem.route(path)
+	if !ok {
+		return nil, 404, nil
+	}
+
+	// Round trip the body through json, so it's stored just as the upstream
+	// would have parsed it, and later changes by the caller don't reach
+	// the store
+	record := map[string]interface{}{}
+	if method != "DELETE" {
+		bodyJson, err := json.Marshal(body)
+		if err != nil {
+			return nil, 0, err
+		}
+		err = json.Unmarshal(bodyJson, &record)
+		if err != nil || record == nil {
+			return nil, 400, nil
+		}
+	}
+
+	collection := mem.collections[name]
+
+	if len(rest) == 0 {
+		if method != "POST" {
+			return nil, 404, nil
+		}
+
+		nextId := 1
+		for _, existing := range collection {
+			if id, ok := recordInt(existing, "id"); ok && id >= nextId {
+				nextId = id + 1
+			}
+		}
+
+		record["id"] = float64(nextId)
+		mem.collections[name] = append(collection, record)
+		return record, 201, nil
+	}
+
+	id, err := strconv.Atoi(rest[0])
+	if err != nil || len(rest) > 1 {
+		return nil, 404, nil
+	}
+
+	index := -1
+	for i, existing := range collection {
+		if existingId, ok := recordInt(existing, "id"); ok && existingId == id {
+			index = i
+		}
+	}
+	if index < 0 {
+		return nil, 404, nil
+	}
+
+	switch method {
+	case "PUT":
+		record["id"] = float64(id)
+
+	case "PATCH":
+		merged := map[string]interface{}{}
+		for key, val := range collection[index].(map[string]interface{}) {
+			merged[key] = val
+		}
+		for key, val := range record {
+			merged[key] = val
+		}
+		merged["id"] = float64(id)
+		record = merged
+
+	case "DELETE":
+		updated := append([]interface{}{}, collection[:index]...)
+		mem.collections[name] = append(updated, collection[index + 1:]...)
+		return map[string]interface{}{}, 200, nil
+
+	default:
+		return nil, 405, nil
+	}
+
+	// Replace rather than modify the slice, since readers may still hold
+	// the old one
+	updated := append([]interface{}{}, collection...)
+	updated[index] = record
+	mem.collections[name] = updated
+	return record, 200, nil
+}
+
+// Select a backend from a --source flag:
+// http uses the upstream at baseUrl, and http:{url},{url}... the upstreams at
+// the given urls, balanced according to upstreamBalance.
+// snapshot:{dir} or fixtures:{dir} serve, read only, from a directory of json
+// as written by the mirror command.
+// memory starts with nothing, and memory:{dir} starts from a directory, with
+// writes kept in memory until exit.
+func useSource(source string) error {
+	kind, arg, _ := strings.Cut(source, ":")
+
+	switch kind {
+	case "http":
+		urls := []string{ baseUrl }
+		if arg != "" {
+			urls = strings.Split(arg, ",")
+		}
+
+		pool, err := newUpstreamPool(urls, upstreamBalance)
+		if err != nil {
+			return err
+		}
+		baseUrl = pool.upstreams[0].url
+		backend = &httpBackend{ pool: pool }
+
+	case "snapshot", "fixtures":
+		mem, err := loadFixtures(arg)
+		if err != nil {
+			return err
+		}
+		mem.readOnly = true
+		backend = mem
+
+	case "memory":
+		if arg == "" {
+			backend = newMemoryBackend(nil)
+			return nil
+		}
+
+		mem, err := loadFixtures(arg)
+		if err != nil {
+			return err
+		}
+		backend = mem
+
+	default:
+		return fmt.Errorf("Unknown source %q", source)
+	}
+
+	return nil
+}
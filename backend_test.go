@@ -0,0 +1,121 @@
+package main
+
+import (
+	"testing"
+	"context"
+	"encoding/json"
+	"reflect"
+)
+
+// Swap in a memory backend holding the same fixtures as startFakeUpstream,
+// for tests that don't need to go over http
+func useMemoryBackend(t *testing.T) *memoryBackend {
+	collections := map[string][]interface{}{}
+	fixtures := map[string]string{
+		"users": "[" + expUserStr + "]",
+		"posts": expPostsStr,
+		"comments": fakeCommentsStr,
+	}
+	for name, fixture := range fixtures {
+		var collection []interface{}
+		json.Unmarshal([]byte(fixture), &collection)
+		collections[name] = collection
+	}
+
+	mem := newMemoryBackend(collections)
+
+	prevBackend := backend
+	backend = mem
+	t.Cleanup(func() { backend = prevBackend })
+
+	return mem
+}
+
+func TestMemoryBackendGetUserPosts(t *testing.T) {
+	useMemoryBackend(t)
+
+	userPosts, status, err := getUserPosts(1)
+	if err != nil || status != 200 {
+		t.Fatalf("Unexpected error getting user posts: %d %v", status, err)
+	}
+
+	exp := UserPosts{ Id: 1, UserInfo: *expUser, Posts: expPosts }
+	if !reflect.DeepEqual(exp, *userPosts) {
+		t.Fatalf("Expected %v, got %v", exp, *userPosts)
+	}
+
+	_, status, err = getUserPosts(2)
+	if err != nil || status != 404 {
+		t.Fatalf("Expected 404 for missing user, got %d %v", status, err)
+	}
+}
+
+func TestMemoryBackendWrites(t *testing.T) {
+	useMemoryBackend(t)
+	ctx := context.TODO()
+
+	res, status, _ := sendJson(ctx, "POST", "/posts", map[string]interface{}{
+		"userId": 1, "title": "new", "body": "post",
+	})
+	post, err := parsePost(res)
+	if status != 201 || err != nil || post != (Post{ 11, "new", "post" }) {
+		t.Fatalf("Got unexpected created post %d: %v %v", status, post, err)
+	}
+
+	res, status, _ = sendJson(ctx, "PATCH", "/posts/11", map[string]interface{}{ "title": "patched" })
+	post, err = parsePost(res)
+	if status != 200 || err != nil || post != (Post{ 11, "patched", "post" }) {
+		t.Fatalf("Got unexpected patched post %d: %v %v", status, post, err)
+	}
+
+	_, status, _ = sendJson(ctx, "DELETE", "/posts/1", nil)
+	if status != 200 {
+		t.Fatalf("Expected 200 deleting post, got %d", status)
+	}
+
+	_, status, _ = sendJson(ctx, "PUT", "/posts/1", map[string]interface{}{ "title": "gone" })
+	if status != 404 {
+		t.Fatalf("Expected 404 replacing deleted post, got %d", status)
+	}
+
+	res2 := getPosts(ctx, 1)
+	if res2.err != nil || len(res2.posts) != 10 {
+		t.Fatalf("Expected 10 posts, got %v %v", res2.posts, res2.err)
+	}
+	if res2.posts[0].Id != 2 || res2.posts[9] != (Post{ 11, "patched", "post" }) {
+		t.Fatalf("Got unexpected posts: %v", res2.posts)
+	}
+}
+
+func TestUseSource(t *testing.T) {
+	prevBackend := backend
+	prevBaseUrl := baseUrl
+	defer func() {
+		backend = prevBackend
+		baseUrl = prevBaseUrl
+	}()
+
+	if useSource("ftp:somewhere") == nil {
+		t.Fatalf("Expected error for unknown source")
+	}
+	if useSource("snapshot:" + t.TempDir()) == nil {
+		t.Fatalf("Expected error for empty snapshot dir")
+	}
+
+	err := useSource("http:http://localhost:3000/")
+	if err != nil || baseUrl != "http://localhost:3000" {
+		t.Fatalf("Expected baseUrl to be set, got %s %v", baseUrl, err)
+	}
+	if _, ok := backend.(*httpBackend); !ok {
+		t.Fatalf("Expected http backend, got %T", backend)
+	}
+
+	err = useSource("memory")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	_, status, _ := fetchJson(context.TODO(), "/users/1")
+	if status != 404 {
+		t.Fatalf("Expected empty memory backend, got %d", status)
+	}
+}
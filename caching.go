@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// HTTP caching for /v1/user-posts/{id}. Every response carries a strong ETag,
+// taken from the hash of the exact bytes sent, so each format and query gets
+// its own. Last-Modified is only sent when the backend can say when its data
+// last changed, which the http upstream can't. Clients sending back either
+// validator get a 304 if nothing has changed.
+
+// Cache-Control sent with user posts. Empty sends none. Responses may be
+// redacted per client, so they default to private.
+var userPostsCacheControl = "private, max-age=60"
+
+// Backends that know when their data last changed
+type modificationTracker interface {
+	lastModified() time.Time
+}
+
+func bodyEtag(body []byte) string {
+	hash := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(hash[:16]) + `"`
+}
+
+// When the data behind responses last changed, if that can be known. Changes
+// to the overlay count too, as they're merged into responses.
+func userPostsModified() (time.Time, bool) {
+	tracker, ok := backend.(modificationTracker)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	modified := tracker.lastModified()
+	if changed := overlays.lastChange(); changed.After(modified) {
+		modified = changed
+	}
+	return modified.UTC().Truncate(time.Second), true
+}
+
+// Whether an If-None-Match header lists etag. Comparison is weak, as the spec
+// asks for If-None-Match, so W/ prefixes are ignored.
+func etagMatches(header string, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Set the caching headers for a response with the given body, and answer 304
+// instead if the client's copy is still current. Returns whether it did, in
+// which case there's nothing more to write.
+func writeNotModified(w http.ResponseWriter, r *http.Request, body []byte) bool {
+	etag := bodyEtag(body)
+	modified, hasModified := userPostsModified()
+
+	w.Header().Set("ETag", etag)
+	if hasModified {
+		w.Header().Set("Last-Modified", modified.Format(http.TimeFormat))
+	}
+	if userPostsCacheControl != "" {
+		w.Header().Set("Cache-Control", userPostsCacheControl)
+	}
+	// What's sent depends on who asked, as well as what they accept
+	if authEnabled() {
+		w.Header().Add("Vary", "Authorization")
+		w.Header().Add("Vary", "X-API-Key")
+	}
+
+	notModified := false
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		// If-Modified-Since is ignored when there's an etag to go by
+		notModified = etagMatches(match, etag)
+	} else if since := r.Header.Get("If-Modified-Since"); since != "" && hasModified {
+		sinceTime, err := http.ParseTime(since)
+		notModified = err == nil && !modified.After(sinceTime)
+	}
+
+	if !notModified {
+		return false
+	}
+
+	// The body's headers don't apply to an empty response
+	w.Header().Del("Content-Type")
+	w.WriteHeader(304)
+	return true
+}
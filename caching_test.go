@@ -0,0 +1,125 @@
+package main
+
+import (
+	"testing"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+// Serve body the way /v1/user-posts/{id} does, with the given request headers
+func conditionalRequest(body string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/v1/user-posts/1", nil)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	rec := httptest.NewRecorder()
+	rec.Header().Set("Content-Type", "application/json")
+	if !writeNotModified(rec, req, []byte(body)) {
+		rec.Write([]byte(body))
+	}
+	return rec
+}
+
+func TestEtag(t *testing.T) {
+	rec := conditionalRequest(`{"id": 1}`, nil)
+	etag := rec.Header().Get("ETag")
+	if rec.Code != 200 || len(etag) != 34 || etag[0] != '"' {
+		t.Fatalf("Expected a strong etag, got %d %q", rec.Code, etag)
+	}
+	if rec.Header().Get("Cache-Control") != userPostsCacheControl {
+		t.Fatalf("Expected Cache-Control, got %q", rec.Header().Get("Cache-Control"))
+	}
+	if conditionalRequest(`{"id": 2}`, nil).Header().Get("ETag") == etag {
+		t.Fatalf("Expected etag to change with the body")
+	}
+
+	tests := []struct {
+		name string
+		ifNoneMatch string
+		status int
+	}{
+		{ "match", etag, 304 },
+		{ "one of several", `"other", ` + etag, 304 },
+		{ "weak", "W/" + etag, 304 },
+		{ "any", "*", 304 },
+		{ "stale", `"other"`, 200 },
+	}
+
+	for _, test := range tests {
+		rec := conditionalRequest(`{"id": 1}`, map[string]string{ "If-None-Match": test.ifNoneMatch })
+		if rec.Code != test.status {
+			t.Fatalf("%s: expected %d, got %d", test.name, test.status, rec.Code)
+		}
+		if rec.Code == 304 && (rec.Body.Len() != 0 || rec.Header().Get("ETag") != etag) {
+			t.Fatalf("%s: expected an empty 304 with the etag", test.name)
+		}
+	}
+}
+
+func TestLastModified(t *testing.T) {
+	useTempOverlay(t)
+
+	// The http upstream can't say when anything changed
+	prevBackend := backend
+	backend = &httpBackend{}
+	t.Cleanup(func() { backend = prevBackend })
+
+	rec := conditionalRequest(`{}`, map[string]string{ "If-Modified-Since": time.Now().Format(http.TimeFormat) })
+	if rec.Code != 200 || rec.Header().Get("Last-Modified") != "" {
+		t.Fatalf("Expected no Last-Modified from the http upstream, got %d %q", rec.Code, rec.Header().Get("Last-Modified"))
+	}
+
+	mem := useMemoryBackend(t)
+	rec = conditionalRequest(`{}`, nil)
+	modified, err := http.ParseTime(rec.Header().Get("Last-Modified"))
+	if err != nil {
+		t.Fatalf("Expected Last-Modified from the memory backend, got %v", err)
+	}
+
+	rec = conditionalRequest(`{}`, map[string]string{ "If-Modified-Since": modified.Format(http.TimeFormat) })
+	if rec.Code != 304 {
+		t.Fatalf("Expected 304 when unmodified, got %d", rec.Code)
+	}
+
+	// An etag, when sent, wins over the date
+	rec = conditionalRequest(`{}`, map[string]string{
+		"If-Modified-Since": modified.Format(http.TimeFormat),
+		"If-None-Match": `"other"`,
+	})
+	if rec.Code != 200 {
+		t.Fatalf("Expected If-None-Match to take precedence, got %d", rec.Code)
+	}
+
+	// Writes to the backend or the overlay move it on
+	mem.mu.Lock()
+	mem.modified = mem.modified.Add(time.Hour)
+	mem.mu.Unlock()
+
+	rec = conditionalRequest(`{}`, map[string]string{ "If-Modified-Since": modified.Format(http.TimeFormat) })
+	if rec.Code != 200 {
+		t.Fatalf("Expected 200 after a write, got %d", rec.Code)
+	}
+
+	later, _ := http.ParseTime(rec.Header().Get("Last-Modified"))
+	overlays.changedAt = later.Add(time.Hour)
+	rec = conditionalRequest(`{}`, map[string]string{ "If-Modified-Since": later.Format(http.TimeFormat) })
+	if rec.Code != 200 {
+		t.Fatalf("Expected 200 after an overlay change, got %d", rec.Code)
+	}
+}
+
+func TestMemoryBackendModified(t *testing.T) {
+	mem := useMemoryBackend(t)
+	before := mem.lastModified()
+
+	time.Sleep(time.Millisecond)
+	_, status, err := sendJson(t.Context(), "PATCH", "/posts/1", map[string]string{ "title": "changed" })
+	if err != nil || status != 200 {
+		t.Fatalf("Write failed: %d %v", status, err)
+	}
+	if !mem.lastModified().After(before) {
+		t.Fatalf("Expected writes to move the modified time on")
+	}
+}
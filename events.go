@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Live updates of a user's posts. The upstream can't push changes, so a feed
+// per user polls getPosts, diffs each result against the previous snapshot,
+// and fans the resulting events out to every subscriber. A feed only polls
+// while it has subscribers, but keeps its snapshot and recent history after,
+// so clients reconnecting with Last-Event-ID can pick up where they left off.
+
+var eventPollInterval = 30 * time.Second
+var eventHeartbeatInterval = 15 * time.Second
+
+// Number of past events kept per user for resuming
+const eventHistorySize = 100
+
+// Events queued for a subscriber beyond this are a sign it has stalled, and it
+// is disconnected rather than holding up everyone else
+const eventSubscriberBuffer = 64
+
+// Event ids are prefixed with the time the process started, so ids handed out
+// by a previous run are never mistaken for ids from this one
+var eventEpoch = strconv.FormatInt(time.Now().UnixNano(), 36)
+
+type PostEvent struct {
+	Id string `json:"-"`
+	Seq int64 `json:"-"`
+	Type string `json:"type"`
+	UserId int `json:"userId"`
+	Post Post `json:"post"`
+}
+
+// Compare two snapshots of a user's posts by id. Events are returned sorted by
+// post id, so the order is stable between polls.
+func diffPosts(prev []Post, next []Post) []PostEvent {
+	prevById := map[int]Post{}
+	for _, post := range prev {
+		prevById[post.Id] = post
+	}
+
+	nextById := map[int]Post{}
+	for _, post := range next {
+		nextById[post.Id] = post
+	}
+
+	events := []PostEvent{}
+	for _, post := range next {
+		old, ok := prevById[post.Id]
+		if !ok {
+			events = append(events, PostEvent{ Type: "post.created", Post: post })
+		} else if old != post {
+			events = append(events, PostEvent{ Type: "post.updated", Post: post })
+		}
+	}
+
+	for _, post := range prev {
+		if _, ok := nextById[post.Id]; !ok {
+			events = append(events, PostEvent{ Type: "post.deleted", Post: post })
+		}
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Post.Id < events[j].Post.Id
+	})
+
+	return events
+}
+
+// State of the feed for a single user
+type postsFeed struct {
+	userId int
+	fetch func(ctx context.Context, id int) PostsRes
+
+	// Held for the whole of a poll, so results from overlapping polls can't
+	// be applied out of order
+	pollMu sync.Mutex
+
+	mu sync.Mutex
+	snapshot []Post
+	history []PostEvent
+	seq int64
+	subscribers map[chan PostEvent]bool
+	stop context.CancelFunc
+}
+
+// Poll once, recording and broadcasting any changes. The first successful poll
+// only records the baseline snapshot.
+func (feed *postsFeed) poll(ctx context.Context) {
+	feed.pollMu.Lock()
+	defer feed.pollMu.Unlock()
+
+	res := feed.fetch(ctx, feed.userId)
+	if res.err != nil || errorStatus(res.status) {
+		if ctx.Err() == nil {
+			log.Printf("Failed to poll posts for user %d: %d %v", feed.userId, res.status, res.err)
+		}
+		return
+	}
+
+	feed.mu.Lock()
+	defer feed.mu.Unlock()
+
+	if feed.snapshot == nil {
+		feed.snapshot = res.posts
+		return
+	}
+
+	events := diffPosts(feed.snapshot, res.posts)
+	feed.snapshot = res.posts
+
+	for _, event := range events {
+		feed.seq++
+		event.Seq = feed.seq
+		event.Id = fmt.Sprintf("%s-%d", eventEpoch, feed.seq)
+		event.UserId = feed.userId
+
+		feed.history = append(feed.history, event)
+		if len(feed.history) > eventHistorySize {
+			feed.history = feed.history[1:]
+		}
+
+		for ch := range feed.subscribers {
+			select {
+			case ch <- event:
+			default:
+				delete(feed.subscribers, ch)
+				close(ch)
+			}
+		}
+	}
+}
+
+func (feed *postsFeed) run(ctx context.Context) {
+	ticker := time.NewTicker(eventPollInterval)
+	defer ticker.Stop()
+
+	feed.poll(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			feed.poll(ctx)
+		}
+	}
+}
+
+// Registry of feeds, one per user, shared by every subscriber to that user
+type feedHub struct {
+	mu sync.Mutex
+	feeds map[int]*postsFeed
+	fetch func(ctx context.Context, id int) PostsRes
+}
+
+func newFeedHub() *feedHub {
+	return &feedHub{ feeds: map[int]*postsFeed{}, fetch: getPosts }
+}
+
+var postsFeeds = newFeedHub()
+
+// Subscribe to a user's feed, starting its poller if this is the first
+// subscriber. If lastEventId is given, any events after it that are still in
+// the history are returned for replay. The returned channel is closed if the
+// subscriber falls too far behind.
+func (hub *feedHub) subscribe(userId int, lastEventId string) (chan PostEvent, []PostEvent, func()) {
+	// The hub stays locked while the feed is updated, so a feed can't be
+	// removed between being looked up and subscribed to
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	feed, ok := hub.feeds[userId]
+	if !ok {
+		feed = &postsFeed{
+			userId: userId,
+			fetch: hub.fetch,
+			subscribers: map[chan PostEvent]bool{},
+		}
+		hub.feeds[userId] = feed
+	}
+
+	ch := make(chan PostEvent, eventSubscriberBuffer)
+
+	feed.mu.Lock()
+	feed.subscribers[ch] = true
+	if feed.stop == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		feed.stop = cancel
+		go feed.run(ctx)
+	}
+
+	var replay []PostEvent
+	if seq, ok := parseEventId(lastEventId); ok {
+		for _, event := range feed.history {
+			if event.Seq > seq {
+				replay = append(replay, event)
+			}
+		}
+	}
+	feed.mu.Unlock()
+
+	unsubscribe := func() {
+		hub.mu.Lock()
+		defer hub.mu.Unlock()
+		feed.mu.Lock()
+		defer feed.mu.Unlock()
+
+		if feed.subscribers[ch] {
+			delete(feed.subscribers, ch)
+			close(ch)
+		}
+
+		if len(feed.subscribers) > 0 {
+			return
+		}
+
+		if feed.stop != nil {
+			feed.stop()
+			feed.stop = nil
+		}
+
+		// Feeds with nothing to resume from aren't worth keeping. This
+		// also stops subscriptions to missing users from piling up.
+		if len(feed.history) == 0 {
+			delete(hub.feeds, userId)
+		}
+	}
+
+	return ch, replay, unsubscribe
+}
+
+// Poll a user's feed straight away if anyone is subscribed, so changes made
+// through this service reach subscribers without waiting for the next tick
+func (hub *feedHub) refresh(userId int) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	feed, ok := hub.feeds[userId]
+	if !ok {
+		return
+	}
+
+	feed.mu.Lock()
+	running := feed.stop != nil
+	feed.mu.Unlock()
+
+	if running {
+		go feed.poll(context.Background())
+	}
+}
+
+// Pull the sequence number out of an event id. Ids from a previous run of
+// the service can't be resumed from.
+func parseEventId(id string) (int64, bool) {
+	prefix := eventEpoch + "-"
+	if !strings.HasPrefix(id, prefix) {
+		return 0, false
+	}
+
+	seq, err := strconv.ParseInt(strings.TrimPrefix(id, prefix), 10, 64)
+	return seq, err == nil
+}
+
+func writeSseEvent(w http.ResponseWriter, event PostEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.Id, event.Type, data)
+	return err
+}
+
+// Serve /v1/user-posts/{id}/events as a Server-Sent Events stream
+func handlePostEvents(w http.ResponseWriter, r *http.Request, subpath string) {
+	if r.Method != "GET" {
+		writeError(w, 404, "Not found")
+		return
+	}
+
+	id, err := strconv.Atoi(subpath)
+	if err != nil || id < 0 {
+		writeError(w, 404, "Not found")
+		return
+	}
+	if !requireUser(w, r, id) {
+		return
+	}
+
+	// Check the user exists before committing to a stream
+	userRes := getUser(r.Context(), id)
+	if userRes.status == 404 {
+		writeError(w, 404, "Not found")
+		return
+	}
+	if userRes.err != nil || errorStatus(userRes.status) {
+		writeError(w, 500, "Something went wrong")
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, 500, "Streaming not supported")
+		return
+	}
+
+	ch, replay, unsubscribe := postsFeeds.subscribe(id, r.Header.Get("Last-Event-ID"))
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+
+	for _, event := range replay {
+		writeSseEvent(w, event)
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case event, ok := <-ch:
+			// Closed because we fell behind. The client will reconnect
+			// and resume from its last event.
+			if !ok {
+				return
+			}
+			err = writeSseEvent(w, event)
+
+		case <-heartbeat.C:
+			_, err = fmt.Fprint(w, ": heartbeat\n\n")
+		}
+
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
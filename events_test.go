@@ -0,0 +1,218 @@
+package main
+
+import (
+	"testing"
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+func TestDiffPosts(t *testing.T) {
+	prev := []Post{
+		{ Id: 1, Title: "one", Body: "body" },
+		{ Id: 2, Title: "two", Body: "body" },
+		{ Id: 3, Title: "three", Body: "body" },
+	}
+
+	next := []Post{
+		{ Id: 4, Title: "four", Body: "body" },
+		{ Id: 1, Title: "one", Body: "body" },
+		{ Id: 3, Title: "three", Body: "edited" },
+	}
+
+	events := diffPosts(prev, next)
+
+	var types []string
+	var ids []int
+	for _, event := range events {
+		types = append(types, event.Type)
+		ids = append(ids, event.Post.Id)
+	}
+
+	expTypes := []string{"post.deleted", "post.updated", "post.created"}
+	if !reflect.DeepEqual(expTypes, types) || !reflect.DeepEqual([]int{2, 3, 4}, ids) {
+		t.Fatalf("Got unexpected events: %v", events)
+	}
+
+	if events[1].Post.Body != "edited" {
+		t.Fatalf("Updated event does not carry the new post: %v", events[1])
+	}
+
+	if len(diffPosts(prev, prev)) != 0 {
+		t.Fatalf("Got events for identical snapshots")
+	}
+}
+
+// Fetch function whose result can be swapped out between polls
+type fakePostsFetch struct {
+	mu sync.Mutex
+	posts []Post
+	calls int
+}
+
+func (fake *fakePostsFetch) set(posts ...Post) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.posts = posts
+}
+
+func (fake *fakePostsFetch) fetch(ctx context.Context, id int) PostsRes {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.calls++
+	return PostsRes{ posts: append([]Post{}, fake.posts...), status: 200 }
+}
+
+// The first poll runs in the background when a feed starts, so wait for it to
+// record the baseline snapshot before changing anything
+func waitForBaseline(t *testing.T, hub *feedHub, userId int) *postsFeed {
+	for i := 0; i < 100; i++ {
+		hub.mu.Lock()
+		feed := hub.feeds[userId]
+		hub.mu.Unlock()
+
+		if feed != nil {
+			feed.mu.Lock()
+			ready := feed.snapshot != nil
+			feed.mu.Unlock()
+			if ready {
+				return feed
+			}
+		}
+
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	t.Fatalf("Feed for user %d never polled", userId)
+	return nil
+}
+
+func TestFeedHub(t *testing.T) {
+	fake := &fakePostsFetch{}
+	fake.set(Post{ Id: 1, Title: "one" })
+
+	hub := newFeedHub()
+	hub.fetch = fake.fetch
+
+	prevInterval := eventPollInterval
+	eventPollInterval = time.Hour
+	defer func() { eventPollInterval = prevInterval }()
+
+	first, _, unsubFirst := hub.subscribe(1, "")
+	second, _, unsubSecond := hub.subscribe(1, "")
+
+	// Both subscribers share a single feed, and so a single poller
+	feed := waitForBaseline(t, hub, 1)
+	if fake.calls != 1 {
+		t.Fatalf("Expected a single poll, got %d", fake.calls)
+	}
+
+	fake.set(Post{ Id: 1, Title: "one" }, Post{ Id: 2, Title: "two" })
+	feed.poll(context.TODO())
+
+	for _, ch := range []chan PostEvent{first, second} {
+		event := <-ch
+		if event.Type != "post.created" || event.Post.Id != 2 || event.UserId != 1 {
+			t.Fatalf("Got unexpected event: %v", event)
+		}
+	}
+
+	fake.set(Post{ Id: 2, Title: "two" })
+	feed.poll(context.TODO())
+	deleted := <-first
+	<-second
+
+	// Resuming from the first event replays only what came after it
+	_, replay, unsubThird := hub.subscribe(1, deleted.Id)
+	if len(replay) != 0 {
+		t.Fatalf("Got unexpected replay: %v", replay)
+	}
+	unsubThird()
+
+	created := feed.history[0]
+	_, replay, unsubThird = hub.subscribe(1, created.Id)
+	if len(replay) != 1 || replay[0].Type != "post.deleted" {
+		t.Fatalf("Got unexpected replay: %v", replay)
+	}
+	unsubThird()
+
+	// Ids from another run of the service can't be resumed from
+	_, replay, unsubThird = hub.subscribe(1, "otherepoch-1")
+	if len(replay) != 0 {
+		t.Fatalf("Got unexpected replay: %v", replay)
+	}
+	unsubThird()
+
+	unsubFirst()
+	unsubSecond()
+
+	feed.mu.Lock()
+	stopped := feed.stop == nil
+	feed.mu.Unlock()
+	if !stopped {
+		t.Fatalf("Feed still polling after last unsubscribe")
+	}
+}
+
+func TestPostEventsStream(t *testing.T) {
+	startFakeUpstream(t)
+
+	fake := &fakePostsFetch{}
+	fake.set(Post{ Id: 1, Title: "one" })
+
+	prevFeeds := postsFeeds
+	postsFeeds = newFeedHub()
+	postsFeeds.fetch = fake.fetch
+
+	prevInterval := eventPollInterval
+	eventPollInterval = 10 * time.Millisecond
+
+	defer func() {
+		postsFeeds = prevFeeds
+		eventPollInterval = prevInterval
+	}()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlePostEvents(w, r, strings.TrimPrefix(r.URL.Path, "/"))
+	}))
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/2")
+	if err != nil || res.StatusCode != 404 {
+		t.Fatalf("Expected 404 for missing user: %v %v", res, err)
+	}
+
+	res, err = http.Get(srv.URL + "/1")
+	if err != nil {
+		t.Fatalf("Failed to connect to event stream: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Got unexpected content type: %s", res.Header.Get("Content-Type"))
+	}
+
+	waitForBaseline(t, postsFeeds, 1)
+	fake.set(Post{ Id: 1, Title: "edited" })
+
+	reader := bufio.NewReader(res.Body)
+	var lines []string
+	for len(lines) < 3 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Failed to read event: %v", err)
+		}
+		lines = append(lines, strings.TrimSuffix(line, "\n"))
+	}
+
+	if !strings.HasPrefix(lines[0], "id: " + eventEpoch + "-") ||
+		lines[1] != "event: post.updated" ||
+		lines[2] != `data: {"type":"post.updated","userId":1,"post":{"id":1,"title":"edited","body":""}}` {
+		t.Fatalf("Got unexpected event:\n%s", strings.Join(lines, "\n"))
+	}
+}
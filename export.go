@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+)
+
+// Bulk export of every user's posts, for nightly jobs. Users are discovered
+// from the upstream, fetched a few at a time, and each written out as a single
+// line of json as soon as it is ready, so nothing is buffered beyond the
+// users currently in flight.
+
+// Number of users fetched at once
+var exportConcurrency = 4
+
+// Written in place of a UserPosts when fetching that user fails, so one bad
+// user doesn't abort the whole export
+type ExportError struct {
+	Id int `json:"id"`
+	Error ExportErrorInfo `json:"error"`
+}
+
+type ExportErrorInfo struct {
+	Code int `json:"code"`
+	Message string `json:"message"`
+}
+
+// Fetch the ids of every user from upstream, in ascending order
+func getUserIds(ctx context.Context) ([]int, error) {
+	res, status, err := fetchJson(ctx, "/users")
+	if err != nil {
+		return nil, err
+	}
+	if errorStatus(status) {
+		return nil, fmt.Errorf("Got status %d fetching users", status)
+	}
+
+	users, err := parseUsers(res)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]int, 0, len(users))
+	for id := range users {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	return ids, nil
+}
+
+// Fetch the UserPosts for each id with bounded concurrency, calling emit with
+// either a *UserPosts or an ExportError for each. Records are emitted in the
+// order they complete, one at a time. Stops early if the context is
+// cancelled or emit fails.
+func exportUserPosts(ctx context.Context, ids []int, concurrency int, emit func(interface{}) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	idChan := make(chan int)
+	resChan := make(chan interface{})
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range idChan {
+				select {
+				case resChan <- exportRecord(ctx, id):
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(idChan)
+		for _, id := range ids {
+			select {
+			case idChan <- id:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(resChan)
+	}()
+
+	// Keep reading until the workers have all exited, even after a failed
+	// emit, so none of them outlive the call
+	var emitErr error
+	for record := range resChan {
+		if emitErr != nil {
+			continue
+		}
+
+		emitErr = emit(record)
+		if emitErr != nil {
+			cancel()
+		}
+	}
+
+	if emitErr != nil {
+		return emitErr
+	}
+	return ctx.Err()
+}
+
+// Fetch a single user's posts, turning failures into an error record with the
+// same codes and messages the http handler would use
+func exportRecord(ctx context.Context, id int) interface{} {
+	userPosts, status, err := getUserPostsContext(ctx, id)
+	switch {
+	case status == 404:
+		return ExportError{ id, ExportErrorInfo{ 404, "Not found" } }
+	case err != nil || errorStatus(status):
+		return ExportError{ id, ExportErrorInfo{ 500, "Something went wrong" } }
+	default:
+		return userPosts
+	}
+}
+
+// Write the export as ndjson. flush is called after every line, so consumers
+// see records as soon as they're ready.
+func writeExport(ctx context.Context, w io.Writer, concurrency int, flush func()) error {
+	ids, err := getUserIds(ctx)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(w)
+	return exportUserPosts(ctx, ids, concurrency, func(record interface{}) error {
+		err := enc.Encode(record)
+		if err == nil {
+			flush()
+		}
+		return err
+	})
+}
+
+func handleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, 404, "Not found")
+		return
+	}
+
+	if r.URL.Query().Get("stream") != "ndjson" {
+		writeError(w, 400, "Only stream=ndjson is supported")
+		return
+	}
+
+	// Fetch the user list before committing to a 200, so that failure can
+	// still be reported with a proper status
+	ids, err := getUserIds(r.Context())
+	if err != nil {
+		writeError(w, 500, "Something went wrong")
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, 500, "Streaming not supported")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(200)
+	flusher.Flush()
+
+	enc := json.NewEncoder(w)
+	policy := redactionFor(r.Context())
+	// Errors here are the client going away, and there's no one left to
+	// tell about them
+	exportUserPosts(r.Context(), ids, exportConcurrency, func(record interface{}) error {
+		if userPosts, ok := record.(*UserPosts); ok {
+			record = policy.userPosts(userPosts)
+		}
+		err := enc.Encode(record)
+		if err == nil {
+			flusher.Flush()
+		}
+		return err
+	})
+}
+
+// The export command writes the same ndjson stream to stdout
+func runExportCommand(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	concurrency := flags.Int("concurrency", exportConcurrency, "Number of users fetched at once")
+	rate := flags.Float64("upstream-rate", defaultUpstreamRate, "Most requests per second sent upstream, or 0 for no limit")
+	burst := flags.Int("upstream-burst", defaultUpstreamBurst, "Requests that may be sent upstream at once before the rate applies")
+	upstreamTls := flags.String("upstream-tls", "", "File of CA, client certificate, server name and proxy settings per upstream url")
+	flags.Parse(args)
+
+	err := useUpstreamTls(*upstreamTls)
+	if err != nil {
+		return err
+	}
+
+	if *concurrency < 1 {
+		return fmt.Errorf("concurrency must be at least 1")
+	}
+	if *rate < 0 || *burst < 1 {
+		return fmt.Errorf("upstream-rate must not be negative, and upstream-burst must be at least 1")
+	}
+	upstreamLimiter.configure(*rate, *burst)
+
+	// Ctrl-C stops fetches already in flight, rather than waiting on them
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	return writeExport(ctx, out, *concurrency, func() {})
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"testing"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+func TestGetUserIds(t *testing.T) {
+	startFakeUpstream(t)
+
+	ids, err := getUserIds(context.TODO())
+	if err != nil {
+		t.Fatalf("Unexpected error getting user ids: %v", err)
+	}
+
+	if !reflect.DeepEqual([]int{1}, ids) {
+		t.Fatalf("Got unexpected ids: %v", ids)
+	}
+}
+
+func TestExportUserPosts(t *testing.T) {
+	startFakeUpstream(t)
+
+	var ids []int
+	var errors []int
+	err := exportUserPosts(context.TODO(), []int{1, 2, 3, 4, 5}, 2, func(record interface{}) error {
+		switch res := record.(type) {
+		case *UserPosts:
+			ids = append(ids, res.Id)
+		case ExportError:
+			if res.Error.Code != 404 {
+				t.Fatalf("Got unexpected error record: %v", res)
+			}
+			errors = append(errors, res.Id)
+		}
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("Unexpected error exporting: %v", err)
+	}
+
+	sort.Ints(errors)
+	if !reflect.DeepEqual([]int{1}, ids) || !reflect.DeepEqual([]int{2, 3, 4, 5}, errors) {
+		t.Fatalf("Got unexpected records: %v %v", ids, errors)
+	}
+
+	// A failing emit stops the export
+	count := 0
+	err = exportUserPosts(context.TODO(), []int{1, 2, 3, 4, 5}, 2, func(record interface{}) error {
+		count++
+		return fmt.Errorf("write failed")
+	})
+
+	if err == nil || count != 1 {
+		t.Fatalf("Export did not stop after failed emit: %v %d", err, count)
+	}
+}
+
+func TestWriteExport(t *testing.T) {
+	startFakeUpstream(t)
+
+	buf := &bytes.Buffer{}
+	flushes := 0
+	err := writeExport(context.TODO(), buf, 2, func() { flushes++ })
+	if err != nil {
+		t.Fatalf("Unexpected error exporting: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 1 || flushes != 1 {
+		t.Fatalf("Got unexpected output:\n%s", buf.String())
+	}
+
+	var userPosts UserPosts
+	json.Unmarshal([]byte(lines[0]), &userPosts)
+
+	exp := UserPosts{ Id: 1, UserInfo: *expUser, Posts: expPosts }
+	if !reflect.DeepEqual(exp, userPosts) {
+		t.Fatalf("\nExpected:\n%v\nGot:\n%v\n", exp, userPosts)
+	}
+}
+
+func TestExportRecordCancelled(t *testing.T) {
+	// The upstream never answers until the test is over
+	done := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer upstream.Close()
+	defer close(done)
+
+	prevBaseUrl := baseUrl
+	baseUrl = upstream.URL
+	defer func() { baseUrl = prevBaseUrl }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	resChan := make(chan interface{})
+	go func() { resChan <- exportRecord(ctx, 1) }()
+
+	cancel()
+	select {
+	case res := <-resChan:
+		if _, ok := res.(ExportError); !ok {
+			t.Fatalf("Expected an error record, got %v", res)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected cancelling to stop the fetch")
+	}
+}
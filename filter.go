@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+)
+
+// Lightweight filtering of a user's posts by title or body, for when the full
+// search endpoint is more than is needed. Filters are given as query params,
+// with the operator attached to the field name:
+//
+//	title~=foo    title contains "foo"
+//	title^=foo    title starts with "foo"
+//	title~=/f.o/  title matches the regex "f.o"
+//
+// Substring and prefix matches are case-insensitive. Regexes are matched as
+// written, so clients can opt in to case-insensitivity with (?i).
+
+// Limits on client supplied regexes. Go's regexp package guarantees linear
+// time matching, but a large pattern can still compile to a very large
+// program, so both the source and the compiled size are bounded.
+const maxFilterPatternLen = 128
+const maxFilterProgSize = 512
+
+type PostFilter struct {
+	field string
+	op string
+	value string
+	re *regexp.Regexp
+}
+
+var filterFields = []string{"title", "body"}
+var filterOps = []string{"~", "^"}
+
+// Read every filter param from the request query. Params that aren't
+// filters are ignored, since the same query also carries pagination.
+func parsePostFilters(values url.Values) ([]PostFilter, error) {
+	var filters []PostFilter
+
+	for _, field := range filterFields {
+		for _, op := range filterOps {
+			for _, value := range values[field+op] {
+				filter, err := newPostFilter(field, op, value)
+				if err != nil {
+					return nil, err
+				}
+				filters = append(filters, filter)
+			}
+		}
+	}
+
+	return filters, nil
+}
+
+func newPostFilter(field string, op string, value string) (PostFilter, error) {
+	if value == "" {
+		return PostFilter{}, fmt.Errorf("%s%s= filter cannot be empty", field, op)
+	}
+
+	filter := PostFilter{ field: field, op: op, value: strings.ToLower(value) }
+
+	// Slash delimited values are regexes
+	isRegex := op == "~" &&
+		len(value) >= 2 &&
+		strings.HasPrefix(value, "/") &&
+		strings.HasSuffix(value, "/")
+
+	if isRegex {
+		re, err := compileSafeRegex(value[1:len(value)-1])
+		if err != nil {
+			return PostFilter{}, err
+		}
+		filter.re = re
+	}
+
+	return filter, nil
+}
+
+// Compile a regex from an untrusted source, rejecting it if it is too long or
+// compiles to too large a program
+func compileSafeRegex(pattern string) (*regexp.Regexp, error) {
+	if len(pattern) > maxFilterPatternLen {
+		return nil, fmt.Errorf(
+			"regex must be at most %d characters",
+			maxFilterPatternLen,
+		)
+	}
+
+	parsed, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid regex")
+	}
+
+	prog, err := syntax.Compile(parsed.Simplify())
+	if err != nil || len(prog.Inst) > maxFilterProgSize {
+		return nil, fmt.Errorf("regex is too complex")
+	}
+
+	return regexp.Compile(pattern)
+}
+
+func (filter PostFilter) match(post Post) bool {
+	text := post.Title
+	if filter.field == "body" {
+		text = post.Body
+	}
+
+	if filter.re != nil {
+		return filter.re.MatchString(text)
+	}
+
+	text = strings.ToLower(text)
+	if filter.op == "^" {
+		return strings.HasPrefix(text, filter.value)
+	}
+
+	return strings.Contains(text, filter.value)
+}
+
+// Return the posts matching every filter
+func filterPosts(posts []Post, filters []PostFilter) []Post {
+	matched := []Post{}
+	for _, post := range posts {
+		ok := true
+		for _, filter := range filters {
+			if !filter.match(post) {
+				ok = false
+				break
+			}
+		}
+
+		if ok {
+			matched = append(matched, post)
+		}
+	}
+
+	return matched
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"testing"
+	"net/url"
+	"reflect"
+	"strings"
+)
+
+func TestParsePostFilters(t *testing.T) {
+	filters, err := parsePostFilters(url.Values{
+		"title~": {"Foo"},
+		"body^": {"bar"},
+		"limit": {"10"},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error parsing filters: %v", err)
+	}
+
+	exp := []PostFilter{
+		{ field: "title", op: "~", value: "foo" },
+		{ field: "body", op: "^", value: "bar" },
+	}
+	if !reflect.DeepEqual(exp, filters) {
+		t.Fatalf("\nExpected:\n%v\nGot:\n%v\n", exp, filters)
+	}
+
+	bad := []url.Values{
+		{ "title~": {""} },
+		{ "title~": {"/(/"} },
+		{ "body~": {"/" + strings.Repeat("a", maxFilterPatternLen + 1) + "/"} },
+		{ "body~": {"/(a{100}){100}/"} },
+	}
+
+	for _, values := range bad {
+		_, err := parsePostFilters(values)
+		if err == nil {
+			t.Fatalf("Did not get error parsing filters: %v", values)
+		}
+	}
+}
+
+func TestFilterPosts(t *testing.T) {
+	filter := func(values url.Values) []int {
+		filters, err := parsePostFilters(values)
+		if err != nil {
+			t.Fatalf("Unexpected error parsing filters: %v", err)
+		}
+
+		ids := []int{}
+		for _, post := range filterPosts(expPosts, filters) {
+			ids = append(ids, post.Id)
+		}
+		return ids
+	}
+
+	// Substring matches are case-insensitive
+	ids := filter(url.Values{ "title~": {"DOLOREM"} })
+	if !reflect.DeepEqual([]int{6, 8, 9}, ids) {
+		t.Fatalf("Got unexpected posts: %v", ids)
+	}
+
+	ids = filter(url.Values{ "title^": {"nesciunt"} })
+	if !reflect.DeepEqual([]int{5, 9}, ids) {
+		t.Fatalf("Got unexpected posts: %v", ids)
+	}
+
+	ids = filter(url.Values{ "title~": {"/^(qui|eum) /"} })
+	if !reflect.DeepEqual([]int{2, 4}, ids) {
+		t.Fatalf("Got unexpected posts: %v", ids)
+	}
+
+	// Every filter has to match
+	ids = filter(url.Values{ "title~": {"dolorem"}, "body~": {"consectetur"} })
+	if !reflect.DeepEqual([]int{9}, ids) {
+		t.Fatalf("Got unexpected posts: %v", ids)
+	}
+}
+
+func TestApplyPostsQueryFilters(t *testing.T) {
+	userPosts := &UserPosts{ Id: 1, UserInfo: *expUser, Posts: expPosts }
+	reqUrl, _ := url.Parse("/v1/user-posts/1?title~=dolorem&limit=2")
+
+	query, err := parsePostsQuery(reqUrl.Query())
+	if err != nil {
+		t.Fatalf("Unexpected error parsing query: %v", err)
+	}
+
+	page := query.apply(reqUrl, userPosts).(*UserPostsPage)
+	if page.TotalPosts != 10 || page.MatchedPosts == nil || *page.MatchedPosts != 3 {
+		t.Fatalf("Got unexpected counts: %v", page)
+	}
+
+	if len(page.Posts) != 2 || page.Next == "" {
+		t.Fatalf("Got unexpected page: %v", page)
+	}
+}
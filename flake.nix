@@ -1,4 +1,7 @@
 {
+  # Pinned, rather than taken from the registry, since go.mod needs Go 1.24
+  inputs.nixpkgs.url = "github:NixOS/nixpkgs/nixos-25.05";
+
   outputs = { nixpkgs, ... }: let
     system = "x86_64-linux";
     pkgs = nixpkgs.legacyPackages.${system};
@@ -13,7 +16,7 @@
 
     devShell.${system} = (pkgs.mkShell {
       packages = with pkgs; [
-        go
+        go_1_24
       ];
     });
 
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Content negotiation for the user posts endpoint. The format is picked from
+// ?format= if given, and otherwise from the Accept header, defaulting to
+// indented json as the endpoint has always returned.
+
+type ResponseFormat struct {
+	name string
+	contentType string
+	encode func(v interface{}) ([]byte, error)
+}
+
+var jsonFormat = ResponseFormat{ "json", "application/json", encodeJson }
+
+var responseFormats = []ResponseFormat{
+	jsonFormat,
+	{ "compact", "application/json", encodeCompactJson },
+	{ "xml", "application/xml", encodeXml },
+	{ "yaml", "application/yaml", encodeYaml },
+	{ "csv", "text/csv; charset=utf-8", encodeCsv },
+	{ "ndjson", "application/x-ndjson", encodeNdjson },
+	{ "protobuf", "application/x-protobuf", encodeProtobuf },
+}
+
+// Media types accepted in the Accept header, mapped to format names. Compact
+// json has no media type of its own, so it is only available via ?format=.
+var mediaTypeFormats = map[string]string{
+	"*/*": "json",
+	"application/*": "json",
+	"application/json": "json",
+	"application/xml": "xml",
+	"text/xml": "xml",
+	"application/yaml": "yaml",
+	"application/x-yaml": "yaml",
+	"text/yaml": "yaml",
+	"text/*": "csv",
+	"text/csv": "csv",
+	"application/x-ndjson": "ndjson",
+	"application/ndjson": "ndjson",
+	"application/x-protobuf": "protobuf",
+	"application/protobuf": "protobuf",
+}
+
+func formatByName(name string) (ResponseFormat, bool) {
+	for _, format := range responseFormats {
+		if format.name == name {
+			return format, true
+		}
+	}
+	return ResponseFormat{}, false
+}
+
+// Pick the response format for a request. Returns false if neither the
+// format param nor the Accept header name anything we can produce.
+func negotiateFormat(r *http.Request) (ResponseFormat, bool) {
+	if name := r.URL.Query().Get("format"); name != "" {
+		return formatByName(name)
+	}
+
+	accept := r.Header.Get("Accept")
+	if strings.TrimSpace(accept) == "" {
+		return jsonFormat, true
+	}
+
+	for _, mediaType := range parseAccept(accept) {
+		if name, ok := mediaTypeFormats[mediaType]; ok {
+			return formatByName(name)
+		}
+	}
+
+	return ResponseFormat{}, false
+}
+
+// Parse an Accept header into its media types, most preferred first. Types
+// with a quality of zero are explicitly unacceptable, and are dropped.
+func parseAccept(accept string) []string {
+	type acceptRange struct {
+		mediaType string
+		q float64
+	}
+
+	var ranges []acceptRange
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+		if mediaType == "" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				val, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+				if err == nil {
+					q = val
+				}
+			}
+		}
+
+		if q > 0 {
+			ranges = append(ranges, acceptRange{ mediaType, q })
+		}
+	}
+
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].q > ranges[j].q
+	})
+
+	mediaTypes := make([]string, len(ranges))
+	for i, r := range ranges {
+		mediaTypes[i] = r.mediaType
+	}
+
+	return mediaTypes
+}
+
+// The handler renders either a plain UserPosts or a UserPostsPage. The
+// formats that flatten the data only care about the UserPosts part.
+func baseUserPosts(v interface{}) *UserPosts {
+	switch res := v.(type) {
+	case *UserPosts:
+		return res
+	case *UserPostsPage:
+		return &res.UserPosts
+	default:
+		return nil
+	}
+}
+
+func encodeJson(v interface{}) ([]byte, error) {
+	return json.MarshalIndent(v, "", "  ")
+}
+
+func encodeCompactJson(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func encodeXml(v interface{}) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	buf.WriteString(xml.Header)
+
+	enc := xml.NewEncoder(buf)
+	enc.Indent("", "  ")
+	err := enc.EncodeElement(v, xml.StartElement{ Name: xml.Name{ Local: "userPosts" } })
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+var csvHeader = []string{
+	"userId", "name", "username", "email", "postId", "title", "body",
+}
+
+// One row per post, with the user's fields repeated on every row
+func encodeCsv(v interface{}) ([]byte, error) {
+	userPosts := baseUserPosts(v)
+	if userPosts == nil {
+		return nil, fmt.Errorf("Cannot encode %T as csv", v)
+	}
+
+	buf := &bytes.Buffer{}
+	writer := csv.NewWriter(buf)
+	writer.Write(csvHeader)
+
+	for _, post := range userPosts.Posts {
+		writer.Write([]string{
+			strconv.Itoa(userPosts.Id),
+			userPosts.UserInfo.Name,
+			userPosts.UserInfo.Username,
+			userPosts.UserInfo.Email,
+			strconv.Itoa(post.Id),
+			post.Title,
+			post.Body,
+		})
+	}
+
+	writer.Flush()
+	return buf.Bytes(), writer.Error()
+}
+
+// A single line of ndjson output: one post along with its author
+type PostRecord struct {
+	UserId int `json:"userId"`
+	UserInfo User `json:"userInfo"`
+	Post Post `json:"post"`
+}
+
+// One line per post, so the output can be processed with line based tools
+func encodeNdjson(v interface{}) ([]byte, error) {
+	userPosts := baseUserPosts(v)
+	if userPosts == nil {
+		return nil, fmt.Errorf("Cannot encode %T as ndjson", v)
+	}
+
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	for _, post := range userPosts.Posts {
+		err := enc.Encode(PostRecord{
+			UserId: userPosts.Id,
+			UserInfo: userPosts.UserInfo,
+			Post: post,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// YAML is produced by re-reading the json encoding, which keeps field names
+// and omitempty handling identical between the two formats. Decoding the json
+// token by token preserves the field order of the structs.
+func encodeYaml(v interface{}) ([]byte, error) {
+	jsonBytes, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(jsonBytes))
+	dec.UseNumber()
+
+	node, err := decodeOrdered(dec)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	writeYaml(buf, node, 0, false)
+	return buf.Bytes(), nil
+}
+
+// A json object with its keys in their original order
+type orderedField struct {
+	key string
+	val interface{}
+}
+
+type orderedObject []orderedField
+
+// Render the object with its keys in order, which encoding a map can't do
+func (obj orderedObject) MarshalJSON() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	buf.WriteByte('{')
+	for i, field := range obj {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+
+		key, err := json.Marshal(field.key)
+		if err != nil {
+			return nil, err
+		}
+
+		val, err := json.Marshal(field.val)
+		if err != nil {
+			return nil, err
+		}
+
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(val)
+	}
+	buf.WriteByte('}')
+
+	return buf.Bytes(), nil
+}
+
+func decodeOrdered(dec *json.Decoder) (interface{}, error) {
+	token, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch token {
+	case json.Delim('{'):
+		obj := orderedObject{}
+		for dec.More() {
+			keyToken, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+
+			val, err := decodeOrdered(dec)
+			if err != nil {
+				return nil, err
+			}
+
+			obj = append(obj, orderedField{ keyToken.(string), val })
+		}
+		_, err = dec.Token()
+		return obj, err
+
+	case json.Delim('['):
+		list := []interface{}{}
+		for dec.More() {
+			val, err := decodeOrdered(dec)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, val)
+		}
+		_, err = dec.Token()
+		return list, err
+
+	default:
+		return token, nil
+	}
+}
+
+var plainYamlKey = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Write a decoded json value as block style YAML. If inline is set, the first
+// line has already been indented by a list item marker.
+func writeYaml(w io.Writer, node interface{}, indent int, inline bool) {
+	pad := strings.Repeat(" ", indent)
+
+	switch val := node.(type) {
+	case orderedObject:
+		if len(val) == 0 {
+			fmt.Fprint(w, "{}\n")
+			return
+		}
+
+		for i, field := range val {
+			if i > 0 || !inline {
+				fmt.Fprint(w, pad)
+			}
+
+			key := field.key
+			if !plainYamlKey.MatchString(key) {
+				key = strconv.Quote(key)
+			}
+
+			if isYamlBlock(field.val) {
+				fmt.Fprintf(w, "%s:\n", key)
+				writeYaml(w, field.val, indent+2, false)
+			} else {
+				fmt.Fprintf(w, "%s: ", key)
+				writeYaml(w, field.val, indent+2, true)
+			}
+		}
+
+	case []interface{}:
+		if len(val) == 0 {
+			fmt.Fprint(w, "[]\n")
+			return
+		}
+
+		for i, item := range val {
+			if i > 0 || !inline {
+				fmt.Fprint(w, pad)
+			}
+			fmt.Fprint(w, "- ")
+			writeYaml(w, item, indent+2, true)
+		}
+
+	case string:
+		// json string escapes are also valid in YAML double quoted strings
+		fmt.Fprintf(w, "%s\n", strconv.Quote(val))
+
+	case nil:
+		fmt.Fprint(w, "null\n")
+
+	default:
+		fmt.Fprintf(w, "%v\n", val)
+	}
+}
+
+// Whether a value is written on the lines following its key, rather than on
+// the same line
+func isYamlBlock(node interface{}) bool {
+	switch val := node.(type) {
+	case orderedObject:
+		return len(val) > 0
+	case []interface{}:
+		return len(val) > 0
+	default:
+		return false
+	}
+}
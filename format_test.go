@@ -0,0 +1,141 @@
+package main
+
+import (
+	"testing"
+	"encoding/json"
+	"encoding/xml"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+)
+
+var formatUserPosts = &UserPosts{
+	Id: 1,
+	UserInfo: *expUser,
+	Posts: []Post{
+		{ Id: 1, Title: "first, post", Body: "line one\nline \"two\"" },
+		{ Id: 2, Title: "second", Body: "" },
+	},
+}
+
+func TestNegotiateFormat(t *testing.T) {
+	cases := []struct {
+		url string
+		accept string
+		exp string
+	}{
+		{ "/", "", "json" },
+		{ "/", "*/*", "json" },
+		{ "/", "text/csv", "csv" },
+		{ "/", "text/html, application/xml;q=0.5, application/yaml;q=0.9", "yaml" },
+		{ "/", "application/json;q=0, text/*", "csv" },
+		{ "/?format=compact", "application/xml", "compact" },
+		{ "/?format=ndjson", "", "ndjson" },
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", c.url, nil)
+		if c.accept != "" {
+			req.Header.Set("Accept", c.accept)
+		}
+
+		format, ok := negotiateFormat(req)
+		if !ok || format.name != c.exp {
+			t.Fatalf("Expected %s for %s %s, got %s", c.exp, c.url, c.accept, format.name)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept", "text/html, image/png")
+	if _, ok := negotiateFormat(req); ok {
+		t.Fatalf("Negotiated a format for unsupported Accept")
+	}
+
+	req = httptest.NewRequest("GET", "/?format=pdf", nil)
+	if _, ok := negotiateFormat(req); ok {
+		t.Fatalf("Negotiated a format for unsupported format param")
+	}
+}
+
+func TestEncodeCsv(t *testing.T) {
+	res, err := encodeCsv(formatUserPosts)
+	if err != nil {
+		t.Fatalf("Unexpected error encoding csv: %v", err)
+	}
+
+	exp := `userId,name,username,email,postId,title,body
+1,Leanne Graham,Bret,Sincere@april.biz,1,"first, post","line one
+line ""two"""
+1,Leanne Graham,Bret,Sincere@april.biz,2,second,
+`
+	if string(res) != exp {
+		t.Fatalf("\nExpected:\n%s\nGot:\n%s\n", exp, res)
+	}
+}
+
+func TestEncodeNdjson(t *testing.T) {
+	page := &UserPostsPage{ UserPosts: *formatUserPosts, TotalPosts: 2 }
+	res, err := encodeNdjson(page)
+	if err != nil {
+		t.Fatalf("Unexpected error encoding ndjson: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(res), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got:\n%s", res)
+	}
+
+	var record PostRecord
+	json.Unmarshal([]byte(lines[1]), &record)
+
+	exp := PostRecord{ UserId: 1, UserInfo: *expUser, Post: formatUserPosts.Posts[1] }
+	if !reflect.DeepEqual(exp, record) {
+		t.Fatalf("\nExpected:\n%v\nGot:\n%v\n", exp, record)
+	}
+}
+
+func TestEncodeXml(t *testing.T) {
+	res, err := encodeXml(formatUserPosts)
+	if err != nil {
+		t.Fatalf("Unexpected error encoding xml: %v", err)
+	}
+
+	var decoded UserPosts
+	err = xml.Unmarshal(res, &decoded)
+	if err != nil {
+		t.Fatalf("Unexpected error decoding xml: %v", err)
+	}
+
+	if !reflect.DeepEqual(*formatUserPosts, decoded) {
+		t.Fatalf("\nExpected:\n%v\nGot:\n%v\n", *formatUserPosts, decoded)
+	}
+}
+
+func TestEncodeYaml(t *testing.T) {
+	res, err := encodeYaml(formatUserPosts)
+	if err != nil {
+		t.Fatalf("Unexpected error encoding yaml: %v", err)
+	}
+
+	exp := `id: 1
+userInfo:
+  name: "Leanne Graham"
+  username: "Bret"
+  email: "Sincere@april.biz"
+posts:
+  - id: 1
+    title: "first, post"
+    body: "line one\nline \"two\""
+  - id: 2
+    title: "second"
+    body: ""
+`
+	if string(res) != exp {
+		t.Fatalf("\nExpected:\n%s\nGot:\n%s\n", exp, res)
+	}
+
+	res, _ = encodeYaml(&UserPosts{ Id: 2, Posts: []Post{} })
+	if !strings.Contains(string(res), "posts: []\n") {
+		t.Fatalf("Empty list not rendered inline:\n%s", res)
+	}
+}
@@ -1,3 +1,5 @@
 module www.github.com/matthewmazzanti/transcarent-tech-assignment
 
-go 1.16
+// http.Protocols, which lets net/http serve gRPC's HTTP/2 without TLS, and
+// so stands in for golang.org/x/net/http2/h2c, needs Go 1.24
+go 1.24
@@ -0,0 +1,911 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// GraphQL endpoint over users, posts and comments, so frontends can ask for
+// exactly the shape they need. This implements the subset of GraphQL the
+// schema needs: queries with aliases, arguments, variables and __typename.
+// Fragments, directives, mutations and introspection are not supported.
+//
+// The schema, in SDL:
+//
+//	type Query {
+//	  user(id: Int!): User
+//	  post(id: Int!): Post
+//	}
+//
+//	type User {
+//	  id: Int!
+//	  name: String!
+//	  username: String!
+//	  email: String!
+//	  posts: [Post!]!
+//	}
+//
+//	type Post {
+//	  id: Int!
+//	  userId: Int!
+//	  title: String!
+//	  body: String!
+//	  author: User
+//	  comments: [Comment!]!
+//	}
+//
+//	type Comment {
+//	  id: Int!
+//	  name: String!
+//	  email: String!
+//	  body: String!
+//	}
+
+// Limits on incoming queries. Depth counts nested selection sets, and
+// complexity counts fields, with fields under a list weighted as if the list
+// held gqlListWeight items.
+const maxGraphqlDepth = 6
+const maxGraphqlComplexity = 1000
+const gqlListWeight = 10
+
+// Maximum size of a query document, in bytes
+const maxGraphqlQueryLen = 8192
+
+// Resolved objects. These carry the ids needed to resolve their child fields,
+// which the plain User and Post types don't have.
+type gqlUser struct {
+	id int
+	user User
+}
+
+type gqlPost struct {
+	userId int
+	post Post
+}
+
+type Comment struct {
+	Id int
+	Name string
+	Email string
+	Body string
+}
+
+// A field of an object type. kind is the name of the field's type, and list
+// is set if the field holds a list of that type.
+type gqlFieldDef struct {
+	kind string
+	list bool
+	args map[string]string
+	resolve func(ctx *gqlContext, parent interface{}, args map[string]interface{}) (interface{}, error)
+}
+
+var gqlScalars = map[string]bool{ "Int": true, "String": true }
+
+var gqlSchema map[string]map[string]gqlFieldDef
+
+// The schema refers to the resolvers, some of which refer back to the
+// schema, so it is built at init
+func init() {
+	gqlSchema = map[string]map[string]gqlFieldDef{
+		"Query": {
+			"user": {
+				kind: "User",
+				args: map[string]string{ "id": "Int" },
+				resolve: func(ctx *gqlContext, _ interface{}, args map[string]interface{}) (interface{}, error) {
+					return ctx.users.load(ctx.ctx, args["id"].(int))
+				},
+			},
+			"post": {
+				kind: "Post",
+				args: map[string]string{ "id": "Int" },
+				resolve: func(ctx *gqlContext, _ interface{}, args map[string]interface{}) (interface{}, error) {
+					return getGqlPost(ctx.ctx, args["id"].(int))
+				},
+			},
+		},
+		"User": {
+			"id": gqlScalar("Int", func(p interface{}) interface{} { return p.(*gqlUser).id }),
+			"name": gqlScalar("String", func(p interface{}) interface{} { return p.(*gqlUser).user.Name }),
+			"username": gqlScalar("String", func(p interface{}) interface{} { return p.(*gqlUser).user.Username }),
+			"email": gqlScalar("String", func(p interface{}) interface{} { return p.(*gqlUser).user.Email }),
+			"posts": {
+				kind: "Post",
+				list: true,
+				resolve: func(ctx *gqlContext, parent interface{}, _ map[string]interface{}) (interface{}, error) {
+					user := parent.(*gqlUser)
+					res := getPosts(ctx.ctx, user.id)
+					if res.err != nil || errorStatus(res.status) {
+						return nil, fmt.Errorf("Failed to fetch posts")
+					}
+
+					posts := make([]interface{}, len(res.posts))
+					for i, post := range res.posts {
+						posts[i] = &gqlPost{ userId: user.id, post: post }
+					}
+					return posts, nil
+				},
+			},
+		},
+		"Post": {
+			"id": gqlScalar("Int", func(p interface{}) interface{} { return p.(*gqlPost).post.Id }),
+			"userId": gqlScalar("Int", func(p interface{}) interface{} { return p.(*gqlPost).userId }),
+			"title": gqlScalar("String", func(p interface{}) interface{} { return p.(*gqlPost).post.Title }),
+			"body": gqlScalar("String", func(p interface{}) interface{} { return p.(*gqlPost).post.Body }),
+			"author": {
+				kind: "User",
+				resolve: func(ctx *gqlContext, parent interface{}, _ map[string]interface{}) (interface{}, error) {
+					return ctx.users.load(ctx.ctx, parent.(*gqlPost).userId)
+				},
+			},
+			"comments": {
+				kind: "Comment",
+				list: true,
+				resolve: func(ctx *gqlContext, parent interface{}, _ map[string]interface{}) (interface{}, error) {
+					comments, err := getGqlComments(ctx.ctx, parent.(*gqlPost).post.Id)
+					if err != nil {
+						return nil, err
+					}
+
+					policy := redactionFor(ctx.ctx)
+					for i, comment := range comments {
+						comments[i] = policy.comment(comment.(*Comment))
+					}
+					return comments, nil
+				},
+			},
+		},
+		"Comment": {
+			"id": gqlScalar("Int", func(p interface{}) interface{} { return p.(*Comment).Id }),
+			"name": gqlScalar("String", func(p interface{}) interface{} { return p.(*Comment).Name }),
+			"email": gqlScalar("String", func(p interface{}) interface{} { return p.(*Comment).Email }),
+			"body": gqlScalar("String", func(p interface{}) interface{} { return p.(*Comment).Body }),
+		},
+	}
+}
+
+func gqlScalar(kind string, get func(parent interface{}) interface{}) gqlFieldDef {
+	return gqlFieldDef{
+		kind: kind,
+		resolve: func(_ *gqlContext, parent interface{}, _ map[string]interface{}) (interface{}, error) {
+			return get(parent), nil
+		},
+	}
+}
+
+// Fetch a single post, keeping its userId so the author can be resolved
+func getGqlPost(ctx context.Context, id int) (interface{}, error) {
+	res, status, err := fetchJson(ctx, fmt.Sprintf("/posts/%d", id))
+	if status == 404 {
+		return nil, nil
+	}
+	if err != nil || errorStatus(status) {
+		return nil, fmt.Errorf("Failed to fetch post")
+	}
+
+	post, err := parsePost(res)
+	if err != nil {
+		return nil, err
+	}
+
+	userId, err := indexInt(res.(map[string]interface{}), "userId")
+	if err != nil {
+		return nil, err
+	}
+
+	return &gqlPost{ userId: userId, post: post }, nil
+}
+
+func getGqlComments(ctx context.Context, postId int) ([]interface{}, error) {
+	res, status, err := fetchJson(ctx, fmt.Sprintf("/posts/%d/comments", postId))
+	if err != nil || errorStatus(status) {
+		return nil, fmt.Errorf("Failed to fetch comments")
+	}
+
+	data, ok := res.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("non-list json")
+	}
+
+	comments := make([]interface{}, len(data))
+	for i, commentIface := range data {
+		commentData, ok := commentIface.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("non-object json")
+		}
+
+		comment := &Comment{}
+		comment.Id, err = indexInt(commentData, "id")
+		if err != nil { return nil, err }
+
+		comment.Name, err = indexStr(commentData, "name")
+		if err != nil { return nil, err }
+
+		comment.Email, err = indexStr(commentData, "email")
+		if err != nil { return nil, err }
+
+		comment.Body, err = indexStr(commentData, "body")
+		if err != nil { return nil, err }
+
+		comments[i] = comment
+	}
+
+	return comments, nil
+}
+
+// Per-request loader for users. The upstream has no batch lookup, so batching
+// here means every distinct user is fetched at most once per request, no
+// matter how many posts refer to it. Concurrent loads of the same user share
+// a single in-flight request.
+type gqlUserLoader struct {
+	mu sync.Mutex
+	fetch func(ctx context.Context, id int) UserRes
+	entries map[int]*gqlUserEntry
+	// Users are redacted as they're loaded
+	policy redactionPolicy
+}
+
+type gqlUserEntry struct {
+	done chan struct{}
+	user *gqlUser
+	err error
+}
+
+func newGqlUserLoader() *gqlUserLoader {
+	return &gqlUserLoader{ fetch: getUser, entries: map[int]*gqlUserEntry{} }
+}
+
+func (loader *gqlUserLoader) load(ctx context.Context, id int) (interface{}, error) {
+	loader.mu.Lock()
+	entry, ok := loader.entries[id]
+	if !ok {
+		entry = &gqlUserEntry{ done: make(chan struct{}) }
+		loader.entries[id] = entry
+	}
+	loader.mu.Unlock()
+
+	if !ok {
+		res := loader.fetch(ctx, id)
+		switch {
+		case res.status == 404:
+			// Missing users resolve to null, rather than an error
+		case res.err != nil || errorStatus(res.status):
+			entry.err = fmt.Errorf("Failed to fetch user")
+		default:
+			entry.user = &gqlUser{ id: id, user: loader.policy.user(*res.user) }
+		}
+		close(entry.done)
+	}
+
+	<-entry.done
+	// Return an untyped nil for missing users, so the executor sees null
+	if entry.user == nil {
+		return nil, entry.err
+	}
+	return entry.user, entry.err
+}
+
+// State shared by every resolver in a single request
+type gqlContext struct {
+	ctx context.Context
+	users *gqlUserLoader
+	variables map[string]interface{}
+
+	mu sync.Mutex
+	errors []gqlError
+}
+
+type gqlError struct {
+	Message string `json:"message"`
+	Path []interface{} `json:"path,omitempty"`
+}
+
+func (ctx *gqlContext) addError(path []interface{}, err error) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	ctx.errors = append(ctx.errors, gqlError{ Message: err.Error(), Path: path })
+}
+
+// Parsed query document
+type gqlOperation struct {
+	name string
+	selections []gqlSelection
+}
+
+type gqlSelection struct {
+	alias string
+	name string
+	args map[string]gqlValue
+	selections []gqlSelection
+}
+
+// An argument value: either a literal, or a reference to a variable
+type gqlValue struct {
+	variable string
+	literal interface{}
+}
+
+func (sel gqlSelection) responseKey() string {
+	if sel.alias != "" {
+		return sel.alias
+	}
+	return sel.name
+}
+
+// Tokenizer for the query language. Commas are insignificant in GraphQL, and
+// are skipped along with whitespace and comments.
+type gqlLexer struct {
+	src []rune
+	pos int
+}
+
+type gqlToken struct {
+	kind string // "punct", "name", "int", "string" or "eof"
+	val string
+}
+
+func (lex *gqlLexer) next() (gqlToken, error) {
+	for lex.pos < len(lex.src) {
+		r := lex.src[lex.pos]
+		if r == '#' {
+			for lex.pos < len(lex.src) && lex.src[lex.pos] != '\n' {
+				lex.pos++
+			}
+			continue
+		}
+		if !unicode.IsSpace(r) && r != ',' && r != '\uFEFF' {
+			break
+		}
+		lex.pos++
+	}
+
+	if lex.pos >= len(lex.src) {
+		return gqlToken{ kind: "eof" }, nil
+	}
+
+	start := lex.pos
+	r := lex.src[lex.pos]
+	switch {
+	case strings.ContainsRune("{}():$!=[]@", r):
+		lex.pos++
+		return gqlToken{ "punct", string(r) }, nil
+
+	case r == '.':
+		if lex.pos+2 < len(lex.src) && string(lex.src[lex.pos:lex.pos+3]) == "..." {
+			lex.pos += 3
+			return gqlToken{ "punct", "..." }, nil
+		}
+		return gqlToken{}, fmt.Errorf("Unexpected character '.'")
+
+	case r == '_' || unicode.IsLetter(r):
+		for lex.pos < len(lex.src) && (lex.src[lex.pos] == '_' || unicode.IsLetter(lex.src[lex.pos]) || unicode.IsDigit(lex.src[lex.pos])) {
+			lex.pos++
+		}
+		return gqlToken{ "name", string(lex.src[start:lex.pos]) }, nil
+
+	case r == '-' || unicode.IsDigit(r):
+		lex.pos++
+		for lex.pos < len(lex.src) && unicode.IsDigit(lex.src[lex.pos]) {
+			lex.pos++
+		}
+		return gqlToken{ "int", string(lex.src[start:lex.pos]) }, nil
+
+	case r == '"':
+		lex.pos++
+		for lex.pos < len(lex.src) && lex.src[lex.pos] != '"' {
+			if lex.src[lex.pos] == '\\' {
+				lex.pos++
+			}
+			lex.pos++
+		}
+		if lex.pos >= len(lex.src) {
+			return gqlToken{}, fmt.Errorf("Unterminated string")
+		}
+		lex.pos++
+
+		// GraphQL string escapes are a subset of json's
+		var str string
+		err := json.Unmarshal([]byte(string(lex.src[start:lex.pos])), &str)
+		if err != nil {
+			return gqlToken{}, fmt.Errorf("Invalid string")
+		}
+		return gqlToken{ "string", str }, nil
+
+	default:
+		return gqlToken{}, fmt.Errorf("Unexpected character %q", r)
+	}
+}
+
+// Recursive descent parser over the token stream, with one token of
+// lookahead
+type gqlParser struct {
+	lex *gqlLexer
+	tok gqlToken
+}
+
+func parseGraphql(query string) ([]gqlOperation, error) {
+	parser := &gqlParser{ lex: &gqlLexer{ src: []rune(query) } }
+	err := parser.advance()
+	if err != nil {
+		return nil, err
+	}
+
+	var ops []gqlOperation
+	for parser.tok.kind != "eof" {
+		op, err := parser.parseOperation()
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+
+	if len(ops) == 0 {
+		return nil, fmt.Errorf("Query contains no operations")
+	}
+
+	return ops, nil
+}
+
+func (parser *gqlParser) advance() error {
+	tok, err := parser.lex.next()
+	parser.tok = tok
+	return err
+}
+
+func (parser *gqlParser) is(kind string, val string) bool {
+	return parser.tok.kind == kind && parser.tok.val == val
+}
+
+func (parser *gqlParser) expect(kind string, val string) error {
+	if !parser.is(kind, val) {
+		return fmt.Errorf("Expected %q, got %q", val, parser.tok.val)
+	}
+	return parser.advance()
+}
+
+func (parser *gqlParser) expectName() (string, error) {
+	if parser.tok.kind != "name" {
+		return "", fmt.Errorf("Expected a name, got %q", parser.tok.val)
+	}
+	name := parser.tok.val
+	return name, parser.advance()
+}
+
+func (parser *gqlParser) parseOperation() (gqlOperation, error) {
+	op := gqlOperation{}
+
+	// Shorthand queries are just a selection set
+	if !parser.is("punct", "{") {
+		keyword, err := parser.expectName()
+		if err != nil {
+			return op, err
+		}
+		if keyword != "query" {
+			return op, fmt.Errorf("Unsupported operation %q", keyword)
+		}
+
+		if parser.tok.kind == "name" {
+			op.name = parser.tok.val
+			parser.advance()
+		}
+
+		if parser.is("punct", "(") {
+			err := parser.skipVariableDefinitions()
+			if err != nil {
+				return op, err
+			}
+		}
+	}
+
+	selections, err := parser.parseSelectionSet()
+	op.selections = selections
+	return op, err
+}
+
+// Variable types are checked when arguments are coerced, so the definitions
+// themselves only need to be skipped over
+func (parser *gqlParser) skipVariableDefinitions() error {
+	depth := 0
+	for {
+		if parser.tok.kind == "eof" {
+			return fmt.Errorf("Unterminated variable definitions")
+		}
+		if parser.is("punct", "(") {
+			depth++
+		}
+		if parser.is("punct", ")") {
+			depth--
+		}
+		err := parser.advance()
+		if err != nil {
+			return err
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+func (parser *gqlParser) parseSelectionSet() ([]gqlSelection, error) {
+	err := parser.expect("punct", "{")
+	if err != nil {
+		return nil, err
+	}
+
+	var selections []gqlSelection
+	for !parser.is("punct", "}") {
+		if parser.is("punct", "...") {
+			return nil, fmt.Errorf("Fragments are not supported")
+		}
+		if parser.is("punct", "@") {
+			return nil, fmt.Errorf("Directives are not supported")
+		}
+
+		sel, err := parser.parseField()
+		if err != nil {
+			return nil, err
+		}
+		selections = append(selections, sel)
+	}
+
+	if len(selections) == 0 {
+		return nil, fmt.Errorf("Empty selection set")
+	}
+
+	return selections, parser.advance()
+}
+
+func (parser *gqlParser) parseField() (gqlSelection, error) {
+	sel := gqlSelection{}
+
+	name, err := parser.expectName()
+	if err != nil {
+		return sel, err
+	}
+
+	if parser.is("punct", ":") {
+		parser.advance()
+		sel.alias = name
+		name, err = parser.expectName()
+		if err != nil {
+			return sel, err
+		}
+	}
+	sel.name = name
+
+	if parser.is("punct", "(") {
+		parser.advance()
+		sel.args = map[string]gqlValue{}
+		for !parser.is("punct", ")") {
+			argName, err := parser.expectName()
+			if err != nil {
+				return sel, err
+			}
+
+			err = parser.expect("punct", ":")
+			if err != nil {
+				return sel, err
+			}
+
+			val, err := parser.parseValue()
+			if err != nil {
+				return sel, err
+			}
+			sel.args[argName] = val
+		}
+		parser.advance()
+	}
+
+	if parser.is("punct", "@") {
+		return sel, fmt.Errorf("Directives are not supported")
+	}
+
+	if parser.is("punct", "{") {
+		sel.selections, err = parser.parseSelectionSet()
+	}
+
+	return sel, err
+}
+
+func (parser *gqlParser) parseValue() (gqlValue, error) {
+	tok := parser.tok
+	switch {
+	case tok.kind == "punct" && tok.val == "$":
+		parser.advance()
+		name, err := parser.expectName()
+		return gqlValue{ variable: name }, err
+
+	case tok.kind == "int":
+		val, err := strconv.Atoi(tok.val)
+		if err != nil {
+			return gqlValue{}, fmt.Errorf("Invalid integer %s", tok.val)
+		}
+		return gqlValue{ literal: val }, parser.advance()
+
+	case tok.kind == "string":
+		return gqlValue{ literal: tok.val }, parser.advance()
+
+	case tok.kind == "name" && tok.val == "null":
+		return gqlValue{}, parser.advance()
+
+	default:
+		return gqlValue{}, fmt.Errorf("Unsupported argument value %q", tok.val)
+	}
+}
+
+// Check a selection set against the schema, returning its depth and
+// complexity. All of this happens before anything is fetched, so invalid or
+// expensive queries never reach the upstream.
+func validateGraphql(kind string, selections []gqlSelection) (int, int, error) {
+	maxDepth := 0
+	complexity := 0
+
+	for _, sel := range selections {
+		if sel.name == "__typename" {
+			complexity++
+			continue
+		}
+
+		field, ok := gqlSchema[kind][sel.name]
+		if !ok {
+			return 0, 0, fmt.Errorf("Cannot query field %q on type %q", sel.name, kind)
+		}
+
+		for name := range sel.args {
+			if _, ok := field.args[name]; !ok {
+				return 0, 0, fmt.Errorf("Unknown argument %q on field %q", name, sel.name)
+			}
+		}
+
+		for name := range field.args {
+			if _, ok := sel.args[name]; !ok {
+				return 0, 0, fmt.Errorf("Missing argument %q on field %q", name, sel.name)
+			}
+		}
+
+		if gqlScalars[field.kind] {
+			if sel.selections != nil {
+				return 0, 0, fmt.Errorf("Field %q of type %q has no subfields", sel.name, field.kind)
+			}
+			complexity++
+			continue
+		}
+
+		if sel.selections == nil {
+			return 0, 0, fmt.Errorf("Field %q of type %q must have a selection", sel.name, field.kind)
+		}
+
+		depth, childComplexity, err := validateGraphql(field.kind, sel.selections)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		if depth+1 > maxDepth {
+			maxDepth = depth + 1
+		}
+
+		if field.list {
+			childComplexity *= gqlListWeight
+		}
+		complexity += 1 + childComplexity
+	}
+
+	return maxDepth, complexity, nil
+}
+
+// Resolve argument values against the request's variables, checking them
+// against the types the field expects
+func (ctx *gqlContext) coerceArgs(field gqlFieldDef, sel gqlSelection) (map[string]interface{}, error) {
+	args := map[string]interface{}{}
+	for name, kind := range field.args {
+		val := sel.args[name]
+		raw := val.literal
+		if val.variable != "" {
+			raw = ctx.variables[val.variable]
+		}
+
+		switch kind {
+		case "Int":
+			switch num := raw.(type) {
+			case int:
+				args[name] = num
+			// Variables come from json, where every number is a float
+			case float64:
+				if num != float64(int(num)) {
+					return nil, fmt.Errorf("Argument %q must be an Int", name)
+				}
+				args[name] = int(num)
+			default:
+				return nil, fmt.Errorf("Argument %q must be an Int", name)
+			}
+
+		case "String":
+			str, ok := raw.(string)
+			if !ok {
+				return nil, fmt.Errorf("Argument %q must be a String", name)
+			}
+			args[name] = str
+		}
+	}
+
+	return args, nil
+}
+
+// Resolve a selection set on a parent object. Field errors are collected on
+// the context, and the field is set to null, so one failing field doesn't
+// fail the whole query.
+func (ctx *gqlContext) execute(kind string, parent interface{}, selections []gqlSelection, path []interface{}) orderedObject {
+	obj := make(orderedObject, len(selections))
+
+	// Fields resolve concurrently, so loads of the same user from sibling
+	// fields share one upstream request
+	wg := &sync.WaitGroup{}
+	for i, sel := range selections {
+		obj[i].key = sel.responseKey()
+		if sel.name == "__typename" {
+			obj[i].val = kind
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, sel gqlSelection) {
+			defer wg.Done()
+			fieldPath := append(append([]interface{}{}, path...), sel.responseKey())
+			obj[i].val = ctx.executeField(kind, parent, sel, fieldPath)
+		}(i, sel)
+	}
+	wg.Wait()
+
+	return obj
+}
+
+func (ctx *gqlContext) executeField(kind string, parent interface{}, sel gqlSelection, path []interface{}) interface{} {
+	field := gqlSchema[kind][sel.name]
+
+	args, err := ctx.coerceArgs(field, sel)
+	if err != nil {
+		ctx.addError(path, err)
+		return nil
+	}
+
+	res, err := field.resolve(ctx, parent, args)
+	if err != nil {
+		ctx.addError(path, err)
+		return nil
+	}
+
+	if res == nil || gqlScalars[field.kind] {
+		return res
+	}
+
+	if !field.list {
+		return ctx.execute(field.kind, res, sel.selections, path)
+	}
+
+	items := res.([]interface{})
+	list := make([]interface{}, len(items))
+	wg := &sync.WaitGroup{}
+	for i, item := range items {
+		wg.Add(1)
+		go func(i int, item interface{}) {
+			defer wg.Done()
+			itemPath := append(append([]interface{}{}, path...), i)
+			list[i] = ctx.execute(field.kind, item, sel.selections, itemPath)
+		}(i, item)
+	}
+	wg.Wait()
+
+	return list
+}
+
+type gqlRequest struct {
+	Query string `json:"query"`
+	OperationName string `json:"operationName"`
+	Variables map[string]interface{} `json:"variables"`
+}
+
+type gqlResponse struct {
+	Data interface{} `json:"data,omitempty"`
+	Errors []gqlError `json:"errors,omitempty"`
+}
+
+// Parse, validate and execute a request. Returns the http status to respond
+// with along with the response body.
+func runGraphql(ctx context.Context, req gqlRequest) (int, gqlResponse) {
+	fail := func(err error) (int, gqlResponse) {
+		return 400, gqlResponse{ Errors: []gqlError{{ Message: err.Error() }} }
+	}
+
+	if len(req.Query) > maxGraphqlQueryLen {
+		return fail(fmt.Errorf("Query is longer than %d bytes", maxGraphqlQueryLen))
+	}
+
+	ops, err := parseGraphql(req.Query)
+	if err != nil {
+		return fail(err)
+	}
+
+	var op *gqlOperation
+	for i := range ops {
+		if req.OperationName == "" && len(ops) == 1 || ops[i].name == req.OperationName {
+			op = &ops[i]
+		}
+	}
+	if op == nil {
+		return fail(fmt.Errorf("Unknown operation %q", req.OperationName))
+	}
+
+	depth, complexity, err := validateGraphql("Query", op.selections)
+	if err != nil {
+		return fail(err)
+	}
+
+	if depth > maxGraphqlDepth {
+		return fail(fmt.Errorf("Query depth %d exceeds limit of %d", depth, maxGraphqlDepth))
+	}
+
+	if complexity > maxGraphqlComplexity {
+		return fail(fmt.Errorf(
+			"Query complexity %d exceeds limit of %d",
+			complexity,
+			maxGraphqlComplexity,
+		))
+	}
+
+	gqlCtx := &gqlContext{
+		ctx: ctx,
+		users: newGqlUserLoader(),
+		variables: req.Variables,
+	}
+	gqlCtx.users.policy = redactionFor(ctx)
+
+	data := gqlCtx.execute("Query", nil, op.selections, nil)
+	return 200, gqlResponse{ Data: data, Errors: gqlCtx.errors }
+}
+
+// Queries are accepted either as a json POST body, or via query params on a
+// GET
+func handleGraphql(w http.ResponseWriter, r *http.Request) {
+	req := gqlRequest{}
+
+	switch r.Method {
+	case "GET":
+		req.Query = r.URL.Query().Get("query")
+		req.OperationName = r.URL.Query().Get("operationName")
+		if vars := r.URL.Query().Get("variables"); vars != "" {
+			err := json.Unmarshal([]byte(vars), &req.Variables)
+			if err != nil {
+				writeError(w, 400, "Invalid variables")
+				return
+			}
+		}
+
+	case "POST":
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxGraphqlQueryLen * 2)).Decode(&req)
+		if err != nil {
+			writeError(w, 400, "Invalid request body")
+			return
+		}
+
+	default:
+		writeError(w, 405, "Method not allowed")
+		return
+	}
+
+	status, res := runGraphql(r.Context(), req)
+
+	resJson, err := json.MarshalIndent(res, "", "  ")
+	if err != nil {
+		writeError(w, 500, "Something went wrong")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(resJson)
+}
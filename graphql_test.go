@@ -0,0 +1,184 @@
+package main
+
+import (
+	"testing"
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+)
+
+func TestParseGraphql(t *testing.T) {
+	ops, err := parseGraphql(`
+		# Comments and commas are ignored
+		query Named($id: Int!) {
+			me: user(id: $id) { name, posts { id } }
+			post(id: 1) { title }
+		}
+	`)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing query: %v", err)
+	}
+
+	if len(ops) != 1 || ops[0].name != "Named" || len(ops[0].selections) != 2 {
+		t.Fatalf("Got unexpected operations: %v", ops)
+	}
+
+	me := ops[0].selections[0]
+	if me.alias != "me" || me.name != "user" || me.args["id"].variable != "id" {
+		t.Fatalf("Got unexpected selection: %v", me)
+	}
+
+	if ops[0].selections[1].args["id"].literal != 1 {
+		t.Fatalf("Got unexpected selection: %v", ops[0].selections[1])
+	}
+
+	bad := []string{
+		``,
+		`{ user(id: 1) { ...UserFields } }`,
+		`mutation { deletePost(id: 1) }`,
+		`{ user(id: 1) { name }`,
+		`{ user(id: "1) { name } }`,
+		`{ user(id: 1) @include(if: true) { name } }`,
+	}
+
+	for _, query := range bad {
+		_, err := parseGraphql(query)
+		if err == nil {
+			t.Fatalf("Did not get error parsing query: %s", query)
+		}
+	}
+}
+
+func TestValidateGraphql(t *testing.T) {
+	ops, _ := parseGraphql(`{ user(id: 1) { name posts { id author { name } } } }`)
+	depth, complexity, err := validateGraphql("Query", ops[0].selections)
+	if err != nil {
+		t.Fatalf("Unexpected error validating query: %v", err)
+	}
+
+	// user + name + posts * (id + author + name)
+	if depth != 3 || complexity != 1 + 1 + 1 + 10 * 3 {
+		t.Fatalf("Got unexpected depth %d and complexity %d", depth, complexity)
+	}
+
+	bad := []string{
+		`{ user(id: 1) { password } }`,
+		`{ user { name } }`,
+		`{ user(id: 1, name: "x") { name } }`,
+		`{ user(id: 1) }`,
+		`{ user(id: 1) { name { first } } }`,
+	}
+
+	for _, query := range bad {
+		ops, _ := parseGraphql(query)
+		_, _, err := validateGraphql("Query", ops[0].selections)
+		if err == nil {
+			t.Fatalf("Did not get error validating query: %s", query)
+		}
+	}
+}
+
+func TestRunGraphqlLimits(t *testing.T) {
+	deep := `{ user(id: 1) { posts { author { posts { author { posts { author { name } } } } } } } }`
+	status, res := runGraphql(context.TODO(), gqlRequest{ Query: deep })
+	if status != 400 || !strings.Contains(res.Errors[0].Message, "depth") {
+		t.Fatalf("Got unexpected response: %d %v", status, res)
+	}
+
+	wide := `{
+		a: user(id: 1) { posts { comments { id name email body } author { posts { id title body } } } }
+		b: user(id: 2) { posts { comments { id name email body } author { posts { id title body } } } }
+	}`
+	status, res = runGraphql(context.TODO(), gqlRequest{ Query: wide })
+	if status != 400 || !strings.Contains(res.Errors[0].Message, "complexity") {
+		t.Fatalf("Got unexpected response: %d %v", status, res)
+	}
+}
+
+func TestRunGraphql(t *testing.T) {
+	startFakeUpstream(t)
+
+	status, res := runGraphql(context.TODO(), gqlRequest{
+		Query: `query($id: Int!) {
+			user(id: $id) { __typename name posts { id } }
+			missing: user(id: 2) { name }
+			post(id: 1) { title author { username } comments { email } }
+		}`,
+		Variables: map[string]interface{}{ "id": float64(1) },
+	})
+
+	if status != 200 || len(res.Errors) != 0 {
+		t.Fatalf("Got unexpected response: %d %v", status, res)
+	}
+
+	resJson, _ := json.Marshal(res.Data)
+
+	var exp interface{}
+	json.Unmarshal([]byte(`{
+		"user": {
+			"__typename": "User",
+			"name": "Leanne Graham",
+			"posts": [
+				{"id": 1}, {"id": 2}, {"id": 3}, {"id": 4}, {"id": 5},
+				{"id": 6}, {"id": 7}, {"id": 8}, {"id": 9}, {"id": 10}
+			]
+		},
+		"missing": null,
+		"post": {
+			"title": "sunt aut facere repellat provident occaecati excepturi optio reprehenderit",
+			"author": {"username": "Bret"},
+			"comments": [
+				{"email": "Eliseo@gardner.biz"},
+				{"email": "Jayne_Kuhic@sydney.com"}
+			]
+		}
+	}`), &exp)
+
+	expJson, _ := json.Marshal(exp)
+	var data interface{}
+	json.Unmarshal(resJson, &data)
+	dataJson, _ := json.Marshal(data)
+
+	if string(expJson) != string(dataJson) {
+		t.Fatalf("\nExpected:\n%s\nGot:\n%s\n", expJson, dataJson)
+	}
+
+	// Keys should come back in the order they were asked for
+	if !strings.HasPrefix(string(resJson), `{"user":{"__typename":"User","name"`) {
+		t.Fatalf("Fields out of order: %s", resJson)
+	}
+}
+
+func TestGqlUserLoader(t *testing.T) {
+	fetches := map[int]int{}
+	mu := sync.Mutex{}
+
+	loader := newGqlUserLoader()
+	loader.fetch = func(ctx context.Context, id int) UserRes {
+		mu.Lock()
+		fetches[id]++
+		mu.Unlock()
+		return UserRes{ user: &User{ Name: "user" }, status: 200 }
+	}
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			loader.load(context.TODO(), id)
+		}(i % 3)
+	}
+	wg.Wait()
+
+	for id, count := range fetches {
+		if count != 1 {
+			t.Fatalf("User %d fetched %d times", id, count)
+		}
+	}
+
+	if len(fetches) != 3 {
+		t.Fatalf("Got unexpected fetches: %v", fetches)
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// gRPC interface to getUserPosts, for services on the backend mesh. gRPC is
+// plain HTTP/2 with length prefixed protobuf messages and the status sent in
+// trailers, so the service is served by net/http and the hand-written
+// encoding in protobuf.go, rather than pulling in the grpc runtime.
+// See userposts.proto for the service definition.
+//
+// Calls go through the same authentication, access logs and rate limits as
+// the http server, and are served over TLS whenever it is.
+
+// Address to serve gRPC on. Empty turns it off.
+var grpcAddr = ":9090"
+
+const grpcServicePath = "/userposts.v1.UserPostsService/"
+
+// Requests larger than this are rejected. The request messages are tiny, so
+// this only guards against abuse.
+const maxGrpcMessageSize = 1 << 20
+
+// Maximum number of users a single ListUserPosts call can ask for
+const maxGrpcListIds = 50
+
+// gRPC status codes, as defined in the gRPC spec
+const (
+	grpcOk = 0
+	grpcCancelled = 1
+	grpcInvalidArgument = 3
+	grpcNotFound = 5
+	grpcPermissionDenied = 7
+	grpcResourceExhausted = 8
+	grpcUnimplemented = 12
+	grpcInternal = 13
+	grpcUnavailable = 14
+	grpcUnauthenticated = 16
+)
+
+// Map the outcome of getUserPosts to a gRPC status. This mirrors the error
+// handling of the http handler, with upstream trouble reported as
+// unavailable so clients know it is worth retrying.
+func grpcStatus(status int, err error) (int, string) {
+	switch {
+	case status == 404:
+		return grpcNotFound, "Not found"
+	case status == 429:
+		return grpcResourceExhausted, "Upstream rate limited"
+	case err != nil, status >= 500:
+		return grpcUnavailable, "Something went wrong"
+	case errorStatus(status):
+		return grpcInternal, "Something went wrong"
+	default:
+		return grpcOk, ""
+	}
+}
+
+func runGrpcServer(wg *sync.WaitGroup) *http.Server {
+	// Without TLS, gRPC clients speak HTTP/2 using prior knowledge
+	protocols := &http.Protocols{}
+	if serverTls != nil {
+		protocols.SetHTTP2(true)
+	} else {
+		protocols.SetUnencryptedHTTP2(true)
+	}
+
+	handler := http.NewServeMux()
+	handler.HandleFunc(grpcServicePath, handleGrpc)
+
+	srv := &http.Server{
+		Addr: grpcAddr,
+		Handler: authenticate(logRequests(limitClients(handler))),
+		Protocols: protocols,
+	}
+	if serverTls != nil {
+		srv.TLSConfig = serverTls.config()
+	}
+
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		var err error
+		if serverTls != nil {
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			log.Fatalf("gRPC server stopped due to error: %v", err)
+		}
+	}()
+
+	return srv
+}
+
+// Answer a refusal from the auth checks with the matching gRPC status
+func writeGrpcProblem(w http.ResponseWriter, problem *Problem) {
+	code := grpcPermissionDenied
+	if problem.Status == 401 {
+		code = grpcUnauthenticated
+	}
+	writeGrpcStatus(w, code, problem.Detail)
+}
+
+func handleGrpc(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		w.WriteHeader(415)
+		return
+	}
+
+	// Headers aren't written explicitly. Errors that precede any response
+	// message then go out as a "trailers-only" response, with the status
+	// alongside the content type.
+	w.Header().Set("Content-Type", "application/grpc+proto")
+
+	// Both methods are about single users, so tokens for one user are let
+	// through, and checked against each id asked for
+	if problem := scopeProblem(r, scopeUserPostsRead, true); problem != nil {
+		writeGrpcProblem(w, problem)
+		return
+	}
+
+	reqMsg, err := readGrpcMessage(r.Body)
+	if err != nil {
+		writeGrpcStatus(w, grpcInvalidArgument, err.Error())
+		return
+	}
+
+	method := strings.TrimPrefix(r.URL.Path, grpcServicePath)
+	switch method {
+	case "GetUserPosts":
+		grpcGetUserPosts(w, r, reqMsg)
+	case "ListUserPosts":
+		grpcListUserPosts(w, r, reqMsg)
+	default:
+		writeGrpcStatus(w, grpcUnimplemented, fmt.Sprintf("Unknown method %s", method))
+	}
+}
+
+func grpcGetUserPosts(w http.ResponseWriter, r *http.Request, reqMsg []byte) {
+	ids, err := unmarshalIdsProto(reqMsg)
+	if err != nil {
+		writeGrpcStatus(w, grpcInvalidArgument, err.Error())
+		return
+	}
+
+	id := 0
+	if len(ids) > 0 {
+		id = ids[len(ids)-1]
+	}
+
+	if id < 0 {
+		writeGrpcStatus(w, grpcInvalidArgument, "id must be non-negative")
+		return
+	}
+	if problem := userPostsProblem(r, id); problem != nil {
+		writeGrpcProblem(w, problem)
+		return
+	}
+
+	userPosts, status, err := getUserPostsContext(r.Context(), id)
+	code, msg := grpcStatus(status, err)
+	if code != grpcOk {
+		writeGrpcStatus(w, code, msg)
+		return
+	}
+
+	writeGrpcMessage(w, marshalUserPostsProto(redactionFor(r.Context()).userPosts(userPosts), nil))
+	writeGrpcStatus(w, grpcOk, "")
+}
+
+func grpcListUserPosts(w http.ResponseWriter, r *http.Request, reqMsg []byte) {
+	ids, err := unmarshalIdsProto(reqMsg)
+	if err != nil {
+		writeGrpcStatus(w, grpcInvalidArgument, err.Error())
+		return
+	}
+	if len(ids) > maxGrpcListIds {
+		writeGrpcStatus(w, grpcInvalidArgument, fmt.Sprintf("At most %d ids can be listed", maxGrpcListIds))
+		return
+	}
+
+	for _, id := range ids {
+		if id < 0 {
+			writeGrpcStatus(w, grpcInvalidArgument, "ids must be non-negative")
+			return
+		}
+		if problem := userPostsProblem(r, id); problem != nil {
+			writeGrpcProblem(w, problem)
+			return
+		}
+	}
+
+	// Fetch one id at a time, sending each as soon as it's ready so the
+	// client can start processing before the whole list is done
+	for _, id := range ids {
+		if r.Context().Err() != nil {
+			writeGrpcStatus(w, grpcCancelled, "Request cancelled")
+			return
+		}
+
+		userPosts, status, err := getUserPostsContext(r.Context(), id)
+		code, msg := grpcStatus(status, err)
+		if code != grpcOk {
+			writeGrpcStatus(w, code, fmt.Sprintf("User %d: %s", id, msg))
+			return
+		}
+
+		writeGrpcMessage(w, marshalUserPostsProto(redactionFor(r.Context()).userPosts(userPosts), nil))
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	}
+
+	writeGrpcStatus(w, grpcOk, "")
+}
+
+// Read a single length prefixed message. The prefix is a compression flag
+// byte followed by a 4 byte big-endian length. Compression is never
+// negotiated, so the flag must be unset.
+func readGrpcMessage(body io.Reader) ([]byte, error) {
+	prefix := make([]byte, 5)
+	_, err := io.ReadFull(body, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("Missing request message")
+	}
+
+	if prefix[0] != 0 {
+		return nil, fmt.Errorf("Compressed messages are not supported")
+	}
+
+	length := binary.BigEndian.Uint32(prefix[1:])
+	if length > maxGrpcMessageSize {
+		return nil, fmt.Errorf("Request message too large")
+	}
+
+	msg := make([]byte, length)
+	_, err = io.ReadFull(body, msg)
+	if err != nil {
+		return nil, fmt.Errorf("Truncated request message")
+	}
+
+	return msg, nil
+}
+
+func writeGrpcMessage(w io.Writer, msg []byte) error {
+	prefix := make([]byte, 5)
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(msg)))
+
+	_, err := w.Write(append(prefix, msg...))
+	return err
+}
+
+// Send the call's status as trailers. grpc-message is percent encoded, as
+// required by the spec.
+func writeGrpcStatus(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set(http.TrailerPrefix + "Grpc-Status", strconv.Itoa(code))
+	if msg != "" {
+		w.Header().Set(http.TrailerPrefix + "Grpc-Message", url.PathEscape(msg))
+	}
+}
+
+// Decode the id field shared by both request messages. repeated fields may
+// arrive packed into a single length delimited field, or one varint at a
+// time, and both forms must be accepted.
+func unmarshalIdsProto(data []byte) ([]int, error) {
+	fields, err := readProtoFields(data)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []int{}
+	for _, field := range fields {
+		if field.field != 1 {
+			continue
+		}
+
+		switch field.wireType {
+		case wireVarint:
+			ids = append(ids, int(int64(field.varint)))
+
+		case wireBytes:
+			packed := field.bytes
+			for len(packed) > 0 {
+				val, n := binary.Uvarint(packed)
+				if n <= 0 {
+					return nil, fmt.Errorf("Invalid packed ids")
+				}
+				ids = append(ids, int(int64(val)))
+				packed = packed[n:]
+			}
+		}
+	}
+
+	return ids, nil
+}
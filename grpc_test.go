@@ -0,0 +1,261 @@
+package main
+
+import (
+	"testing"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"reflect"
+	"sync"
+)
+
+func grpcCall(t *testing.T, method string, reqMsg []byte) ([][]byte, http.Header) {
+	protocols := &http.Protocols{}
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{ Transport: &http.Transport{ Protocols: protocols } }
+
+	return grpcCallWith(t, client, "http://localhost:9090", method, reqMsg, nil)
+}
+
+func grpcCallWith(t *testing.T, client *http.Client, baseUrl string, method string, reqMsg []byte, header http.Header) ([][]byte, http.Header) {
+	body := &bytes.Buffer{}
+	writeGrpcMessage(body, reqMsg)
+
+	req, _ := http.NewRequest(
+		"POST",
+		baseUrl + grpcServicePath + method,
+		body,
+	)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("gRPC request failed: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.ProtoMajor != 2 {
+		t.Fatalf("gRPC response was not HTTP/2: %s", res.Proto)
+	}
+
+	var msgs [][]byte
+	for {
+		msg, err := readGrpcMessage(res.Body)
+		if err != nil {
+			break
+		}
+		msgs = append(msgs, msg)
+	}
+
+	// Trailers are only populated once the body is drained
+	io.Copy(io.Discard, res.Body)
+	return msgs, res.Trailer
+}
+
+func TestGrpcServer(t *testing.T) {
+	startFakeUpstream(t)
+
+	serverExit := &sync.WaitGroup{}
+	srv := runGrpcServer(serverExit)
+	waitForServer(t, "localhost:9090")
+
+	exp := &UserPosts{ Id: 1, UserInfo: *expUser, Posts: expPosts }
+
+	// GetUserPosts, with id 1
+	msgs, trailer := grpcCall(t, "GetUserPosts", []byte{0x08, 0x01})
+	if trailer.Get("Grpc-Status") != "0" || len(msgs) != 1 {
+		t.Fatalf("Unexpected response: %v %v", trailer, msgs)
+	}
+
+	page, _ := unmarshalUserPostsProto(msgs[0])
+	if !reflect.DeepEqual(exp, &page.UserPosts) {
+		t.Fatalf("\nExpected:\n%v\nGot:\n%v\n", exp, page.UserPosts)
+	}
+
+	// Missing users are not found
+	_, trailer = grpcCall(t, "GetUserPosts", []byte{0x08, 0x02})
+	if trailer.Get("Grpc-Status") != "5" {
+		t.Fatalf("Unexpected status: %v", trailer)
+	}
+
+	// ListUserPosts with packed ids 1, 1, 2. The stream stops at the
+	// missing user
+	msgs, trailer = grpcCall(t, "ListUserPosts", []byte{0x0a, 0x03, 0x01, 0x01, 0x02})
+	if trailer.Get("Grpc-Status") != "5" || len(msgs) != 2 {
+		t.Fatalf("Unexpected response: %v %d messages", trailer, len(msgs))
+	}
+
+	// Unpacked ids are also accepted
+	msgs, trailer = grpcCall(t, "ListUserPosts", []byte{0x08, 0x01, 0x08, 0x01})
+	if trailer.Get("Grpc-Status") != "0" || len(msgs) != 2 {
+		t.Fatalf("Unexpected response: %v %d messages", trailer, len(msgs))
+	}
+
+	// Too many ids are rejected before anything is fetched
+	tooMany := []byte{}
+	for i := 0; i <= maxGrpcListIds; i++ {
+		tooMany = append(tooMany, 0x08, 0x01)
+	}
+	msgs, trailer = grpcCall(t, "ListUserPosts", tooMany)
+	if trailer.Get("Grpc-Status") != "3" || len(msgs) != 0 {
+		t.Fatalf("Unexpected response: %v %d messages", trailer, len(msgs))
+	}
+
+	_, trailer = grpcCall(t, "DeleteUserPosts", []byte{})
+	if trailer.Get("Grpc-Status") != "12" {
+		t.Fatalf("Unexpected status: %v", trailer)
+	}
+
+	err := srv.Shutdown(context.TODO())
+	if err != nil {
+		t.Fatalf("Server failed to shut down")
+	}
+
+	serverExit.Wait()
+}
+
+func TestGrpcAuth(t *testing.T) {
+	startFakeUpstream(t)
+	keys := useApiKeys(t, map[string][]string{
+		"reader": { scopeUserPostsRead },
+		"writer": { scopePostsWrite },
+	})
+	jwtKeys := useJwtAuth(t)
+	claims := validClaims()
+	claims["sub"] = "user:1"
+	token := signJwt(t, "RS256", "rsa", jwtKeys.rsa, claims)
+
+	serverExit := &sync.WaitGroup{}
+	srv := runGrpcServer(serverExit)
+	waitForServer(t, "localhost:9090")
+	defer func() {
+		srv.Shutdown(context.TODO())
+		serverExit.Wait()
+	}()
+
+	protocols := &http.Protocols{}
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{ Transport: &http.Transport{ Protocols: protocols } }
+
+	tests := []struct {
+		name string
+		method string
+		reqMsg []byte
+		header http.Header
+		status string
+	}{
+		{ "no credentials", "GetUserPosts", []byte{0x08, 0x01}, nil, "16" },
+		{ "bad key", "GetUserPosts", []byte{0x08, 0x01}, http.Header{ "X-Api-Key": { "nope" } }, "16" },
+		{ "missing scope", "GetUserPosts", []byte{0x08, 0x01}, http.Header{ "X-Api-Key": { keys["writer"] } }, "7" },
+		{ "reader", "GetUserPosts", []byte{0x08, 0x01}, http.Header{ "X-Api-Key": { keys["reader"] } }, "0" },
+		{ "own user", "GetUserPosts", []byte{0x08, 0x01}, http.Header{ "Authorization": { "Bearer " + token } }, "0" },
+		{ "other user", "GetUserPosts", []byte{0x08, 0x02}, http.Header{ "Authorization": { "Bearer " + token } }, "7" },
+		{ "other user in list", "ListUserPosts", []byte{0x08, 0x01, 0x08, 0x02}, http.Header{ "Authorization": { "Bearer " + token } }, "7" },
+	}
+
+	for _, test := range tests {
+		_, trailer := grpcCallWith(t, client, "http://localhost:9090", test.method, test.reqMsg, test.header)
+		if trailer.Get("Grpc-Status") != test.status {
+			t.Fatalf("%s: expected status %s, got %v", test.name, test.status, trailer)
+		}
+	}
+}
+
+func TestGrpcTls(t *testing.T) {
+	startFakeUpstream(t)
+
+	dir := t.TempDir()
+	ca := newTestCa(t)
+	certPath, keyPath := ca.writeCert(t, dir, "server")
+	reloader, err := newTlsReloader(TlsOptions{ CertFile: certPath, KeyFile: keyPath, MinVersion: "1.2" })
+	if err != nil {
+		t.Fatalf("Failed to set up TLS: %v", err)
+	}
+
+	prevTls := serverTls
+	serverTls = reloader
+	defer func() { serverTls = prevTls }()
+
+	serverExit := &sync.WaitGroup{}
+	srv := runGrpcServer(serverExit)
+	waitForServer(t, "localhost:9090")
+	defer func() {
+		srv.Shutdown(context.TODO())
+		serverExit.Wait()
+	}()
+
+	client := &http.Client{ Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{ RootCAs: ca.pool() },
+		ForceAttemptHTTP2: true,
+	} }
+	msgs, trailer := grpcCallWith(t, client, "https://localhost:9090", "GetUserPosts", []byte{0x08, 0x01}, nil)
+	if trailer.Get("Grpc-Status") != "0" || len(msgs) != 1 {
+		t.Fatalf("Unexpected response over TLS: %v %v", trailer, msgs)
+	}
+}
+
+func TestGrpcStatus(t *testing.T) {
+	cases := []struct {
+		status int
+		err error
+		exp int
+	}{
+		{ 200, nil, grpcOk },
+		{ 404, nil, grpcNotFound },
+		{ 429, nil, grpcResourceExhausted },
+		{ 503, nil, grpcUnavailable },
+		{ 0, io.EOF, grpcUnavailable },
+		{ 400, nil, grpcInternal },
+	}
+
+	for _, c := range cases {
+		code, _ := grpcStatus(c.status, c.err)
+		if code != c.exp {
+			t.Fatalf("Expected code %d for %d %v, got %d", c.exp, c.status, c.err, code)
+		}
+	}
+}
+
+func TestGrpcRedaction(t *testing.T) {
+	startFakeUpstream(t)
+	keys := useApiKeys(t, map[string][]string{
+		"reporting": { scopeUserPostsRead },
+		"support": { scopeUserPostsRead },
+	})
+	useRedaction(t, redactionFile{
+		Default: RedactionFields{ Email: redactMasked },
+		Rules: []RedactionRule{ { Client: "support", Fields: RedactionFields{ Email: redactFull } } },
+	})
+
+	serverExit := &sync.WaitGroup{}
+	srv := runGrpcServer(serverExit)
+	waitForServer(t, "localhost:9090")
+	defer func() {
+		srv.Shutdown(context.TODO())
+		serverExit.Wait()
+	}()
+
+	protocols := &http.Protocols{}
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{ Transport: &http.Transport{ Protocols: protocols } }
+
+	// Each caller gets their own policy
+	expected := map[string]string{ "reporting": "S*****@april.biz", "support": expUser.Email }
+	for id, email := range expected {
+		header := http.Header{ "X-Api-Key": { keys[id] } }
+		msgs, trailer := grpcCallWith(t, client, "http://localhost:9090", "GetUserPosts", []byte{0x08, 0x01}, header)
+		if trailer.Get("Grpc-Status") != "0" || len(msgs) != 1 {
+			t.Fatalf("%s: unexpected response: %v %v", id, trailer, msgs)
+		}
+
+		page, _ := unmarshalUserPostsProto(msgs[0])
+		if page.UserInfo.Email != email {
+			t.Fatalf("%s: expected email %s, got %s", id, email, page.UserInfo.Email)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Hedged reads. When a GET to the upstream takes longer than most recent
+// requests to the same endpoint have, a duplicate is sent, and whichever
+// answers first is used, cancelling the other. Hedges are paid for from a
+// budget that each request adds a fraction to, so they can never add more than
+// that fraction of extra load, even when the upstream slows down across the
+// board.
+
+var hedgeEnabled = false
+
+// Hedge once a request has taken longer than this share of recent requests
+var hedgePercentile = 0.95
+
+// Extra requests allowed, as a share of all requests
+var hedgeMaxExtraLoad = 0.05
+
+// Unused budget is capped, so a quiet spell can't save up for a burst
+const hedgeBudgetCap = 10.0
+
+// Number of recent latencies kept per endpoint, and how many are needed before
+// hedging starts
+const hedgeSampleSize = 500
+const hedgeMinSamples = 20
+
+// Requests faster than this are never worth hedging
+var hedgeMinDelay = 5 * time.Millisecond
+
+type hedgeResult struct {
+	res interface{}
+	status int
+	err error
+	hedge bool
+}
+
+// Stats shown by /v1/admin/hedging
+type HedgeStats struct {
+	Enabled bool `json:"enabled"`
+	Requests int `json:"requests"`
+	Hedges int `json:"hedges"`
+	HedgeWins int `json:"hedgeWins"`
+	// Current hedging delay per endpoint, once there are enough samples
+	DelaysMs map[string]float64 `json:"delaysMs"`
+}
+
+type hedger struct {
+	mu sync.Mutex
+	samples map[string][]time.Duration
+	next map[string]int
+	budget float64
+
+	requests int
+	hedges int
+	hedgeWins int
+}
+
+func newHedger() *hedger {
+	return &hedger{ samples: map[string][]time.Duration{}, next: map[string]int{} }
+}
+
+var hedges = newHedger()
+
+var hedgeIdPattern = regexp.MustCompile(`[0-9]+`)
+
+// Group paths by endpoint, so /users/1 and /users/2 share their latencies
+func hedgeEndpoint(path string) string {
+	return hedgeIdPattern.ReplaceAllString(path, "{id}")
+}
+
+func (h *hedger) observe(endpoint string, elapsed time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	samples := h.samples[endpoint]
+	if len(samples) < hedgeSampleSize {
+		h.samples[endpoint] = append(samples, elapsed)
+		return
+	}
+
+	samples[h.next[endpoint]] = elapsed
+	h.next[endpoint] = (h.next[endpoint] + 1) % hedgeSampleSize
+}
+
+// How long to wait before hedging a request to the endpoint. ok is false if
+// there aren't enough samples yet. Must be called with the lock held.
+func (h *hedger) delay(endpoint string) (time.Duration, bool) {
+	samples := h.samples[endpoint]
+	if len(samples) < hedgeMinSamples {
+		return 0, false
+	}
+
+	sorted := append([]time.Duration{}, samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	index := int(hedgePercentile * float64(len(sorted)))
+	if index >= len(sorted) {
+		index = len(sorted) - 1
+	}
+
+	return max(sorted[index], hedgeMinDelay), true
+}
+
+// Count a request, and work out when to hedge it, if at all
+func (h *hedger) plan(endpoint string) (time.Duration, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.requests++
+	h.budget = min(h.budget + hedgeMaxExtraLoad, hedgeBudgetCap)
+	return h.delay(endpoint)
+}
+
+// Spend from the budget on a hedge, if there's enough
+func (h *hedger) take() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.budget < 1 {
+		return false
+	}
+	h.budget--
+	h.hedges++
+	return true
+}
+
+// Whether a result is worth waiting for the other request over
+func hedgeFailed(result hedgeResult) bool {
+	return (result.err != nil && result.status == 0) || result.status >= 500
+}
+
+// Run fetch, sending a second copy if the first is slow. The first good
+// result wins, and the other request is cancelled.
+func (h *hedger) do(ctx context.Context, path string, fetch func(context.Context) (interface{}, int, error)) (interface{}, int, error) {
+	endpoint := hedgeEndpoint(path)
+	delay, ok := h.plan(endpoint)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Buffered, so the loser can finish without anyone waiting on it
+	results := make(chan hedgeResult, 2)
+
+	// Copies are timed from when upstreamLimiter lets them through, and the
+	// hedge waits on the first copy being let through, so time spent queued
+	// isn't mistaken for a slow upstream
+	primaryGranted := make(chan struct{})
+	start := func(hedge bool) {
+		began := time.Now()
+		var once sync.Once
+		fetchCtx := withTokenGranted(ctx, func() {
+			once.Do(func() {
+				began = time.Now()
+				if !hedge {
+					close(primaryGranted)
+				}
+			})
+		})
+
+		go func() {
+			res, status, err := fetch(fetchCtx)
+			if err == nil {
+				h.observe(endpoint, time.Since(began))
+			}
+			results <- hedgeResult{ res, status, err, hedge }
+		}()
+	}
+
+	start(false)
+	pending := 1
+
+	var granted <-chan struct{}
+	if ok {
+		granted = primaryGranted
+	}
+	var timer <-chan time.Time
+
+	var result hedgeResult
+	for {
+		select {
+		case <-granted:
+			granted = nil
+			t := time.NewTimer(delay)
+			defer t.Stop()
+			timer = t.C
+			continue
+
+		case <-timer:
+			timer = nil
+			if h.take() {
+				start(true)
+				pending++
+			}
+			continue
+
+		case result = <-results:
+			pending--
+		}
+
+		if !hedgeFailed(result) || pending == 0 {
+			break
+		}
+	}
+
+	if result.hedge && !hedgeFailed(result) {
+		h.mu.Lock()
+		h.hedgeWins++
+		h.mu.Unlock()
+	}
+
+	return result.res, result.status, result.err
+}
+
+func (h *hedger) stats() HedgeStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	stats := HedgeStats{
+		Enabled: hedgeEnabled,
+		Requests: h.requests,
+		Hedges: h.hedges,
+		HedgeWins: h.hedgeWins,
+		DelaysMs: map[string]float64{},
+	}
+	for endpoint := range h.samples {
+		if delay, ok := h.delay(endpoint); ok {
+			stats.DelaysMs[endpoint] = float64(delay) / float64(time.Millisecond)
+		}
+	}
+	return stats
+}
+
+// Serve /v1/admin/hedging, showing how often requests are hedged
+func handleHedging(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		writeError(w, 405, "Method not allowed")
+		return
+	}
+
+	writeJson(w, 200, hedges.stats())
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"testing"
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// Fill in enough fast samples for the endpoint to be hedged after a few ms
+func warmHedger(h *hedger, path string) {
+	for i := 0; i < hedgeMinSamples; i++ {
+		h.observe(hedgeEndpoint(path), 2 * time.Millisecond)
+	}
+}
+
+func TestHedgeEndpoint(t *testing.T) {
+	if hedgeEndpoint("/posts?userId=12") != "/posts?userId={id}" {
+		t.Fatalf("Got unexpected endpoint: %s", hedgeEndpoint("/posts?userId=12"))
+	}
+	if hedgeEndpoint("/users/3") != hedgeEndpoint("/users/40") {
+		t.Fatalf("Expected users to share an endpoint")
+	}
+}
+
+func TestHedgeSlowRequest(t *testing.T) {
+	h := newHedger()
+	h.budget = 1
+	warmHedger(h, "/users/1")
+
+	// The first request hangs until cancelled, and the hedge answers at once.
+	// Each takes a token, as requests to the upstream do.
+	var calls int32
+	var cancelled int32
+	fetch := func(ctx context.Context) (interface{}, int, error) {
+		upstreamLimiter.wait(ctx)
+		if atomic.AddInt32(&calls, 1) == 1 {
+			<-ctx.Done()
+			atomic.AddInt32(&cancelled, 1)
+			return nil, 0, ctx.Err()
+		}
+		return "hedged", 200, nil
+	}
+
+	start := time.Now()
+	res, status, err := h.do(context.TODO(), "/users/1", fetch)
+	if res != "hedged" || status != 200 || err != nil {
+		t.Fatalf("Expected hedged result, got %v %d %v", res, status, err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("Expected hedge to answer quickly")
+	}
+
+	stats := h.stats()
+	if stats.Hedges != 1 || stats.HedgeWins != 1 {
+		t.Fatalf("Expected one winning hedge, got %+v", stats)
+	}
+
+	// The loser is cancelled once the winner is in
+	for i := 0; i < 100 && atomic.LoadInt32(&cancelled) == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if atomic.LoadInt32(&cancelled) != 1 {
+		t.Fatalf("Expected slow request to be cancelled")
+	}
+}
+
+func TestHedgeBudget(t *testing.T) {
+	h := newHedger()
+	warmHedger(h, "/users/1")
+
+	// With no budget saved up, slow requests are simply waited on
+	var calls int32
+	fetch := func(ctx context.Context) (interface{}, int, error) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(20 * time.Millisecond)
+		return "slow", 200, nil
+	}
+
+	res, _, _ := h.do(context.TODO(), "/users/1", fetch)
+	if res != "slow" || atomic.LoadInt32(&calls) != 1 {
+		t.Fatalf("Expected a single request, got %d", calls)
+	}
+
+	// Each request earns a share of a hedge, up to the cap
+	for i := 0; i < 1000; i++ {
+		h.plan("/other")
+	}
+	if h.budget != hedgeBudgetCap {
+		t.Fatalf("Expected budget to be capped at %v, got %v", hedgeBudgetCap, h.budget)
+	}
+}
+
+func TestHedgeNotEnoughSamples(t *testing.T) {
+	h := newHedger()
+	h.budget = hedgeBudgetCap
+
+	var calls int32
+	fetch := func(ctx context.Context) (interface{}, int, error) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(20 * time.Millisecond)
+		return "slow", 200, nil
+	}
+
+	h.do(context.TODO(), "/users/1", fetch)
+	if atomic.LoadInt32(&calls) != 1 || h.stats().Hedges != 0 {
+		t.Fatalf("Expected no hedging without samples")
+	}
+}
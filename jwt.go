@@ -0,0 +1,340 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Bearer tokens issued by the gateway. Tokens are checked against keys from a
+// local JWKS file: oct keys for HS256, RSA keys for RS256 and P-256 keys for
+// ES256. The algorithm has to match the type of key, so a public key can never
+// be used as an HMAC secret.
+//
+// Scopes come from the token's scope claim. A token whose subject is user:{id}
+// may only read that user's posts.
+
+type Jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	// oct
+	K string `json:"k"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC
+	Crv string `json:"crv"`
+	X string `json:"x"`
+	Y string `json:"y"`
+}
+
+type jwksFile struct {
+	Keys []Jwk `json:"keys"`
+}
+
+type jwtKey struct {
+	kid string
+	alg string
+	// []byte, *rsa.PublicKey or *ecdsa.PublicKey, depending on alg
+	key interface{}
+}
+
+type jwtVerifier struct {
+	keys []jwtKey
+	// Claims to require, if not empty
+	issuer string
+	audience string
+	// Allowance for clocks being out of step with the gateway's
+	leeway time.Duration
+}
+
+// Verifier in use. nil means bearer tokens aren't accepted.
+var jwtAuth *jwtVerifier
+
+const defaultJwtLeeway = 30 * time.Second
+
+var errInvalidToken = errors.New("Malformed token")
+
+func decodeSegment(segment string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(segment, "="))
+}
+
+func parseJwk(jwk Jwk) (jwtKey, error) {
+	switch jwk.Kty {
+	case "oct":
+		secret, err := decodeSegment(jwk.K)
+		if err != nil || len(secret) < 32 {
+			return jwtKey{}, fmt.Errorf("oct key %s must be at least 32 bytes", jwk.Kid)
+		}
+		return jwtKey{ jwk.Kid, "HS256", secret }, nil
+
+	case "RSA":
+		n, errN := decodeSegment(jwk.N)
+		e, errE := decodeSegment(jwk.E)
+		if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+			return jwtKey{}, fmt.Errorf("RSA key %s is malformed", jwk.Kid)
+		}
+
+		key := &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+		if key.N.BitLen() < 2048 {
+			return jwtKey{}, fmt.Errorf("RSA key %s must be at least 2048 bits", jwk.Kid)
+		}
+		return jwtKey{ jwk.Kid, "RS256", key }, nil
+
+	case "EC":
+		x, errX := decodeSegment(jwk.X)
+		y, errY := decodeSegment(jwk.Y)
+		if jwk.Crv != "P-256" || errX != nil || errY != nil || len(x) != 32 || len(y) != 32 {
+			return jwtKey{}, fmt.Errorf("EC key %s must be a P-256 key", jwk.Kid)
+		}
+
+		// Make sure the point is on the curve before trusting it
+		point := append(append([]byte{ 4 }, x...), y...)
+		_, err := ecdh.P256().NewPublicKey(point)
+		if err != nil {
+			return jwtKey{}, fmt.Errorf("EC key %s is not a valid point", jwk.Kid)
+		}
+
+		key := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X: new(big.Int).SetBytes(x),
+			Y: new(big.Int).SetBytes(y),
+		}
+		return jwtKey{ jwk.Kid, "ES256", key }, nil
+	}
+
+	return jwtKey{}, fmt.Errorf("Key %s has unsupported type %s", jwk.Kid, jwk.Kty)
+}
+
+func loadJwks(path string) ([]jwtKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file := jwksFile{}
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid JWKS file %s: %v", path, err)
+	}
+
+	keys := []jwtKey{}
+	for _, jwk := range file.Keys {
+		// Encryption keys are no use here
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		key, err := parseJwk(jwk)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid JWKS file %s: %v", path, err)
+		}
+		if jwk.Alg != "" && jwk.Alg != key.alg {
+			return nil, fmt.Errorf("Invalid JWKS file %s: key %s can't be used for %s", path, jwk.Kid, jwk.Alg)
+		}
+		keys = append(keys, key)
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("Invalid JWKS file %s: no signing keys", path)
+	}
+	return keys, nil
+}
+
+func verifySignature(key jwtKey, signed []byte, sig []byte) bool {
+	hash := sha256.Sum256(signed)
+
+	switch key.alg {
+	case "HS256":
+		mac := hmac.New(sha256.New, key.key.([]byte))
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), sig)
+	case "RS256":
+		return rsa.VerifyPKCS1v15(key.key.(*rsa.PublicKey), crypto.SHA256, hash[:], sig) == nil
+	case "ES256":
+		if len(sig) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(key.key.(*ecdsa.PublicKey), hash[:], r, s)
+	}
+	return false
+}
+
+// Read a NumericDate claim. ok is false if it's missing.
+func numericClaim(claims map[string]interface{}, name string) (time.Time, bool, error) {
+	value, ok := claims[name]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+
+	seconds, ok := value.(float64)
+	if !ok {
+		return time.Time{}, false, fmt.Errorf("Claim %s must be a number", name)
+	}
+	return time.Unix(int64(seconds), 0), true, nil
+}
+
+// The aud claim may be a single string or a list of them
+func hasAudience(claims map[string]interface{}, audience string) bool {
+	switch aud := claims["aud"].(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, value := range aud {
+			if value == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Check a token's signature and claims, returning the claims
+func (v *jwtVerifier) verify(token string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidToken
+	}
+
+	headerData, err := decodeSegment(parts[0])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	err = json.Unmarshal(headerData, &header)
+	if err != nil {
+		return nil, errInvalidToken
+	}
+
+	sig, err := decodeSegment(parts[2])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, key := range v.keys {
+		if key.alg != header.Alg || (header.Kid != "" && key.kid != header.Kid) {
+			continue
+		}
+		if verifySignature(key, signed, sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("Signature does not match any known key")
+	}
+
+	claimsData, err := decodeSegment(parts[1])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	claims := map[string]interface{}{}
+	err = json.Unmarshal(claimsData, &claims)
+	if err != nil {
+		return nil, errInvalidToken
+	}
+
+	exp, ok, err := numericClaim(claims, "exp")
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("Token has no expiry")
+	}
+	if !now.Before(exp.Add(v.leeway)) {
+		return nil, errors.New("Token has expired")
+	}
+
+	nbf, ok, err := numericClaim(claims, "nbf")
+	if err != nil {
+		return nil, err
+	}
+	if ok && now.Add(v.leeway).Before(nbf) {
+		return nil, errors.New("Token is not valid yet")
+	}
+
+	if v.issuer != "" && claims["iss"] != v.issuer {
+		return nil, errors.New("Token was issued by someone else")
+	}
+	if v.audience != "" && !hasAudience(claims, v.audience) {
+		return nil, errors.New("Token is meant for someone else")
+	}
+
+	return claims, nil
+}
+
+// Scopes granted by a token, from either a space separated scope claim or a
+// list in scp
+func claimScopes(claims map[string]interface{}) map[string]bool {
+	scopes := map[string]bool{}
+	if scope, ok := claims["scope"].(string); ok {
+		for _, name := range strings.Fields(scope) {
+			scopes[name] = true
+		}
+	}
+	if scp, ok := claims["scp"].([]interface{}); ok {
+		for _, value := range scp {
+			if name, ok := value.(string); ok {
+				scopes[name] = true
+			}
+		}
+	}
+	return scopes
+}
+
+// Work out who a bearer token speaks for
+func bearerPrincipal(token string) *principal {
+	claims, err := jwtAuth.verify(token, time.Now())
+	if err != nil {
+		return &principal{ invalid: true, reason: err.Error() }
+	}
+
+	p := &principal{ scopes: claimScopes(claims), claims: claims }
+	p.subject, _ = claims["sub"].(string)
+
+	if rest, ok := strings.CutPrefix(p.subject, "user:"); ok {
+		id, err := strconv.Atoi(rest)
+		if err != nil || id < 0 {
+			return &principal{ invalid: true, reason: "Token has an invalid subject" }
+		}
+		p.userId = id
+		p.userOnly = true
+	}
+	return p
+}
+
+// Claims of the token a request was made with, or nil if it wasn't made with
+// one
+func requestClaims(r *http.Request) map[string]interface{} {
+	p := requestPrincipal(r)
+	if p == nil {
+		return nil
+	}
+	return p.claims
+}
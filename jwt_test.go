@@ -0,0 +1,261 @@
+package main
+
+import (
+	"testing"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var testHmacSecret = []byte("0123456789abcdef0123456789abcdef")
+
+func encodeSegment(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// Sign claims with key, which is a []byte for HS256, or a private key
+func signJwt(t *testing.T, alg string, kid string, key interface{}, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{ "alg": alg, "kid": kid, "typ": "JWT" })
+	body, _ := json.Marshal(claims)
+	signed := encodeSegment(header) + "." + encodeSegment(body)
+	hash := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	var err error
+	switch alg {
+	case "HS256":
+		mac := hmac.New(sha256.New, key.([]byte))
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case "RS256":
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key.(*rsa.PrivateKey), crypto.SHA256, hash[:])
+	case "ES256":
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key.(*ecdsa.PrivateKey), hash[:])
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+
+	return signed + "." + encodeSegment(sig)
+}
+
+type testJwtKeys struct {
+	rsa *rsa.PrivateKey
+	ec *ecdsa.PrivateKey
+}
+
+// Write a JWKS with one key of each type, and accept tokens signed with them
+// for the rest of the test
+func useJwtAuth(t *testing.T) testJwtKeys {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate RSA key: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate EC key: %v", err)
+	}
+
+	jwks := jwksFile{ Keys: []Jwk{
+		{ Kty: "oct", Kid: "hmac", K: encodeSegment(testHmacSecret) },
+		{
+			Kty: "RSA", Kid: "rsa", Alg: "RS256",
+			N: encodeSegment(rsaKey.N.Bytes()),
+			E: encodeSegment(big.NewInt(int64(rsaKey.E)).Bytes()),
+		},
+		{
+			Kty: "EC", Kid: "ec", Crv: "P-256",
+			X: encodeSegment(ecKey.X.FillBytes(make([]byte, 32))),
+			Y: encodeSegment(ecKey.Y.FillBytes(make([]byte, 32))),
+		},
+	} }
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	data, _ := json.Marshal(jwks)
+	os.WriteFile(path, data, 0644)
+
+	keys, err := loadJwks(path)
+	if err != nil {
+		t.Fatalf("Failed to load JWKS: %v", err)
+	}
+
+	prev := jwtAuth
+	jwtAuth = &jwtVerifier{ keys, "gateway", "user-posts", time.Second }
+	t.Cleanup(func() { jwtAuth = prev })
+
+	return testJwtKeys{ rsaKey, ecKey }
+}
+
+func validClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"iss": "gateway",
+		"aud": []string{ "other", "user-posts" },
+		"sub": "user:3",
+		"scope": "user-posts:read",
+		"exp": time.Now().Add(time.Minute).Unix(),
+	}
+}
+
+func TestJwtVerifyAlgorithms(t *testing.T) {
+	keys := useJwtAuth(t)
+
+	tokens := map[string]string{
+		"HS256": signJwt(t, "HS256", "hmac", testHmacSecret, validClaims()),
+		"RS256": signJwt(t, "RS256", "rsa", keys.rsa, validClaims()),
+		"ES256": signJwt(t, "ES256", "ec", keys.ec, validClaims()),
+		"ES256 without kid": signJwt(t, "ES256", "", keys.ec, validClaims()),
+	}
+
+	for name, token := range tokens {
+		claims, err := jwtAuth.verify(token, time.Now())
+		if err != nil || claims["sub"] != "user:3" {
+			t.Fatalf("%s: expected token to verify, got %v", name, err)
+		}
+	}
+}
+
+func TestJwtVerifyRejected(t *testing.T) {
+	keys := useJwtAuth(t)
+
+	expired := validClaims()
+	expired["exp"] = time.Now().Add(-time.Minute).Unix()
+
+	notYet := validClaims()
+	notYet["nbf"] = time.Now().Add(time.Minute).Unix()
+
+	noExpiry := validClaims()
+	delete(noExpiry, "exp")
+
+	wrongIssuer := validClaims()
+	wrongIssuer["iss"] = "someone"
+
+	wrongAudience := validClaims()
+	wrongAudience["aud"] = "other"
+
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	tokens := map[string]string{
+		"expired": signJwt(t, "HS256", "hmac", testHmacSecret, expired),
+		"not yet valid": signJwt(t, "HS256", "hmac", testHmacSecret, notYet),
+		"no expiry": signJwt(t, "HS256", "hmac", testHmacSecret, noExpiry),
+		"wrong issuer": signJwt(t, "HS256", "hmac", testHmacSecret, wrongIssuer),
+		"wrong audience": signJwt(t, "HS256", "hmac", testHmacSecret, wrongAudience),
+		"unknown key": signJwt(t, "ES256", "ec", otherKey, validClaims()),
+		"wrong kid": signJwt(t, "RS256", "other", keys.rsa, validClaims()),
+		"none": encodeSegment([]byte(`{"alg":"none"}`)) + "." + encodeSegment([]byte(`{"sub":"user:3"}`)) + ".",
+		"malformed": "not.a-token",
+	}
+
+	for name, token := range tokens {
+		_, err := jwtAuth.verify(token, time.Now())
+		if err == nil {
+			t.Fatalf("%s: expected token to be rejected", name)
+		}
+	}
+}
+
+func TestLoadJwksInvalid(t *testing.T) {
+	files := map[string]string{
+		"short secret": `{"keys": [{"kty": "oct", "k": "c2hvcnQ"}]}`,
+		"wrong alg": `{"keys": [{"kty": "oct", "alg": "RS256", "k": "` + encodeSegment(testHmacSecret) + `"}]}`,
+		"off curve": `{"keys": [{"kty": "EC", "crv": "P-256", "x": "` + encodeSegment(make([]byte, 32)) + `", "y": "` + encodeSegment(make([]byte, 32)) + `"}]}`,
+		"empty": `{"keys": []}`,
+	}
+
+	for name, contents := range files {
+		path := filepath.Join(t.TempDir(), "jwks.json")
+		os.WriteFile(path, []byte(contents), 0644)
+
+		_, err := loadJwks(path)
+		if err == nil {
+			t.Fatalf("%s: expected JWKS to be rejected", name)
+		}
+	}
+}
+
+func TestBearerRestrictedToUser(t *testing.T) {
+	useJwtAuth(t)
+	token := signJwt(t, "HS256", "hmac", testHmacSecret, validClaims())
+
+	var claims map[string]interface{}
+	userPosts := authenticate(requireUserScope(scopeUserPostsRead, func(w http.ResponseWriter, r *http.Request) {
+		if requireUser(w, r, 3) {
+			claims = requestClaims(r)
+			w.WriteHeader(204)
+		}
+	}))
+	otherUser := authenticate(requireUserScope(scopeUserPostsRead, func(w http.ResponseWriter, r *http.Request) {
+		if requireUser(w, r, 4) {
+			w.WriteHeader(204)
+		}
+	}))
+	search := authenticate(requireScope(scopeUserPostsRead, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(204)
+	}))
+
+	tests := []struct {
+		name string
+		handler http.Handler
+		authorization string
+		status int
+	}{
+		{ "own posts", userPosts, "Bearer " + token, 204 },
+		{ "other user", otherUser, "Bearer " + token, 403 },
+		{ "all users", search, "Bearer " + token, 403 },
+		{ "bad token", userPosts, "Bearer " + token + "x", 401 },
+		{ "no token", userPosts, "", 401 },
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/v1/user-posts/3", nil)
+		if test.authorization != "" {
+			req.Header.Set("Authorization", test.authorization)
+		}
+		rec := httptest.NewRecorder()
+		test.handler.ServeHTTP(rec, req)
+
+		if rec.Code != test.status {
+			t.Fatalf("%s: expected %d, got %d: %s", test.name, test.status, rec.Code, rec.Body.String())
+		}
+	}
+
+	if claims["iss"] != "gateway" {
+		t.Fatalf("Expected claims in the request context, got %v", claims)
+	}
+}
+
+func TestBearerScopes(t *testing.T) {
+	useJwtAuth(t)
+
+	claims := validClaims()
+	delete(claims, "sub")
+	claims["scp"] = []string{ scopePostsWrite }
+	token := signJwt(t, "HS256", "hmac", testHmacSecret, claims)
+
+	handler := authenticate(requireScope(scopePostsWrite, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(204)
+	}))
+
+	req := httptest.NewRequest("PUT", "/v1/posts/1", nil)
+	req.Header.Set("Authorization", "Bearer " + token)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != 204 {
+		t.Fatalf("Expected scp claim to grant posts:write, got %d", rec.Code)
+	}
+}
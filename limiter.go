@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Client side rate limiting toward the upstream. Every request sent by
+// httpBackend first takes a token from a shared bucket, waiting its turn if
+// there are none left. Tokens are taken before any per-attempt timeout starts,
+// so time spent queued isn't held against the upstream. When the upstream answers 429 the bucket backs off,
+// halving its rate and pausing for any Retry-After, then speeds back up a
+// little with every request that gets through.
+
+// Limits the serve and export commands start with. The limiter itself is
+// unlimited until configured.
+const defaultUpstreamRate = 20.0
+const defaultUpstreamBurst = 40
+
+// Lowest the rate is slowed to, as a share of the configured rate
+const minUpstreamRateFactor = 1.0 / 16
+
+// Share of the configured rate won back by each successful request
+const upstreamRateRecovery = 0.02
+
+// Pause after a 429 without a usable Retry-After
+const defaultRetryAfter = time.Second
+
+// Longest pause a Retry-After can ask for. The pause holds up every request
+// to every upstream, so one upstream mustn't be able to stop them for long.
+const maxRetryAfter = time.Minute
+
+// Stats shown by /v1/admin/upstream-rate-limit
+type RateLimitStats struct {
+	Rate float64 `json:"rate"`
+	Burst int `json:"burst"`
+	EffectiveRate float64 `json:"effectiveRate"`
+	Requests int `json:"requests"`
+	Delayed int `json:"delayed"`
+	Throttled int `json:"throttled"`
+	TotalWaitMs float64 `json:"totalWaitMs"`
+	MeanWaitMs float64 `json:"meanWaitMs"`
+	MaxWaitMs float64 `json:"maxWaitMs"`
+}
+
+type rateLimiter struct {
+	mu sync.Mutex
+	// Tokens per second. 0 means unlimited.
+	rate float64
+	burst int
+	// Share of rate currently allowed, lowered on 429s
+	factor float64
+
+	// Tokens available as of last. Negative when requests are queued, and
+	// last is in the future while paused.
+	tokens float64
+	last time.Time
+
+	requests int
+	delayed int
+	throttled int
+	totalWait time.Duration
+	maxWait time.Duration
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate: rate,
+		burst: burst,
+		factor: 1,
+		tokens: float64(burst),
+		last: time.Now(),
+	}
+}
+
+var upstreamLimiter = newRateLimiter(0, 0)
+
+type tokenGrantedKey struct{}
+
+// Have granted called whenever a request made with the context is handed its
+// token, the way httptrace reports connections. This lets callers time the
+// request itself rather than its wait in the queue.
+func withTokenGranted(ctx context.Context, granted func()) context.Context {
+	return context.WithValue(ctx, tokenGrantedKey{}, granted)
+}
+
+func tokenGranted(ctx context.Context) {
+	if granted, ok := ctx.Value(tokenGrantedKey{}).(func()); ok {
+		granted()
+	}
+}
+
+func (l *rateLimiter) configure(rate float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rate = rate
+	l.burst = burst
+	l.factor = 1
+	l.tokens = float64(burst)
+	l.last = time.Now()
+}
+
+// Take a token, returning how long to wait before using it. Must be called
+// with the lock held.
+func (l *rateLimiter) reserve(now time.Time) time.Duration {
+	rate := l.rate * l.factor
+
+	if now.After(l.last) {
+		if rate > 0 {
+			l.tokens += now.Sub(l.last).Seconds() * rate
+			l.tokens = min(l.tokens, float64(l.burst))
+		}
+		l.last = now
+	}
+
+	// Paused after a 429
+	wait := l.last.Sub(now)
+	if rate <= 0 {
+		return wait
+	}
+
+	l.tokens--
+	if l.tokens < 0 {
+		wait += time.Duration(-l.tokens / rate * float64(time.Second))
+	}
+	return wait
+}
+
+// Wait for a token, giving up if the context is cancelled first
+func (l *rateLimiter) wait(ctx context.Context) error {
+	l.mu.Lock()
+	wait := l.reserve(time.Now())
+	l.requests++
+	if wait > 0 {
+		l.delayed++
+		l.totalWait += wait
+		l.maxWait = max(l.maxWait, wait)
+	}
+	l.mu.Unlock()
+
+	if wait <= 0 {
+		tokenGranted(ctx)
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		tokenGranted(ctx)
+		return nil
+	case <-ctx.Done():
+		// Hand the token back for whoever is next
+		l.mu.Lock()
+		if l.rate > 0 {
+			l.tokens++
+		}
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// Adjust to how the upstream responded
+func (l *rateLimiter) observe(status int, retryAfter string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if status != 429 {
+		l.factor = min(l.factor + upstreamRateRecovery, 1)
+		return
+	}
+
+	l.throttled++
+	l.factor = max(l.factor / 2, minUpstreamRateFactor)
+
+	// Seconds too large to be a Duration are ignored, like any other value
+	// that can't be used
+	pause := defaultRetryAfter
+	if seconds, err := strconv.ParseInt(retryAfter, 10, 64); err == nil && seconds >= 0 {
+		if seconds <= int64(math.MaxInt64 / time.Second) {
+			pause = time.Duration(seconds) * time.Second
+		}
+	} else if date, err := http.ParseTime(retryAfter); err == nil {
+		pause = time.Until(date)
+	}
+	pause = min(pause, maxRetryAfter)
+
+	// Nothing more goes out until the pause is over, and the bucket starts
+	// empty after it
+	until := time.Now().Add(pause)
+	if until.After(l.last) {
+		l.last = until
+	}
+	l.tokens = min(l.tokens, 0)
+}
+
+func (l *rateLimiter) stats() RateLimitStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	stats := RateLimitStats{
+		Rate: l.rate,
+		Burst: l.burst,
+		EffectiveRate: l.rate * l.factor,
+		Requests: l.requests,
+		Delayed: l.delayed,
+		Throttled: l.throttled,
+		TotalWaitMs: float64(l.totalWait) / float64(time.Millisecond),
+		MaxWaitMs: float64(l.maxWait) / float64(time.Millisecond),
+	}
+	if l.delayed > 0 {
+		stats.MeanWaitMs = stats.TotalWaitMs / float64(l.delayed)
+	}
+	return stats
+}
+
+// Serve /v1/admin/upstream-rate-limit, showing how long requests waited
+func handleUpstreamRateLimit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		writeError(w, 405, "Method not allowed")
+		return
+	}
+
+	writeJson(w, 200, upstreamLimiter.stats())
+}
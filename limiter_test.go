@@ -0,0 +1,197 @@
+package main
+
+import (
+	"testing"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+)
+
+func TestRateLimiterReserve(t *testing.T) {
+	limiter := newRateLimiter(100, 2)
+	now := time.Now()
+	limiter.last = now
+
+	// The burst goes straight out, then requests are spaced by the rate
+	waits := []time.Duration{}
+	for i := 0; i < 4; i++ {
+		waits = append(waits, limiter.reserve(now))
+	}
+
+	expected := []time.Duration{ 0, 0, 10 * time.Millisecond, 20 * time.Millisecond }
+	for i := range expected {
+		if waits[i].Round(time.Millisecond) != expected[i] {
+			t.Fatalf("Expected waits %v, got %v", expected, waits)
+		}
+	}
+
+	// Tokens come back over time, up to the burst
+	if wait := limiter.reserve(now.Add(time.Second)); wait != 0 {
+		t.Fatalf("Expected no wait after refilling, got %v", wait)
+	}
+	if limiter.tokens != 1 {
+		t.Fatalf("Expected refill to stop at the burst, got %v tokens", limiter.tokens)
+	}
+}
+
+func TestRateLimiterWaitCancelled(t *testing.T) {
+	limiter := newRateLimiter(1, 1)
+	limiter.wait(context.TODO())
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 10 * time.Millisecond)
+	defer cancel()
+
+	err := limiter.wait(ctx)
+	if err == nil {
+		t.Fatalf("Expected error when cancelled while waiting")
+	}
+
+	// The cancelled request's token is returned
+	if limiter.tokens < -0.1 {
+		t.Fatalf("Expected token to be refunded, got %v tokens", limiter.tokens)
+	}
+
+	stats := limiter.stats()
+	if stats.Requests != 2 || stats.Delayed != 1 || stats.MaxWaitMs < 900 {
+		t.Fatalf("Got unexpected stats: %+v", stats)
+	}
+}
+
+func TestRateLimiterThrottled(t *testing.T) {
+	limiter := newRateLimiter(100, 10)
+
+	limiter.observe(429, "2")
+	if limiter.factor != 0.5 {
+		t.Fatalf("Expected rate to be halved, got factor %v", limiter.factor)
+	}
+
+	// Nothing goes out until Retry-After has passed
+	wait := limiter.reserve(time.Now())
+	if wait < 1900 * time.Millisecond {
+		t.Fatalf("Expected to wait out Retry-After, got %v", wait)
+	}
+
+	for i := 0; i < 100; i++ {
+		limiter.observe(200, "")
+	}
+	if limiter.factor != 1 {
+		t.Fatalf("Expected rate to recover, got factor %v", limiter.factor)
+	}
+
+	// Slowing down bottoms out
+	for i := 0; i < 10; i++ {
+		limiter.observe(429, "0")
+	}
+	if limiter.factor != minUpstreamRateFactor {
+		t.Fatalf("Expected factor to stop at %v, got %v", minUpstreamRateFactor, limiter.factor)
+	}
+
+	// Even unlimited, a 429 pauses requests
+	unlimited := newRateLimiter(0, 0)
+	unlimited.observe(429, "")
+	if wait := unlimited.reserve(time.Now()); wait < 900 * time.Millisecond {
+		t.Fatalf("Expected default pause, got %v", wait)
+	}
+}
+
+func TestRateLimiterRetryAfterBounded(t *testing.T) {
+	tests := map[string]struct {
+		retryAfter string
+		pause time.Duration
+	}{
+		"huge": { "99999999", maxRetryAfter },
+		"far off date": { time.Now().Add(24 * time.Hour).UTC().Format(http.TimeFormat), maxRetryAfter },
+		"overflows a duration": { "9223372036854775807", defaultRetryAfter },
+		"overflows an int": { "99999999999999999999", defaultRetryAfter },
+	}
+
+	for name, test := range tests {
+		limiter := newRateLimiter(0, 0)
+		limiter.observe(429, test.retryAfter)
+
+		wait := limiter.reserve(time.Now())
+		if wait > test.pause || wait < test.pause - time.Second {
+			t.Fatalf("%s: expected a pause of %v, got %v", name, test.pause, wait)
+		}
+	}
+}
+
+func TestUpstreamRateLimited(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(429)
+	}))
+	defer upstream.Close()
+	useUpstreamPool(t, []string{ upstream.URL }, "failover")
+
+	prevLimiter := upstreamLimiter
+	upstreamLimiter = newRateLimiter(1000, 10)
+	defer func() { upstreamLimiter = prevLimiter }()
+
+	_, status, _ := fetchJson(context.TODO(), "/users/1")
+	if status != 429 {
+		t.Fatalf("Expected 429, got %d", status)
+	}
+
+	stats := upstreamLimiter.stats()
+	if stats.Requests != 1 || stats.Throttled != 1 || stats.EffectiveRate != 500 {
+		t.Fatalf("Got unexpected stats: %+v", stats)
+	}
+}
+
+func TestUpstreamRetryAfterLongerThanTimeout(t *testing.T) {
+	// Asks for a pause longer than an attempt may take, then answers normally
+	var calls int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(429)
+			return
+		}
+		fmt.Fprint(w, expUserStr)
+	}))
+	defer upstream.Close()
+	pool := useUpstreamPool(t, []string{ upstream.URL }, "failover")
+
+	prevTimeout := upstreamTimeout
+	upstreamTimeout = 200 * time.Millisecond
+	defer func() { upstreamTimeout = prevTimeout }()
+
+	prevLimiter := upstreamLimiter
+	upstreamLimiter = newRateLimiter(1000, 10)
+	defer func() { upstreamLimiter = prevLimiter }()
+
+	prevHedges, prevHedgeEnabled := hedges, hedgeEnabled
+	hedges, hedgeEnabled = newHedger(), true
+	defer func() { hedges, hedgeEnabled = prevHedges, prevHedgeEnabled }()
+
+	_, status, _ := fetchJson(context.TODO(), "/users/1")
+	if status != 429 {
+		t.Fatalf("Expected 429, got %d", status)
+	}
+
+	// The next request waits out the pause before its attempt starts
+	start := time.Now()
+	_, status, err := fetchJson(context.TODO(), "/users/1")
+	if err != nil || status != 200 {
+		t.Fatalf("Expected request to wait out the pause, got %d %v", status, err)
+	}
+	if time.Since(start) < 500 * time.Millisecond {
+		t.Fatalf("Expected request to be held back by Retry-After")
+	}
+
+	// Neither the upstream's health nor the latencies it is judged by count
+	// the time spent queued
+	stats := pool.stats()[0]
+	if !stats.Healthy || stats.Failures != 0 || stats.LatencyMs >= 500 {
+		t.Fatalf("Expected the wait not to count against the upstream, got %+v", stats)
+	}
+	for _, sample := range hedges.samples[hedgeEndpoint("/users/1")] {
+		if sample >= 500 * time.Millisecond {
+			t.Fatalf("Expected hedge samples to leave out the wait, got %v", sample)
+		}
+	}
+}
@@ -9,6 +9,10 @@ import (
 	"strconv"
 	"sync"
 	"context"
+	"os"
+	"io"
+	"bytes"
+	"flag"
 )
 
 // Define the data structure. Since the expected result has a very rigid
@@ -16,27 +20,62 @@ import (
 // type allows us to run validation and sanity check against the input,
 // and ensures that the rendered json is always valid.
 type UserPosts struct {
-	Id int `json:"id"`
-	UserInfo User `json:"userInfo"`
-	Posts []Post `json:"posts"`
+	Id int `json:"id" xml:"id"`
+	UserInfo User `json:"userInfo" xml:"userInfo"`
+	Posts []Post `json:"posts" xml:"posts>post"`
 }
 
 type User struct {
-	Name string `json:"name"`
-	Username string `json:"username"`
-	Email string `json:"email"`
+	Name string `json:"name" xml:"name"`
+	Username string `json:"username" xml:"username"`
+	Email string `json:"email" xml:"email"`
+	// Fields a redaction policy left out, see User.MarshalJSON
+	omitted omittedFields
 }
 
 type Post struct {
-	Id int `json:"id"`
-	Title string `json:"title"`
-	Body string `json:"body"`
+	Id int `json:"id" xml:"id"`
+	Title string `json:"title" xml:"title"`
+	Body string `json:"body" xml:"body"`
 }
 
 var baseUrl = "https://jsonplaceholder.typicode.com"
 
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	log.SetOutput(redactLogs(os.Stderr))
+
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		err := runExportCommand(os.Args[2:], os.Stdout)
+		if err != nil {
+			log.Fatalf("Export failed: %v", err)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "mirror" {
+		err := runMirrorCommand(os.Args[2:], os.Stdout)
+		if err != nil {
+			log.Fatalf("Mirror failed: %v", err)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "keygen" {
+		err := runKeygenCommand(os.Args[2:], os.Stdout)
+		if err != nil {
+			log.Fatalf("Keygen failed: %v", err)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		err := runServeCommand(os.Args[2:])
+		if err != nil {
+			log.Fatalf("Serve failed: %v", err)
+		}
+		return
+	}
 
 	userPosts, status, err := getUserPosts(1)
 	fmt.Println(userPosts)
@@ -46,10 +85,143 @@ func main() {
 	/*
 	serverExit := &sync.WaitGroup{}
 	runServer(serverExit)
+	runGrpcServer(serverExit)
 	serverExit.Wait()
 	*/
 }
 
+// The serve command runs the http and grpc servers until they exit
+func runServeCommand(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	source := flags.String("source", "http", "Where to read upstream data from: http[:{url},...], snapshot:{dir}, fixtures:{dir} or memory[:{dir}]")
+	flags.StringVar(&upstreamBalance, "balance", upstreamBalance, "How to spread requests over http upstreams: failover, round-robin or least-latency")
+	flags.BoolVar(&hedgeEnabled, "hedge", hedgeEnabled, "Send a second request when an upstream read is slow")
+	flags.Float64Var(&hedgePercentile, "hedge-percentile", hedgePercentile, "Latency percentile, from 0 to 1, after which reads are hedged")
+	flags.Float64Var(&hedgeMaxExtraLoad, "hedge-max-extra-load", hedgeMaxExtraLoad, "Most extra requests hedging may add, as a share of all requests")
+	rate := flags.Float64("upstream-rate", defaultUpstreamRate, "Most requests per second sent upstream, or 0 for no limit")
+	burst := flags.Int("upstream-burst", defaultUpstreamBurst, "Requests that may be sent upstream at once before the rate applies")
+	flags.Float64Var(&ipRateLimit, "ip-rate", defaultIpRateLimit, "Requests per second allowed from each IP without an API key, or 0 for no limit")
+	flags.IntVar(&ipRateBurst, "ip-burst", defaultIpRateBurst, "Requests each IP may make at once before the rate applies")
+	flags.Float64Var(&keyRateLimit, "key-rate", defaultKeyRateLimit, "Requests per second allowed for each API key, or 0 for no limit")
+	flags.IntVar(&keyRateBurst, "key-burst", defaultKeyRateBurst, "Requests each API key may make at once before the rate applies")
+	flags.IntVar(&dailyQuota, "daily-quota", dailyQuota, "Requests each client may make per UTC day, or 0 for no quota")
+	quotaFile := flags.String("quota-file", "", "File to keep daily quota usage in across restarts")
+	keyFile := flags.String("api-keys", "", "File listing the API keys allowed. Without keys or a JWKS, anyone may read and nobody may write or administer")
+	jwksFile := flags.String("jwks", "", "JWKS file with the keys bearer tokens are signed with, or empty to not accept tokens")
+	issuer := flags.String("jwt-issuer", "", "Issuer bearer tokens must have, if any")
+	audience := flags.String("jwt-audience", "", "Audience bearer tokens must be meant for, if any")
+	leeway := flags.Duration("jwt-leeway", defaultJwtLeeway, "Allowance for clock skew when checking token expiry")
+	redactionFile := flags.String("redaction", "", "File of policies for redacting user details, or empty to show them in full")
+	tlsOptions := TlsOptions{}
+	flags.StringVar(&tlsOptions.CertFile, "tls-cert", "", "Certificate to serve https with, or empty for plain http")
+	flags.StringVar(&tlsOptions.KeyFile, "tls-key", "", "Private key for tls-cert")
+	flags.StringVar(&tlsOptions.ClientCaFile, "tls-client-ca", "", "CA bundle to check client certificates against, or empty to not ask for them")
+	flags.StringVar(&tlsOptions.ClientAuth, "tls-client-auth", "", "Whether clients need a certificate: none, request or require. Defaults to require with a client CA")
+	flags.StringVar(&tlsOptions.MinVersion, "tls-min-version", "1.2", "Lowest TLS version accepted: 1.0, 1.1, 1.2 or 1.3")
+	ciphers := flags.String("tls-ciphers", "", "Comma separated cipher suites allowed up to TLS 1.2, or empty for Go's defaults")
+	upstreamTls := flags.String("upstream-tls", "", "File of CA, client certificate, server name and proxy settings per upstream url")
+	overlayFile := flags.String("overlay", "", "File to keep draft post edits in across restarts, or empty to keep them in memory")
+	webhookAllow := flags.String("webhook-allow", "", "Comma separated private networks, in CIDR form, webhooks may be sent to")
+	flags.StringVar(&grpcAddr, "grpc-addr", grpcAddr, "Address to serve gRPC on, or empty to not serve it")
+	flags.StringVar(&userPostsCacheControl, "cache-control", userPostsCacheControl, "Cache-Control sent with user posts, or empty for none")
+	flags.Parse(args)
+
+	err := useUpstreamTls(*upstreamTls)
+	if err != nil {
+		return err
+	}
+
+	if *rate < 0 || *burst < 1 {
+		return fmt.Errorf("upstream-rate must not be negative, and upstream-burst must be at least 1")
+	}
+	upstreamLimiter.configure(*rate, *burst)
+
+	if ipRateLimit < 0 || keyRateLimit < 0 || dailyQuota < 0 {
+		return fmt.Errorf("Rate limits and quotas must not be negative")
+	}
+	if (ipRateLimit > 0 && ipRateBurst < 1) || (keyRateLimit > 0 && keyRateBurst < 1) {
+		return fmt.Errorf("Rate limit bursts must be at least 1")
+	}
+
+	if *quotaFile != "" {
+		limiter, err := loadClientLimiter(*quotaFile)
+		if err != nil {
+			return err
+		}
+		clientLimits = limiter
+	}
+
+	if *keyFile != "" {
+		store, err := loadApiKeys(*keyFile)
+		if err != nil {
+			return err
+		}
+		apiKeys = store
+	}
+
+	if *jwksFile != "" {
+		keys, err := loadJwks(*jwksFile)
+		if err != nil {
+			return err
+		}
+		jwtAuth = &jwtVerifier{ keys, *issuer, *audience, *leeway }
+	}
+
+	if *redactionFile != "" {
+		config, err := loadRedaction(*redactionFile)
+		if err != nil {
+			return err
+		}
+		redaction = config
+	}
+
+	if tlsOptions.CertFile != "" || tlsOptions.KeyFile != "" {
+		if *ciphers != "" {
+			tlsOptions.CipherSuites = strings.Split(*ciphers, ",")
+		}
+
+		reloader, err := newTlsReloader(tlsOptions)
+		if err != nil {
+			return err
+		}
+		serverTls = reloader
+	}
+
+	if *overlayFile != "" {
+		store, err := loadOverlayStore(*overlayFile)
+		if err != nil {
+			return err
+		}
+		overlays = store
+	}
+
+	webhookAllowedNets, err = parseWebhookAllowedNets(*webhookAllow)
+	if err != nil {
+		return err
+	}
+
+	if hedgePercentile <= 0 || hedgePercentile > 1 {
+		return fmt.Errorf("hedge-percentile must be between 0 and 1")
+	}
+	if hedgeMaxExtraLoad < 0 {
+		return fmt.Errorf("hedge-max-extra-load must not be negative")
+	}
+
+	err = useSource(*source)
+	if err != nil {
+		return err
+	}
+
+	serverExit := &sync.WaitGroup{}
+	runServer(serverExit)
+	if grpcAddr != "" {
+		runGrpcServer(serverExit)
+	}
+	serverExit.Wait()
+
+	return nil
+}
+
 func errorStatus(status int) bool {
 	return status < 200 || status >= 300
 }
@@ -63,21 +235,75 @@ func writeError(w http.ResponseWriter, status int, msg string) {
 	http.Error(w, errRes, status)
 }
 
+// Error body following RFC 9457, for errors clients are expected to act on
+type Problem struct {
+	Type string `json:"type"`
+	Title string `json:"title"`
+	Status int `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+func writeProblem(w http.ResponseWriter, status int, title string, detail string) {
+	body, err := json.MarshalIndent(Problem{ "about:blank", title, status, detail }, "", "  ")
+	if err != nil {
+		writeError(w, 500, "Something went wrong")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// Write v as indented json with the given status
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	resJson, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		writeError(w, 500, "Something went wrong")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(resJson)
+}
+
 func runServer(wg *sync.WaitGroup) *http.Server {
 	path := "/v1/user-posts/"
 
 	handler := http.NewServeMux()
-	handler.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+	handler.HandleFunc(path, requireUserScope(scopeUserPostsRead, func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "GET" {
 			writeError(w, 404, "Not found")
+			return
 		}
 
 		subpath := strings.TrimPrefix(r.URL.Path, path)
+		if strings.HasSuffix(subpath, "/events") {
+			handlePostEvents(w, r, strings.TrimSuffix(subpath, "/events"))
+			return
+		}
+
 		id, err := strconv.Atoi(subpath)
 		if err != nil || id < 0 {
 			writeError(w, 404, "Not Found")
 			return
 		}
+		if !requireUser(w, r, id) {
+			return
+		}
+
+		query, err := parsePostsQuery(r.URL.Query())
+		if err != nil {
+			writeError(w, 400, err.Error())
+			return
+		}
+
+		format, ok := negotiateFormat(r)
+		if !ok {
+			writeError(w, 406, "Not acceptable")
+			return
+		}
 
 		userPosts, status, err := getUserPosts(id)
 		if status == 404 {
@@ -90,25 +316,79 @@ func runServer(wg *sync.WaitGroup) *http.Server {
 			return
 		}
 
-		userPostsJson, err := json.MarshalIndent(userPosts, "", "  ")
+		userPosts = redactionFor(r.Context()).userPosts(userPosts)
+		body, err := format.encode(query.apply(r.URL, userPosts))
 		if err != nil {
 			writeError(w, 500, "Something went wrong")
 			return
 		}
 
-		fmt.Fprintf(w, "%v", string(userPostsJson))
-	})
+		w.Header().Set("Content-Type", format.contentType)
+		w.Header().Set("Vary", "Accept")
+		setOverlayHeader(w, id)
+		if writeNotModified(w, r, body) {
+			return
+		}
+		w.Write(body)
+	}))
+
+	handler.HandleFunc("/v1/user-posts", requireScope(scopeUserPostsRead, handleExport))
+	handler.HandleFunc("/v1/search/posts", requireScope(scopeUserPostsRead, handleSearchPosts))
+	handler.HandleFunc("/graphql", requireScope(scopeUserPostsRead, handleGraphql))
+	handler.HandleFunc("/v1/ws", requireScope(scopeUserPostsRead, handleWebsocket))
+	handler.HandleFunc("/v1/users/", requireScope(scopePostsWrite, handleCreatePost))
+	handler.HandleFunc("/v1/posts/", requireScope(scopePostsWrite, handlePost))
+	handler.HandleFunc("/v1/overlays", requireScope(scopePostsWrite, handleOverlays))
+	handler.HandleFunc("/v1/overlays/", requireScope(scopePostsWrite, handleOverlays))
+	handler.HandleFunc("/v1/admin/webhooks", requireScope(scopeAdmin, handleWebhooks))
+	handler.HandleFunc("/v1/admin/webhooks/", requireScope(scopeAdmin, handleWebhook))
+	handler.HandleFunc("/v1/admin/upstreams", requireScope(scopeAdmin, handleUpstreams))
+	handler.HandleFunc("/v1/admin/hedging", requireScope(scopeAdmin, handleHedging))
+	handler.HandleFunc("/v1/admin/upstream-rate-limit", requireScope(scopeAdmin, handleUpstreamRateLimit))
 
 	srv := &http.Server{
 		Addr: ":8080",
-		Handler: handler,
+		// Requests are identified first, so logs and rate limits can tell keys
+		// apart
+		Handler: authenticate(logRequests(limitClients(handler))),
+	}
+
+	// Keep the search index fresh for as long as the server is up
+	searchCtx, stopSearch := context.WithCancel(context.Background())
+	srv.RegisterOnShutdown(stopSearch)
+	searchIndex.setContext(searchCtx)
+	go runSearchRefresh(searchCtx, searchIndex)
+
+	// Likewise for webhook polling and delivery
+	webhookCtx, stopWebhooks := context.WithCancel(context.Background())
+	srv.RegisterOnShutdown(stopWebhooks)
+	go webhooks.run(webhookCtx)
+
+	// And saving quota usage
+	quotaCtx, stopQuotas := context.WithCancel(context.Background())
+	srv.RegisterOnShutdown(stopQuotas)
+	go clientLimits.run(quotaCtx)
+
+	// And picking up new certificates
+	if serverTls != nil {
+		srv.TLSConfig = serverTls.config()
+		tlsCtx, stopTls := context.WithCancel(context.Background())
+		srv.RegisterOnShutdown(stopTls)
+		go serverTls.run(tlsCtx)
 	}
 
 	wg.Add(1)
 
 	go func() {
 		defer wg.Done()
-		err := srv.ListenAndServe()
+
+		var err error
+		if serverTls != nil {
+			// Certificates come from the config
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
 		if err != http.ErrServerClosed {
 			log.Fatalf("Server stopped due to error: %v", err)
 		}
@@ -120,7 +400,12 @@ func runServer(wg *sync.WaitGroup) *http.Server {
 // Request both the user and their posts, and stitch together into a UserPosts
 // struct
 func getUserPosts(id int) (*UserPosts, int, error) {
-	ctx, cancel := context.WithCancel(context.Background())
+	return getUserPostsContext(context.Background(), id)
+}
+
+// getUserPosts, giving up once ctx is cancelled
+func getUserPostsContext(parent context.Context, id int) (*UserPosts, int, error) {
+	ctx, cancel := context.WithCancel(parent)
 	defer cancel()
 
 	resChan := make(chan interface{})
@@ -136,32 +421,41 @@ func getUserPosts(id int) (*UserPosts, int, error) {
 		resChan <- getPosts(ctx, id)
 	}()
 
+	// If we error out, cancel the in-flight request and wait for it to
+	// return, so its goroutine isn't left blocked on resChan
+	pending := 2
+	abort := func() {
+		cancel()
+		for ; pending > 0; pending-- {
+			<-resChan
+		}
+	}
+
 	// Iterate until we have both the user and the post data. The requests
 	// are defined such that a 200 status and no errors will always have
 	// non-null values for these
 	for user == nil || posts == nil {
 		resIface := <-resChan
+		pending--
 		switch res := resIface.(type) {
 		case UserRes:
-			// If we error out, cancel the in-flight request
 			if res.err != nil {
-				cancel()
+				abort()
 				return nil, res.status, res.err
 			}
 			if errorStatus(res.status) {
-				cancel()
+				abort()
 				return nil, res.status, nil
 			}
 			user = res.user
 
 		case PostsRes:
-			// If we error out, cancel the in-flight request
 			if res.err != nil {
-				cancel()
+				abort()
 				return nil, res.status, res.err
 			}
 			if errorStatus(res.status) {
-				cancel()
+				abort()
 				return nil, res.status, nil
 			}
 			posts = res.posts
@@ -190,9 +484,7 @@ type UserRes struct {
 
 // Make a get request to the user's endpoint, and validate the response
 func getUser(ctx context.Context, id int) UserRes {
-	url := fmt.Sprintf("%s/users/%d", baseUrl, id)
-
-	res, status, err := getJson(ctx, url)
+	res, status, err := fetchJson(ctx, fmt.Sprintf("/users/%d", id))
 	if err != nil {
 		return UserRes{ status: status, err: err }
 	}
@@ -238,8 +530,7 @@ type PostsRes struct {
 // Make a get request to the posts endpoint with a userId filter, and validate
 // the response
 func getPosts(ctx context.Context, id int) PostsRes {
-	url := fmt.Sprintf("%s/posts?userId=%d", baseUrl, id)
-	res, status, err := getJson(ctx, url)
+	res, status, err := fetchJson(ctx, fmt.Sprintf("/posts?userId=%d", id))
 	if err != nil {
 		return PostsRes{ posts: nil, status: status, err: err }
 	}
@@ -248,7 +539,13 @@ func getPosts(ctx context.Context, id int) PostsRes {
 	}
 
 	posts, err := parsePosts(res)
-	return PostsRes{ posts: posts, status: status, err: err }
+	if err != nil {
+		return PostsRes{ posts: nil, status: status, err: err }
+	}
+
+	// Layer any local drafts over what the upstream has
+	posts = overlays.merge(id, posts)
+	return PostsRes{ posts: posts, status: status, err: nil }
 }
 
 // Unpack multiple posts in a list
@@ -353,21 +650,46 @@ func indexStr(data map[string]interface{}, key string) (string, error) {
 // An HTTP status code
 // An error. This may be an error in the request or in the parsing of the json
 func getJson(ctx context.Context, url string) (interface{}, int, error) {
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	return requestJson(ctx, "GET", url, nil)
+}
+
+// Make a request with the given method, sending body as json if it isn't nil,
+// and parse the response as json. Returns the same values as getJson.
+func requestJson(ctx context.Context, method string, url string, body interface{}) (interface{}, int, error) {
+	var reqBody io.Reader = nil
+	if body != nil {
+		bodyJson, err := json.Marshal(body)
+		if err != nil {
+			return nil, 0, err
+		}
+		reqBody = bytes.NewReader(bodyJson)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, reqBody)
 	if err != nil {
 		return nil, 0, err
 	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	}
 
-	httpRes, err := (&http.Client{}).Do(req)
+	httpRes, err := upstreamClientFor(url).Do(req)
 	if err != nil {
 		return nil, 0, err
 	}
 	defer httpRes.Body.Close()
 
+	upstreamLimiter.observe(httpRes.StatusCode, httpRes.Header.Get("Retry-After"))
+
 	if httpRes.StatusCode < 200 || httpRes.StatusCode >= 300 {
 		return nil, httpRes.StatusCode, nil
 	}
 
+	// Writes may not have anything to say
+	if httpRes.StatusCode == 204 {
+		return nil, httpRes.StatusCode, nil
+	}
+
 	var jsonRes interface{} = nil
 	err = json.NewDecoder(httpRes.Body).Decode(&jsonRes)
 	if err != nil {
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Local overlay of draft edits. The upstream fakes its writes, so posts
+// created, updated or deleted through the write endpoints are kept here
+// instead, and merged over the upstream's results in getPosts. Given a file,
+// the overlay is saved to it after every change, so drafts survive restarts.
+// Otherwise drafts only last as long as the server.
+
+type OverlayEntry struct {
+	PostId int `json:"postId"`
+	UserId int `json:"userId"`
+	// One of "created", "updated" or "deleted"
+	Op string `json:"op"`
+	// The post as it should now read. Not set for deletions.
+	Post *Post `json:"post,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// What's written to the overlay file
+type overlayFile struct {
+	NextId int `json:"nextId"`
+	Entries []OverlayEntry `json:"entries"`
+}
+
+type overlayStore struct {
+	mu sync.Mutex
+	// Where the overlay is saved. If empty, it is only kept in memory.
+	path string
+	nextId int
+	entries map[int]*OverlayEntry
+	// When the overlay was opened, or last changed. Discards count, which
+	// is why this isn't taken from the entries.
+	changedAt time.Time
+}
+
+func newOverlayStore(path string) *overlayStore {
+	return &overlayStore{ path: path, entries: map[int]*OverlayEntry{}, changedAt: time.Now() }
+}
+
+func (store *overlayStore) lastChange() time.Time {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.changedAt
+}
+
+var overlays = newOverlayStore("")
+
+// Open the overlay saved at path, or start an empty one if there isn't one yet
+func loadOverlayStore(path string) (*overlayStore, error) {
+	store := newOverlayStore(path)
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	file := overlayFile{}
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid overlay file %s: %v", path, err)
+	}
+
+	store.nextId = file.NextId
+	for i := range file.Entries {
+		entry := file.Entries[i]
+		store.entries[entry.PostId] = &entry
+	}
+
+	return store, nil
+}
+
+// Copy of the entries, for a change to be made to before it's committed. Must
+// be called with the store locked.
+func (store *overlayStore) copyEntries() map[int]*OverlayEntry {
+	entries := make(map[int]*OverlayEntry, len(store.entries))
+	for postId, entry := range store.entries {
+		entries[postId] = entry
+	}
+	return entries
+}
+
+// Save the overlay as it is with the given entries, replacing the previous
+// file in one step so a crash can't leave it half written, and only then
+// switch to them. A failed save leaves the overlay as it was. Must be called
+// with the store locked.
+func (store *overlayStore) commit(nextId int, entries map[int]*OverlayEntry) error {
+	if store.path != "" {
+		data, err := json.MarshalIndent(overlayFile{ nextId, sortedEntries(entries) }, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		err = writeFileAtomic(store.path, data)
+		if err != nil {
+			return err
+		}
+	}
+
+	store.nextId = nextId
+	store.entries = entries
+	store.changedAt = time.Now()
+	return nil
+}
+
+// Every entry, by post id. Must be called with the store locked.
+func (store *overlayStore) sorted() []OverlayEntry {
+	return sortedEntries(store.entries)
+}
+
+func sortedEntries(byId map[int]*OverlayEntry) []OverlayEntry {
+	entries := []OverlayEntry{}
+	for _, entry := range byId {
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].PostId < entries[j].PostId
+	})
+	return entries
+}
+
+func (store *overlayStore) list() []OverlayEntry {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.sorted()
+}
+
+func (store *overlayStore) get(postId int) (OverlayEntry, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	entry, ok := store.entries[postId]
+	if !ok {
+		return OverlayEntry{}, false
+	}
+	return *entry, true
+}
+
+// Record a newly created post. The upstream hands every new post the same id,
+// so ids are allocated here instead, starting from the upstream's.
+func (store *overlayStore) create(userId int, post Post) (Post, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if post.Id < store.nextId {
+		post.Id = store.nextId
+	}
+
+	entries := store.copyEntries()
+	entries[post.Id] = &OverlayEntry{
+		PostId: post.Id,
+		UserId: userId,
+		Op: "created",
+		Post: &post,
+		UpdatedAt: time.Now().UTC(),
+	}
+
+	err := store.commit(post.Id + 1, entries)
+	if err != nil {
+		return Post{}, err
+	}
+	return post, nil
+}
+
+// Record an edit. Posts that only exist in the overlay stay "created".
+func (store *overlayStore) update(userId int, post Post) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	op := "updated"
+	if prev, ok := store.entries[post.Id]; ok && prev.Op == "created" {
+		op = "created"
+	}
+
+	entries := store.copyEntries()
+	entries[post.Id] = &OverlayEntry{
+		PostId: post.Id,
+		UserId: userId,
+		Op: op,
+		Post: &post,
+		UpdatedAt: time.Now().UTC(),
+	}
+
+	return store.commit(store.nextId, entries)
+}
+
+// Record a deletion. Posts that only exist in the overlay are simply dropped.
+func (store *overlayStore) delete(userId int, postId int) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	entries := store.copyEntries()
+	if prev, ok := entries[postId]; ok && prev.Op == "created" {
+		delete(entries, postId)
+		return store.commit(store.nextId, entries)
+	}
+
+	entries[postId] = &OverlayEntry{
+		PostId: postId,
+		UserId: userId,
+		Op: "deleted",
+		UpdatedAt: time.Now().UTC(),
+	}
+
+	return store.commit(store.nextId, entries)
+}
+
+// Drop a pending entry, going back to the upstream's version of the post
+func (store *overlayStore) discard(postId int) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	_, ok := store.entries[postId]
+	if !ok {
+		return false, nil
+	}
+
+	entries := store.copyEntries()
+	delete(entries, postId)
+	return true, store.commit(store.nextId, entries)
+}
+
+func (store *overlayStore) discardAll() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	return store.commit(store.nextId, map[int]*OverlayEntry{})
+}
+
+// Apply a user's entries over their posts from upstream. Edits replace posts
+// in place, deletions remove them, and created posts are added at the end.
+func (store *overlayStore) merge(userId int, posts []Post) []Post {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	merged := make([]Post, 0, len(posts))
+	seen := map[int]bool{}
+	for _, post := range posts {
+		seen[post.Id] = true
+
+		entry, ok := store.entries[post.Id]
+		if !ok || entry.UserId != userId {
+			merged = append(merged, post)
+			continue
+		}
+		if entry.Op != "deleted" {
+			merged = append(merged, *entry.Post)
+		}
+	}
+
+	for _, entry := range store.sorted() {
+		if entry.UserId == userId && entry.Op == "created" && !seen[entry.PostId] {
+			merged = append(merged, *entry.Post)
+		}
+	}
+
+	return merged
+}
+
+// Value of the X-Overlay header for a user's posts, listing each post the
+// overlay changed, such as "updated=1, created=101". Empty if none were.
+func (store *overlayStore) marker(userId int) string {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	parts := []string{}
+	for _, entry := range store.sorted() {
+		if entry.UserId == userId {
+			parts = append(parts, fmt.Sprintf("%s=%d", entry.Op, entry.PostId))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+func setOverlayHeader(w http.ResponseWriter, userId int) {
+	if marker := overlays.marker(userId); marker != "" {
+		w.Header().Set("X-Overlay", marker)
+	}
+}
+
+// Serve /v1/overlays, listing or discarding every pending entry, and
+// /v1/overlays/{postId}, for discarding just one
+func handleOverlays(w http.ResponseWriter, r *http.Request) {
+	subpath := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/v1/overlays"), "/")
+
+	if subpath == "" {
+		switch r.Method {
+		case "GET":
+			writeJson(w, 200, overlays.list())
+		case "DELETE":
+			err := overlays.discardAll()
+			if err != nil {
+				writeError(w, 500, "Something went wrong")
+				return
+			}
+			w.WriteHeader(204)
+		default:
+			w.Header().Set("Allow", "GET, DELETE")
+			writeError(w, 405, "Method not allowed")
+		}
+		return
+	}
+
+	postId, err := strconv.Atoi(subpath)
+	if err != nil {
+		writeError(w, 404, "Not found")
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		entry, ok := overlays.get(postId)
+		if !ok {
+			writeError(w, 404, "Not found")
+			return
+		}
+		writeJson(w, 200, entry)
+
+	case "DELETE":
+		entry, ok := overlays.get(postId)
+		if !ok {
+			writeError(w, 404, "Not found")
+			return
+		}
+
+		_, err := overlays.discard(postId)
+		if err != nil {
+			writeError(w, 500, "Something went wrong")
+			return
+		}
+		invalidateUserPosts(entry.UserId)
+		w.WriteHeader(204)
+
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		writeError(w, 405, "Method not allowed")
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"testing"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// Swap in an empty overlay saved under the test's temp dir, so drafts made by
+// one test don't show up in another
+func useTempOverlay(t *testing.T) *overlayStore {
+	store, err := loadOverlayStore(filepath.Join(t.TempDir(), "overlay.json"))
+	if err != nil {
+		t.Fatalf("Unexpected error creating overlay: %v", err)
+	}
+
+	prevOverlays := overlays
+	overlays = store
+	t.Cleanup(func() { overlays = prevOverlays })
+
+	return store
+}
+
+func TestOverlayMerge(t *testing.T) {
+	store := newOverlayStore("")
+	store.update(1, Post{ 2, "edited", "" })
+	store.delete(1, 3)
+	store.create(1, Post{ 101, "new", "" })
+	// Other users' drafts are left alone
+	store.create(2, Post{ 101, "other", "" })
+
+	posts := []Post{ { 1, "one", "" }, { 2, "two", "" }, { 3, "three", "" } }
+	expected := []Post{ { 1, "one", "" }, { 2, "edited", "" }, { 101, "new", "" } }
+
+	merged := store.merge(1, posts)
+	if !reflect.DeepEqual(expected, merged) {
+		t.Fatalf("Expected %v, got %v", expected, merged)
+	}
+
+	marker := store.marker(1)
+	if marker != "updated=2, deleted=3, created=101" {
+		t.Fatalf("Got unexpected marker: %s", marker)
+	}
+}
+
+func TestOverlayCreateIds(t *testing.T) {
+	store := newOverlayStore("")
+
+	// The upstream gives every new post the same id
+	first, _ := store.create(1, Post{ Id: 101 })
+	second, _ := store.create(1, Post{ Id: 101 })
+	if first.Id != 101 || second.Id != 102 {
+		t.Fatalf("Expected ids 101 and 102, got %d and %d", first.Id, second.Id)
+	}
+
+	// Deleting a draft post drops it, rather than recording a deletion
+	store.delete(1, 102)
+	if _, ok := store.get(102); ok {
+		t.Fatalf("Expected draft to be dropped")
+	}
+}
+
+func TestOverlayPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "overlay.json")
+
+	store, _ := loadOverlayStore(path)
+	store.create(1, Post{ 101, "new", "post" })
+	store.update(1, Post{ 1, "edited", "post" })
+
+	reloaded, err := loadOverlayStore(path)
+	if err != nil {
+		t.Fatalf("Unexpected error loading overlay: %v", err)
+	}
+
+	if !reflect.DeepEqual(store.list(), reloaded.list()) {
+		t.Fatalf("Expected %v, got %v", store.list(), reloaded.list())
+	}
+
+	// Ids carry on from where they left off
+	post, _ := reloaded.create(1, Post{ Id: 101 })
+	if post.Id != 102 {
+		t.Fatalf("Expected id 102, got %d", post.Id)
+	}
+}
+
+func TestOverlayGetPosts(t *testing.T) {
+	startFakeUpstream(t)
+	useTempOverlay(t)
+
+	w := httptest.NewRecorder()
+	body := strings.NewReader(`{"title": "draft", "body": "post"}`)
+	handleCreatePost(w, httptest.NewRequest("POST", "/v1/users/1/posts", body))
+	if w.Code != 201 {
+		t.Fatalf("Expected 201, got %d: %s", w.Code, w.Body)
+	}
+
+	// Draft posts are edited locally, since the upstream has never heard
+	// of them
+	w = httptest.NewRecorder()
+	body = strings.NewReader(`{"body": "edited"}`)
+	handlePost(w, httptest.NewRequest("PATCH", "/v1/posts/101", body))
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	handlePost(w, httptest.NewRequest("DELETE", "/v1/posts/1", nil))
+	if w.Code != 204 {
+		t.Fatalf("Expected 204, got %d: %s", w.Code, w.Body)
+	}
+
+	res := getPosts(context.TODO(), 1)
+	if res.err != nil {
+		t.Fatalf("Unexpected error getting posts: %v", res.err)
+	}
+
+	if res.posts[0].Id != 2 {
+		t.Fatalf("Expected post 1 to be deleted, got %v", res.posts[0])
+	}
+	last := res.posts[len(res.posts) - 1]
+	if last != (Post{ 101, "draft", "edited" }) {
+		t.Fatalf("Expected draft post last, got %v", last)
+	}
+
+	// Deleted posts can't be edited
+	w = httptest.NewRecorder()
+	handlePost(w, httptest.NewRequest("DELETE", "/v1/posts/1", nil))
+	if w.Code != 404 {
+		t.Fatalf("Expected 404 deleting twice, got %d", w.Code)
+	}
+}
+
+func TestOverlayApi(t *testing.T) {
+	store := useTempOverlay(t)
+	store.update(1, Post{ 1, "edited", "post" })
+	store.update(1, Post{ 2, "edited", "post" })
+
+	w := httptest.NewRecorder()
+	handleOverlays(w, httptest.NewRequest("GET", "/v1/overlays", nil))
+	entries := []OverlayEntry{}
+	json.Unmarshal(w.Body.Bytes(), &entries)
+	if w.Code != 200 || len(entries) != 2 || entries[0].PostId != 1 || entries[0].Op != "updated" {
+		t.Fatalf("Got unexpected overlay list %d: %s", w.Code, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	handleOverlays(w, httptest.NewRequest("DELETE", "/v1/overlays/1", nil))
+	if w.Code != 204 || len(store.list()) != 1 {
+		t.Fatalf("Expected one entry discarded, got %d: %v", w.Code, store.list())
+	}
+
+	w = httptest.NewRecorder()
+	handleOverlays(w, httptest.NewRequest("DELETE", "/v1/overlays/1", nil))
+	if w.Code != 404 {
+		t.Fatalf("Expected 404 discarding twice, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handleOverlays(w, httptest.NewRequest("DELETE", "/v1/overlays", nil))
+	if w.Code != 204 || len(store.list()) != 0 {
+		t.Fatalf("Expected every entry discarded, got %d: %v", w.Code, store.list())
+	}
+}
+
+func TestOverlayFailedSave(t *testing.T) {
+	// The directory doesn't exist, so every save fails
+	store := newOverlayStore(filepath.Join(t.TempDir(), "missing", "overlay.json"))
+
+	_, err := store.create(1, Post{ 101, "new", "" })
+	if err == nil {
+		t.Fatalf("Expected create to fail")
+	}
+	err = store.update(1, Post{ 1, "edited", "" })
+	if err == nil {
+		t.Fatalf("Expected update to fail")
+	}
+	err = store.delete(1, 2)
+	if err == nil {
+		t.Fatalf("Expected delete to fail")
+	}
+
+	// None of which should have been kept
+	if entries := store.list(); len(entries) != 0 || store.nextId != 0 {
+		t.Fatalf("Expected failed changes to be dropped, got %v and next id %d", entries, store.nextId)
+	}
+	if merged := store.merge(1, []Post{ { 1, "one", "" } }); merged[0].Title != "one" || len(merged) != 1 {
+		t.Fatalf("Expected failed changes not to be served, got %v", merged)
+	}
+}
+
+func TestLoadOverlayStoreInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "overlay.json")
+	os.WriteFile(path, []byte("{"), 0644)
+
+	_, err := loadOverlayStore(path)
+	if err == nil {
+		t.Fatalf("Expected a corrupt overlay file to be an error")
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"encoding/base64"
+)
+
+// The upstream returns every post for a user in a single list, with no way to
+// page through or order them. Pagination and sorting are therefore applied
+// locally, after the full list has been fetched and validated.
+
+// Upper bound on ?limit=, so a single page can't be arbitrarily large
+const maxPostsLimit = 100
+
+// Parsed form of the pagination, sorting and filtering query parameters
+type PostsQuery struct {
+	// Maximum number of posts to return. Zero means no limit
+	limit int
+	offset int
+	sort string
+	// Whether the client is paging with opaque cursors, in which case the
+	// next/prev links are rendered as cursors rather than offsets
+	cursor bool
+	// Title and body filters, applied before sorting and pagination
+	filters []PostFilter
+	// Whether any of the parameters were given at all. If not, the plain
+	// UserPosts structure is returned, as before pagination existed
+	paged bool
+}
+
+// Response envelope for a page of posts. Embedding UserPosts keeps the
+// existing fields at the top level of the rendered json.
+type UserPostsPage struct {
+	UserPosts
+	TotalPosts int `json:"totalPosts" xml:"totalPosts"`
+	// Only set when filters were given, since otherwise it always equals
+	// TotalPosts
+	MatchedPosts *int `json:"matchedPosts,omitempty" xml:"matchedPosts,omitempty"`
+	Next string `json:"next,omitempty" xml:"next,omitempty"`
+	Prev string `json:"prev,omitempty" xml:"prev,omitempty"`
+}
+
+// Read limit, offset, cursor, sort and filters from the request query.
+// Offsets and cursors are mutually exclusive, since both describe the start of
+// the page.
+func parsePostsQuery(values url.Values) (PostsQuery, error) {
+	query := PostsQuery{}
+
+	for _, key := range []string{"limit", "offset", "cursor", "sort"} {
+		if _, ok := values[key]; ok {
+			query.paged = true
+		}
+	}
+
+	filters, err := parsePostFilters(values)
+	if err != nil {
+		return PostsQuery{}, err
+	}
+	if len(filters) > 0 {
+		query.filters = filters
+		query.paged = true
+	}
+
+	if str := values.Get("limit"); str != "" {
+		limit, err := strconv.Atoi(str)
+		if err != nil || limit < 1 || limit > maxPostsLimit {
+			return PostsQuery{}, fmt.Errorf(
+				"limit must be an integer between 1 and %d",
+				maxPostsLimit,
+			)
+		}
+		query.limit = limit
+	}
+
+	offsetStr := values.Get("offset")
+	cursorStr := values.Get("cursor")
+	if offsetStr != "" && cursorStr != "" {
+		return PostsQuery{}, fmt.Errorf("offset and cursor cannot both be given")
+	}
+
+	if offsetStr != "" {
+		offset, err := strconv.Atoi(offsetStr)
+		if err != nil || offset < 0 {
+			return PostsQuery{}, fmt.Errorf("offset must be a non-negative integer")
+		}
+		query.offset = offset
+	}
+
+	if cursorStr != "" {
+		offset, err := decodeCursor(cursorStr)
+		if err != nil {
+			return PostsQuery{}, err
+		}
+		query.offset = offset
+		query.cursor = true
+	}
+
+	switch sort := values.Get("sort"); sort {
+	case "", "id", "-id", "title", "-title":
+		query.sort = sort
+	default:
+		return PostsQuery{}, fmt.Errorf("sort must be one of id, -id, title, -title")
+	}
+
+	return query, nil
+}
+
+// Cursors are the base64 encoding of the offset they point at. They are
+// opaque to clients, which lets the representation change later without
+// breaking anyone holding on to a link.
+func encodeCursor(offset int) string {
+	return base64.RawURLEncoding.EncodeToString(
+		[]byte(fmt.Sprintf("offset:%d", offset)),
+	)
+}
+
+func decodeCursor(cursor string) (int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, fmt.Errorf("invalid cursor")
+	}
+
+	str := string(raw)
+	if !strings.HasPrefix(str, "offset:") {
+		return 0, fmt.Errorf("invalid cursor")
+	}
+
+	offset, err := strconv.Atoi(strings.TrimPrefix(str, "offset:"))
+	if err != nil || offset < 0 {
+		return 0, fmt.Errorf("invalid cursor")
+	}
+
+	return offset, nil
+}
+
+// Return a sorted copy of posts. The sort is stable, so posts with equal
+// titles keep their upstream order.
+func sortPosts(posts []Post, key string) []Post {
+	sorted := make([]Post, len(posts))
+	copy(sorted, posts)
+
+	var less func(a, b Post) bool
+	switch key {
+	case "id":
+		less = func(a, b Post) bool { return a.Id < b.Id }
+	case "-id":
+		less = func(a, b Post) bool { return a.Id > b.Id }
+	case "title":
+		less = func(a, b Post) bool { return a.Title < b.Title }
+	case "-title":
+		less = func(a, b Post) bool { return a.Title > b.Title }
+	default:
+		return sorted
+	}
+
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return less(sorted[i], sorted[j])
+	})
+
+	return sorted
+}
+
+// Apply the query to a user's posts. If no params were given the UserPosts is
+// returned untouched, otherwise a UserPostsPage wrapping the requested slice,
+// with links relative to the request URL.
+func (query PostsQuery) apply(reqUrl *url.URL, userPosts *UserPosts) interface{} {
+	if !query.paged {
+		return userPosts
+	}
+
+	posts := userPosts.Posts
+	if query.filters != nil {
+		posts = filterPosts(posts, query.filters)
+	}
+
+	posts = sortPosts(posts, query.sort)
+	total := len(posts)
+
+	start := query.offset
+	if start > total {
+		start = total
+	}
+
+	end := total
+	if query.limit > 0 && start+query.limit < total {
+		end = start + query.limit
+	}
+
+	page := &UserPostsPage{
+		UserPosts: UserPosts{
+			Id: userPosts.Id,
+			UserInfo: userPosts.UserInfo,
+			Posts: posts[start:end],
+		},
+		TotalPosts: len(userPosts.Posts),
+	}
+
+	if query.filters != nil {
+		page.MatchedPosts = &total
+	}
+
+	// Without a limit the page runs to the end of the list, so there is
+	// nothing to link to
+	if query.limit == 0 {
+		return page
+	}
+
+	if end < total {
+		page.Next = query.link(reqUrl, end)
+	}
+
+	if start > 0 {
+		prev := start - query.limit
+		if prev < 0 {
+			prev = 0
+		}
+		page.Prev = query.link(reqUrl, prev)
+	}
+
+	return page
+}
+
+// Build a link to the page starting at offset, preserving the rest of the
+// request's query string
+func (query PostsQuery) link(reqUrl *url.URL, offset int) string {
+	values := reqUrl.Query()
+	values.Del("offset")
+	values.Del("cursor")
+
+	if query.cursor {
+		values.Set("cursor", encodeCursor(offset))
+	} else {
+		values.Set("offset", strconv.Itoa(offset))
+	}
+
+	link := url.URL{ Path: reqUrl.Path, RawQuery: values.Encode() }
+	return link.String()
+}
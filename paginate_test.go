@@ -0,0 +1,128 @@
+package main
+
+import (
+	"testing"
+	"net/url"
+	"reflect"
+)
+
+func TestParsePostsQuery(t *testing.T) {
+	query, err := parsePostsQuery(url.Values{})
+	if err != nil {
+		t.Fatalf("Unexpected error parsing empty query: %v", err)
+	}
+
+	if query.paged {
+		t.Fatalf("Empty query should not be paged")
+	}
+
+	query, err = parsePostsQuery(url.Values{
+		"limit": {"3"},
+		"offset": {"2"},
+		"sort": {"-id"},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error parsing query: %v", err)
+	}
+
+	exp := PostsQuery{ limit: 3, offset: 2, sort: "-id", paged: true }
+	if !reflect.DeepEqual(exp, query) {
+		t.Fatalf("\nExpected:\n%v\nGot:\n%v\n", exp, query)
+	}
+
+	bad := []url.Values{
+		{ "limit": {"0"} },
+		{ "limit": {"101"} },
+		{ "limit": {"abc"} },
+		{ "offset": {"-1"} },
+		{ "sort": {"body"} },
+		{ "cursor": {"not a cursor"} },
+		{ "offset": {"1"}, "cursor": {encodeCursor(1)} },
+	}
+
+	for _, values := range bad {
+		_, err := parsePostsQuery(values)
+		if err == nil {
+			t.Fatalf("Did not get error parsing query: %v", values)
+		}
+	}
+}
+
+func TestCursor(t *testing.T) {
+	offset, err := decodeCursor(encodeCursor(42))
+	if err != nil {
+		t.Fatalf("Unexpected error decoding cursor: %v", err)
+	}
+
+	if offset != 42 {
+		t.Fatalf("Got unexpected offset: %d", offset)
+	}
+}
+
+func TestSortPosts(t *testing.T) {
+	sorted := sortPosts(expPosts, "-id")
+	for i, post := range sorted {
+		if post.Id != len(expPosts) - i {
+			t.Fatalf("Posts not sorted by descending id: %v", sorted)
+		}
+	}
+
+	sorted = sortPosts(expPosts, "title")
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i-1].Title > sorted[i].Title {
+			t.Fatalf("Posts not sorted by title: %v", sorted)
+		}
+	}
+
+	// The input should not be reordered
+	if expPosts[0].Id != 1 {
+		t.Fatalf("sortPosts modified its input")
+	}
+}
+
+func TestApplyPostsQuery(t *testing.T) {
+	userPosts := &UserPosts{ Id: 1, UserInfo: *expUser, Posts: expPosts }
+	reqUrl, _ := url.Parse("/v1/user-posts/1?limit=3&offset=3")
+
+	query, _ := parsePostsQuery(reqUrl.Query())
+	page, ok := query.apply(reqUrl, userPosts).(*UserPostsPage)
+	if !ok {
+		t.Fatalf("Paged query did not return a UserPostsPage")
+	}
+
+	if !reflect.DeepEqual(expPosts[3:6], page.Posts) {
+		t.Fatalf("\nExpected:\n%v\nGot:\n%v\n", expPosts[3:6], page.Posts)
+	}
+
+	if page.TotalPosts != 10 {
+		t.Fatalf("Got unexpected total: %d", page.TotalPosts)
+	}
+
+	if page.Next != "/v1/user-posts/1?limit=3&offset=6" {
+		t.Fatalf("Got unexpected next link: %s", page.Next)
+	}
+
+	if page.Prev != "/v1/user-posts/1?limit=3&offset=0" {
+		t.Fatalf("Got unexpected prev link: %s", page.Prev)
+	}
+
+	// Cursor pagination should link with cursors, and the last page should
+	// have no next link
+	reqUrl, _ = url.Parse("/v1/user-posts/1?limit=5&cursor=" + encodeCursor(5))
+	query, _ = parsePostsQuery(reqUrl.Query())
+	page = query.apply(reqUrl, userPosts).(*UserPostsPage)
+
+	if page.Next != "" {
+		t.Fatalf("Got next link on last page: %s", page.Next)
+	}
+
+	if page.Prev != "/v1/user-posts/1?cursor=" + encodeCursor(0) + "&limit=5" {
+		t.Fatalf("Got unexpected prev link: %s", page.Prev)
+	}
+
+	// Unpaged queries return the UserPosts as-is
+	query, _ = parsePostsQuery(url.Values{})
+	if query.apply(reqUrl, userPosts) != userPosts {
+		t.Fatalf("Unpaged query did not return the original UserPosts")
+	}
+}
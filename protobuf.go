@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Hand-written protobuf encoding of UserPosts, following userposts.proto.
+// The schema is small enough that generated code and the dependency on the
+// protobuf runtime aren't worth it.
+
+// Protobuf wire types
+const (
+	wireVarint = 0
+	wireFixed64 = 1
+	wireBytes = 2
+	wireFixed32 = 5
+)
+
+func appendUvarint(buf []byte, val uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], val)
+	return append(buf, tmp[:n]...)
+}
+
+func appendTag(buf []byte, field int, wireType int) []byte {
+	return appendUvarint(buf, uint64(field << 3 | wireType))
+}
+
+// proto3 leaves out fields holding their zero value
+func appendIntField(buf []byte, field int, val int) []byte {
+	if val == 0 {
+		return buf
+	}
+	return appendOptionalIntField(buf, field, val)
+}
+
+// Fields marked optional are written whenever they are present, even if zero
+func appendOptionalIntField(buf []byte, field int, val int) []byte {
+	buf = appendTag(buf, field, wireVarint)
+	return appendUvarint(buf, uint64(int64(val)))
+}
+
+func appendStringField(buf []byte, field int, val string) []byte {
+	if val == "" {
+		return buf
+	}
+	return appendBytesField(buf, field, []byte(val))
+}
+
+func appendBytesField(buf []byte, field int, val []byte) []byte {
+	buf = appendTag(buf, field, wireBytes)
+	buf = appendUvarint(buf, uint64(len(val)))
+	return append(buf, val...)
+}
+
+func marshalUserProto(user User) []byte {
+	var buf []byte
+	buf = appendStringField(buf, 1, user.Name)
+	buf = appendStringField(buf, 2, user.Username)
+	buf = appendStringField(buf, 3, user.Email)
+	return buf
+}
+
+func marshalPostProto(post Post) []byte {
+	var buf []byte
+	buf = appendIntField(buf, 1, post.Id)
+	buf = appendStringField(buf, 2, post.Title)
+	buf = appendStringField(buf, 3, post.Body)
+	return buf
+}
+
+// Encode a UserPosts message. If page is given, its envelope fields are
+// included alongside.
+func marshalUserPostsProto(userPosts *UserPosts, page *UserPostsPage) []byte {
+	var buf []byte
+	buf = appendIntField(buf, 1, userPosts.Id)
+	// Sub-messages are always written, even if empty, so the decoder can
+	// tell an empty user apart from a missing one
+	buf = appendBytesField(buf, 2, marshalUserProto(userPosts.UserInfo))
+	for _, post := range userPosts.Posts {
+		buf = appendBytesField(buf, 3, marshalPostProto(post))
+	}
+
+	if page != nil {
+		buf = appendOptionalIntField(buf, 4, page.TotalPosts)
+		if page.MatchedPosts != nil {
+			buf = appendOptionalIntField(buf, 5, *page.MatchedPosts)
+		}
+		buf = appendStringField(buf, 6, page.Next)
+		buf = appendStringField(buf, 7, page.Prev)
+	}
+
+	return buf
+}
+
+func encodeProtobuf(v interface{}) ([]byte, error) {
+	switch res := v.(type) {
+	case *UserPosts:
+		return marshalUserPostsProto(res, nil), nil
+	case *UserPostsPage:
+		return marshalUserPostsProto(&res.UserPosts, res), nil
+	default:
+		return nil, fmt.Errorf("Cannot encode %T as protobuf", v)
+	}
+}
+
+// A single decoded field. Only one of varint and bytes is set, depending on
+// the wire type.
+type protoField struct {
+	field int
+	wireType int
+	varint uint64
+	bytes []byte
+}
+
+// Split an encoded message into its fields. Fixed width fields are skipped,
+// since nothing in the schema uses them, but unknown fields of any wire type
+// must not stop decoding.
+func readProtoFields(data []byte) ([]protoField, error) {
+	var fields []protoField
+
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, fmt.Errorf("Invalid protobuf tag")
+		}
+		data = data[n:]
+
+		field := protoField{ field: int(tag >> 3), wireType: int(tag & 7) }
+		switch field.wireType {
+		case wireVarint:
+			val, n := binary.Uvarint(data)
+			if n <= 0 {
+				return nil, fmt.Errorf("Invalid protobuf varint")
+			}
+			field.varint = val
+			data = data[n:]
+
+		case wireBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data) - n) < length {
+				return nil, fmt.Errorf("Invalid protobuf length")
+			}
+			field.bytes = data[n:n+int(length)]
+			data = data[n+int(length):]
+
+		case wireFixed64:
+			if len(data) < 8 {
+				return nil, fmt.Errorf("Truncated protobuf fixed64")
+			}
+			data = data[8:]
+			continue
+
+		case wireFixed32:
+			if len(data) < 4 {
+				return nil, fmt.Errorf("Truncated protobuf fixed32")
+			}
+			data = data[4:]
+			continue
+
+		default:
+			return nil, fmt.Errorf("Unsupported protobuf wire type %d", field.wireType)
+		}
+
+		fields = append(fields, field)
+	}
+
+	return fields, nil
+}
+
+func unmarshalUserProto(data []byte) (User, error) {
+	fields, err := readProtoFields(data)
+	if err != nil {
+		return User{}, err
+	}
+
+	user := User{}
+	for _, field := range fields {
+		if field.wireType != wireBytes {
+			continue
+		}
+
+		switch field.field {
+		case 1:
+			user.Name = string(field.bytes)
+		case 2:
+			user.Username = string(field.bytes)
+		case 3:
+			user.Email = string(field.bytes)
+		}
+	}
+
+	return user, nil
+}
+
+func unmarshalPostProto(data []byte) (Post, error) {
+	fields, err := readProtoFields(data)
+	if err != nil {
+		return Post{}, err
+	}
+
+	post := Post{}
+	for _, field := range fields {
+		switch {
+		case field.field == 1 && field.wireType == wireVarint:
+			post.Id = int(int64(field.varint))
+		case field.field == 2 && field.wireType == wireBytes:
+			post.Title = string(field.bytes)
+		case field.field == 3 && field.wireType == wireBytes:
+			post.Body = string(field.bytes)
+		}
+	}
+
+	return post, nil
+}
+
+// Decode a UserPosts message, along with any envelope fields
+func unmarshalUserPostsProto(data []byte) (*UserPostsPage, error) {
+	fields, err := readProtoFields(data)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &UserPostsPage{ UserPosts: UserPosts{ Posts: []Post{} } }
+	for _, field := range fields {
+		switch {
+		case field.field == 1 && field.wireType == wireVarint:
+			page.Id = int(int64(field.varint))
+
+		case field.field == 2 && field.wireType == wireBytes:
+			page.UserInfo, err = unmarshalUserProto(field.bytes)
+			if err != nil {
+				return nil, err
+			}
+
+		case field.field == 3 && field.wireType == wireBytes:
+			post, err := unmarshalPostProto(field.bytes)
+			if err != nil {
+				return nil, err
+			}
+			page.Posts = append(page.Posts, post)
+
+		case field.field == 4 && field.wireType == wireVarint:
+			page.TotalPosts = int(int64(field.varint))
+
+		case field.field == 5 && field.wireType == wireVarint:
+			matched := int(int64(field.varint))
+			page.MatchedPosts = &matched
+
+		case field.field == 6 && field.wireType == wireBytes:
+			page.Next = string(field.bytes)
+
+		case field.field == 7 && field.wireType == wireBytes:
+			page.Prev = string(field.bytes)
+		}
+	}
+
+	return page, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+	"encoding/json"
+	"reflect"
+)
+
+// Round trip through protobuf, and check the result renders to the same json
+// as the original
+func TestProtobufRoundTrip(t *testing.T) {
+	matched := 0
+	values := []interface{}{
+		&UserPosts{ Id: 1, UserInfo: *expUser, Posts: expPosts },
+		&UserPostsPage{
+			UserPosts: UserPosts{ Id: 1, UserInfo: *expUser, Posts: expPosts[:2] },
+			TotalPosts: 10,
+			MatchedPosts: &matched,
+			Next: "/v1/user-posts/1?limit=2&offset=2",
+		},
+	}
+
+	for _, v := range values {
+		data, err := encodeProtobuf(v)
+		if err != nil {
+			t.Fatalf("Unexpected error encoding protobuf: %v", err)
+		}
+
+		page, err := unmarshalUserPostsProto(data)
+		if err != nil {
+			t.Fatalf("Unexpected error decoding protobuf: %v", err)
+		}
+
+		var decoded interface{} = page
+		if _, ok := v.(*UserPosts); ok {
+			decoded = &page.UserPosts
+		}
+
+		expJson, _ := json.Marshal(v)
+		resJson, _ := json.Marshal(decoded)
+		if string(expJson) != string(resJson) {
+			t.Fatalf("\nExpected:\n%s\nGot:\n%s\n", expJson, resJson)
+		}
+	}
+}
+
+func TestProtobufWireFormat(t *testing.T) {
+	// Field 1 varint 150 is the canonical example from the protobuf docs
+	res := marshalPostProto(Post{ Id: 150 })
+	if !reflect.DeepEqual([]byte{0x08, 0x96, 0x01}, res) {
+		t.Fatalf("Got unexpected encoding: %x", res)
+	}
+
+	res = marshalUserProto(User{ Name: "testing" })
+	exp := []byte{0x0a, 0x07, 't', 'e', 's', 't', 'i', 'n', 'g'}
+	if !reflect.DeepEqual(exp, res) {
+		t.Fatalf("Got unexpected encoding: %x", res)
+	}
+}
+
+func TestProtobufUnknownFields(t *testing.T) {
+	data := marshalPostProto(Post{ Id: 3, Title: "title" })
+	// Unknown varint, fixed64, length delimited and fixed32 fields
+	data = append(data, 0x50, 0x01)
+	data = append(data, 0x59, 1, 2, 3, 4, 5, 6, 7, 8)
+	data = append(data, 0x62, 0x01, 'x')
+	data = append(data, 0x6d, 1, 2, 3, 4)
+
+	post, err := unmarshalPostProto(data)
+	if err != nil {
+		t.Fatalf("Unexpected error decoding protobuf: %v", err)
+	}
+
+	if !reflect.DeepEqual(Post{ Id: 3, Title: "title" }, post) {
+		t.Fatalf("Got unexpected post: %v", post)
+	}
+
+	_, err = unmarshalPostProto([]byte{0x12, 0x05, 'a'})
+	if err == nil {
+		t.Fatalf("Did not get error decoding truncated protobuf")
+	}
+}
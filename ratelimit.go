@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Inbound rate limiting and daily quotas, per client. Clients whose API key or
+// bearer token checked out are told apart by it, and everyone else by IP. Each
+// client gets a token bucket, with keyed clients allowed more, and a count of
+// requests made today, which can be saved to a file so quotas survive
+// restarts.
+//
+// Limits are off until configured. The serve command turns them on with its
+// flag defaults.
+
+// Requests per second and burst for clients identified by IP. A rate of 0
+// means unlimited.
+var ipRateLimit = 0.0
+var ipRateBurst = 0
+
+// Likewise for clients identified by API key
+var keyRateLimit = 0.0
+var keyRateBurst = 0
+
+// Requests allowed per client per UTC day. 0 means unlimited.
+var dailyQuota = 0
+
+// Defaults for the serve command's flags
+const defaultIpRateLimit = 10.0
+const defaultIpRateBurst = 20
+const defaultKeyRateLimit = 50.0
+const defaultKeyRateBurst = 100
+
+// How often usage is saved, and idle buckets dropped
+var quotaSaveInterval = 10 * time.Second
+
+type clientBucket struct {
+	tokens float64
+	last time.Time
+	// When the bucket will have refilled completely
+	full time.Time
+}
+
+// What a request is allowed, and what to tell the client about it
+type limitDecision struct {
+	allowed bool
+	// Why the request was refused
+	reason string
+
+	limited bool
+	limit int
+	remaining int
+	reset time.Duration
+
+	quota int
+	quotaRemaining int
+	quotaReset time.Duration
+
+	retryAfter time.Duration
+}
+
+// What's written to the quota file
+type quotaFile struct {
+	Day string `json:"day"`
+	Usage map[string]int `json:"usage"`
+}
+
+type clientLimiter struct {
+	mu sync.Mutex
+	buckets map[string]*clientBucket
+	day string
+	usage map[string]int
+
+	// Where usage is saved. If empty, it's only kept in memory.
+	path string
+	dirty bool
+}
+
+func newClientLimiter(path string) *clientLimiter {
+	return &clientLimiter{
+		buckets: map[string]*clientBucket{},
+		day: time.Now().UTC().Format(time.DateOnly),
+		usage: map[string]int{},
+		path: path,
+	}
+}
+
+var clientLimits = newClientLimiter("")
+
+// Open the usage saved at path. Usage from a previous day is discarded.
+func loadClientLimiter(path string) (*clientLimiter, error) {
+	limiter := newClientLimiter(path)
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return limiter, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	file := quotaFile{}
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid quota file %s: %v", path, err)
+	}
+
+	if file.Day == limiter.day && file.Usage != nil {
+		limiter.usage = file.Usage
+	}
+	return limiter, nil
+}
+
+// Identify the client making a request. Verified keys go by their id, and
+// verified tokens by their subject. Everyone else goes by their IP.
+func clientId(r *http.Request) (string, bool) {
+	if p := requestPrincipal(r); p != nil && !p.invalid {
+		if p.keyId != "" {
+			return "key:" + p.keyId, true
+		}
+		if p.subject != "" {
+			return "sub:" + p.subject, true
+		}
+	}
+	// Anything else sent, checked or not, counts against the IP. Otherwise
+	// made up keys would each get a fresh bucket and quota.
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host, false
+}
+
+func untilMidnight(now time.Time) time.Duration {
+	utc := now.UTC()
+	midnight := time.Date(utc.Year(), utc.Month(), utc.Day() + 1, 0, 0, 0, 0, time.UTC)
+	return midnight.Sub(utc)
+}
+
+// Decide whether a client may make a request, counting it if so
+func (cl *clientLimiter) check(client string, keyed bool, now time.Time) limitDecision {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	decision := limitDecision{ allowed: true }
+
+	// Quotas start again each day
+	if today := now.UTC().Format(time.DateOnly); today != cl.day {
+		cl.day = today
+		cl.usage = map[string]int{}
+		cl.dirty = true
+	}
+
+	if dailyQuota > 0 {
+		used := cl.usage[client]
+		decision.quota = dailyQuota
+		decision.quotaRemaining = max(dailyQuota - used, 0)
+		decision.quotaReset = untilMidnight(now)
+
+		if used >= dailyQuota {
+			decision.allowed = false
+			decision.reason = "Daily quota exceeded"
+			decision.retryAfter = decision.quotaReset
+			return decision
+		}
+	}
+
+	rate, burst := ipRateLimit, ipRateBurst
+	if keyed {
+		rate, burst = keyRateLimit, keyRateBurst
+	}
+
+	if rate > 0 {
+		bucket, ok := cl.buckets[client]
+		if !ok {
+			bucket = &clientBucket{ tokens: float64(burst), last: now }
+			cl.buckets[client] = bucket
+		}
+
+		bucket.tokens = min(bucket.tokens + now.Sub(bucket.last).Seconds() * rate, float64(burst))
+		bucket.last = now
+
+		decision.limited = true
+		decision.limit = burst
+
+		if bucket.tokens < 1 {
+			decision.allowed = false
+			decision.reason = "Rate limit exceeded"
+			decision.remaining = 0
+			decision.retryAfter = time.Duration((1 - bucket.tokens) / rate * float64(time.Second))
+			decision.reset = time.Duration((float64(burst) - bucket.tokens) / rate * float64(time.Second))
+			return decision
+		}
+
+		bucket.tokens--
+		decision.remaining = int(bucket.tokens)
+		decision.reset = time.Duration((float64(burst) - bucket.tokens) / rate * float64(time.Second))
+		bucket.full = now.Add(decision.reset)
+	}
+
+	if dailyQuota > 0 {
+		cl.usage[client]++
+		cl.dirty = true
+		decision.quotaRemaining--
+	}
+
+	return decision
+}
+
+// Write out usage if it has changed, and drop buckets that have refilled,
+// since they're no different from new ones
+func (cl *clientLimiter) flush(now time.Time) error {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	for client, bucket := range cl.buckets {
+		if now.After(bucket.full) {
+			delete(cl.buckets, client)
+		}
+	}
+
+	if cl.path == "" || !cl.dirty {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(quotaFile{ cl.day, cl.usage }, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = writeFileAtomic(cl.path, data)
+	if err == nil {
+		cl.dirty = false
+	}
+	return err
+}
+
+func (cl *clientLimiter) run(ctx context.Context) {
+	ticker := time.NewTicker(quotaSaveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			// Save whatever is left before going
+			err := cl.flush(time.Now())
+			if err != nil {
+				log.Printf("Failed to save quota usage: %v", err)
+			}
+			return
+		case <-ticker.C:
+			err := cl.flush(time.Now())
+			if err != nil {
+				log.Printf("Failed to save quota usage: %v", err)
+			}
+		}
+	}
+}
+
+// Whole seconds, rounded up, as used by the rate limit headers
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// Refuse requests from clients over their limits, telling everyone else how
+// much they have left
+func limitClients(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client, keyed := clientId(r)
+		decision := clientLimits.check(client, keyed, time.Now())
+
+		if decision.limited {
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(decision.limit))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(decision.remaining))
+			w.Header().Set("RateLimit-Reset", ceilSeconds(decision.reset))
+		}
+		if decision.quota > 0 {
+			w.Header().Set("X-Quota-Limit", strconv.Itoa(decision.quota))
+			w.Header().Set("X-Quota-Remaining", strconv.Itoa(decision.quotaRemaining))
+			w.Header().Set("X-Quota-Reset", ceilSeconds(decision.quotaReset))
+		}
+
+		if !decision.allowed {
+			w.Header().Set("Retry-After", ceilSeconds(decision.retryAfter))
+			writeProblem(w, 429, decision.reason, fmt.Sprintf(
+				"Too many requests, try again in %s seconds",
+				ceilSeconds(decision.retryAfter),
+			))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"testing"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Swap in the given limits, and a fresh limiter, for the rest of the test
+func useClientLimits(t *testing.T, ipRate float64, ipBurst int, quota int) *clientLimiter {
+	prevIpRate, prevIpBurst := ipRateLimit, ipRateBurst
+	prevKeyRate, prevKeyBurst := keyRateLimit, keyRateBurst
+	prevQuota, prevLimits := dailyQuota, clientLimits
+
+	ipRateLimit, ipRateBurst = ipRate, ipBurst
+	keyRateLimit, keyRateBurst = ipRate * 2, ipBurst * 2
+	dailyQuota = quota
+	clientLimits = newClientLimiter("")
+
+	t.Cleanup(func() {
+		ipRateLimit, ipRateBurst = prevIpRate, prevIpBurst
+		keyRateLimit, keyRateBurst = prevKeyRate, prevKeyBurst
+		dailyQuota, clientLimits = prevQuota, prevLimits
+	})
+	return clientLimits
+}
+
+func limitedRequest(handler http.Handler, key string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/v1/user-posts/1", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	if key != "" {
+		req.Header.Set("X-API-Key", key)
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestLimitClientsBurst(t *testing.T) {
+	useClientLimits(t, 1, 2, 0)
+	handler := limitClients(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+
+	for i := 0; i < 2; i++ {
+		rec := limitedRequest(handler, "")
+		if rec.Code != 200 {
+			t.Fatalf("Expected burst to be allowed, got %d", rec.Code)
+		}
+	}
+
+	rec := limitedRequest(handler, "")
+	if rec.Code != 429 {
+		t.Fatalf("Expected 429 once the burst is used, got %d", rec.Code)
+	}
+	if rec.Header().Get("Content-Type") != "application/problem+json" {
+		t.Fatalf("Expected problem response, got %s", rec.Header().Get("Content-Type"))
+	}
+	if rec.Header().Get("Retry-After") != "1" || rec.Header().Get("RateLimit-Limit") != "2" ||
+		rec.Header().Get("RateLimit-Remaining") != "0" {
+		t.Fatalf("Got unexpected headers: %v", rec.Header())
+	}
+
+	problem := Problem{}
+	err := json.Unmarshal(rec.Body.Bytes(), &problem)
+	if err != nil || problem.Status != 429 || problem.Title != "Rate limit exceeded" {
+		t.Fatalf("Got unexpected problem: %s", rec.Body.String())
+	}
+
+	// Keys that haven't been checked count against the IP, however many are
+	// made up
+	for _, key := range []string{ "made", "up", "keys" } {
+		if rec := limitedRequest(handler, key); rec.Code != 429 {
+			t.Fatalf("Expected unchecked key %s to share the IP's bucket, got %d", key, rec.Code)
+		}
+	}
+	if len(clientLimits.buckets) != 1 {
+		t.Fatalf("Expected unchecked keys not to get buckets, got %d", len(clientLimits.buckets))
+	}
+
+	// Requests with a valid API key have their own, larger bucket
+	keys := useApiKeys(t, map[string][]string{ "reporting": { scopeUserPostsRead }, "other": { scopeUserPostsRead } })
+	handler = authenticate(handler)
+	for i := 0; i < 4; i++ {
+		rec := limitedRequest(handler, keys["reporting"])
+		if rec.Code != 200 {
+			t.Fatalf("Expected keyed request %d to be allowed, got %d", i, rec.Code)
+		}
+	}
+	if rec := limitedRequest(handler, keys["reporting"]); rec.Code != 429 {
+		t.Fatalf("Expected keyed burst to run out, got %d", rec.Code)
+	}
+	if rec := limitedRequest(handler, keys["other"]); rec.Code != 200 {
+		t.Fatalf("Expected other keys to be unaffected, got %d", rec.Code)
+	}
+	if rec := limitedRequest(handler, "invalid"); rec.Code != 429 {
+		t.Fatalf("Expected an invalid key to count against the IP, got %d", rec.Code)
+	}
+}
+
+func TestClientLimiterRefill(t *testing.T) {
+	limiter := useClientLimits(t, 10, 1, 0)
+	now := time.Now()
+
+	if !limiter.check("ip:a", false, now).allowed {
+		t.Fatalf("Expected first request to be allowed")
+	}
+	if limiter.check("ip:a", false, now).allowed {
+		t.Fatalf("Expected second request to be refused")
+	}
+	if !limiter.check("ip:a", false, now.Add(100 * time.Millisecond)).allowed {
+		t.Fatalf("Expected a token back after 100ms")
+	}
+
+	// Refilled buckets are dropped
+	limiter.flush(now.Add(time.Second))
+	if len(limiter.buckets) != 0 {
+		t.Fatalf("Expected idle buckets to be dropped, got %d", len(limiter.buckets))
+	}
+}
+
+func TestClientLimiterQuota(t *testing.T) {
+	limiter := useClientLimits(t, 0, 0, 2)
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		decision := limiter.check("ip:a", false, now)
+		if !decision.allowed || decision.quotaRemaining != 1 - i {
+			t.Fatalf("Expected request %d to be allowed, got %+v", i, decision)
+		}
+	}
+
+	decision := limiter.check("ip:a", false, now)
+	if decision.allowed || decision.reason != "Daily quota exceeded" || decision.retryAfter != untilMidnight(now) {
+		t.Fatalf("Expected quota to be exceeded, got %+v", decision)
+	}
+
+	// Quotas start again the next day
+	if !limiter.check("ip:a", false, now.Add(24 * time.Hour)).allowed {
+		t.Fatalf("Expected quota to reset the next day")
+	}
+}
+
+func TestClientLimiterPersistence(t *testing.T) {
+	useClientLimits(t, 0, 0, 5)
+	path := filepath.Join(t.TempDir(), "quota.json")
+
+	limiter, err := loadClientLimiter(path)
+	if err != nil {
+		t.Fatalf("Failed to load missing quota file: %v", err)
+	}
+	limiter.check("ip:a", false, time.Now())
+	limiter.check("ip:a", false, time.Now())
+
+	err = limiter.flush(time.Now())
+	if err != nil {
+		t.Fatalf("Failed to save quota usage: %v", err)
+	}
+
+	loaded, err := loadClientLimiter(path)
+	if err != nil || loaded.usage["ip:a"] != 2 {
+		t.Fatalf("Expected usage to be loaded, got %v %v", loaded, err)
+	}
+
+	// Usage from another day is thrown away
+	data, _ := json.Marshal(quotaFile{ "2000-01-01", map[string]int{ "ip:a": 5 } })
+	os.WriteFile(path, data, 0644)
+
+	loaded, err = loadClientLimiter(path)
+	if err != nil || len(loaded.usage) != 0 {
+		t.Fatalf("Expected old usage to be discarded, got %v %v", loaded, err)
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Redaction of personal details. Policies say how each user field is shown:
+// in full, masked down to its first letter, as a keyed hash that can still be
+// matched up between responses, or left out. They're chosen per client, by API
+// key id or token subject, or per scope, with a default for everyone else,
+// and applied to users as responses are put together.
+//
+// Logs are redacted regardless of policy, see redactLogs.
+
+const redactFull = "full"
+const redactMasked = "masked"
+const redactHashed = "hashed"
+const redactOmitted = "omitted"
+
+var redactModes = map[string]bool{
+	redactFull: true,
+	redactMasked: true,
+	redactHashed: true,
+	redactOmitted: true,
+}
+
+// How each field is shown. Fields left empty fall back to the default policy,
+// and then to full.
+type RedactionFields struct {
+	Name string `json:"name,omitempty"`
+	Username string `json:"username,omitempty"`
+	Email string `json:"email,omitempty"`
+}
+
+// Fields applied to requests from client, or made with scope. The first
+// matching rule wins.
+type RedactionRule struct {
+	Client string `json:"client,omitempty"`
+	Scope string `json:"scope,omitempty"`
+	Fields RedactionFields `json:"fields"`
+}
+
+type redactionFile struct {
+	// Secret for hashed fields. If not given, a random one is used, and
+	// hashes change between restarts.
+	HashKey string `json:"hashKey"`
+	Default RedactionFields `json:"default"`
+	Rules []RedactionRule `json:"rules"`
+}
+
+type redactionConfig struct {
+	hashKey []byte
+	fallback RedactionFields
+	rules []RedactionRule
+}
+
+// Policies in use. nil means everything is shown in full.
+var redaction *redactionConfig
+
+// User fields left out of responses altogether, rather than sent empty
+type omittedFields struct {
+	name bool
+	username bool
+	email bool
+}
+
+// A resolved policy, with every field set
+type redactionPolicy struct {
+	fields RedactionFields
+	hashKey []byte
+}
+
+func checkRedactionFields(fields RedactionFields) error {
+	for _, mode := range []string{ fields.Name, fields.Username, fields.Email } {
+		if mode != "" && !redactModes[mode] {
+			return fmt.Errorf("Unknown redaction %s", mode)
+		}
+	}
+	return nil
+}
+
+func loadRedaction(path string) (*redactionConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file := redactionFile{}
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid redaction file %s: %v", path, err)
+	}
+
+	err = checkRedactionFields(file.Default)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid redaction file %s: %v", path, err)
+	}
+	for _, rule := range file.Rules {
+		if (rule.Client == "") == (rule.Scope == "") {
+			return nil, fmt.Errorf("Invalid redaction file %s: rules need one of client or scope", path)
+		}
+		if rule.Scope != "" && !knownScopes[rule.Scope] {
+			return nil, fmt.Errorf("Invalid redaction file %s: unknown scope %s", path, rule.Scope)
+		}
+		err = checkRedactionFields(rule.Fields)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid redaction file %s: %v", path, err)
+		}
+	}
+
+	config := &redactionConfig{ []byte(file.HashKey), file.Default, file.Rules }
+	if len(config.hashKey) == 0 {
+		config.hashKey = make([]byte, 32)
+		rand.Read(config.hashKey)
+	}
+	return config, nil
+}
+
+func orDefault(mode string, fallback string) string {
+	if mode != "" {
+		return mode
+	}
+	return fallback
+}
+
+// Pick the policy for a client. A nil principal gets the default, which is
+// what's used for anything not made on behalf of a client, like webhooks.
+func (rc *redactionConfig) resolve(p *principal) redactionPolicy {
+	full := RedactionFields{ redactFull, redactFull, redactFull }
+	if rc == nil {
+		return redactionPolicy{ fields: full }
+	}
+
+	fields := RedactionFields{
+		orDefault(rc.fallback.Name, redactFull),
+		orDefault(rc.fallback.Username, redactFull),
+		orDefault(rc.fallback.Email, redactFull),
+	}
+
+	if p != nil && !p.invalid {
+		for _, rule := range rc.rules {
+			clientMatch := rule.Client != "" && (rule.Client == p.keyId || rule.Client == p.subject)
+			scopeMatch := rule.Scope != "" && p.scopes[rule.Scope]
+			if clientMatch || scopeMatch {
+				fields.Name = orDefault(rule.Fields.Name, fields.Name)
+				fields.Username = orDefault(rule.Fields.Username, fields.Username)
+				fields.Email = orDefault(rule.Fields.Email, fields.Email)
+				break
+			}
+		}
+	}
+
+	return redactionPolicy{ fields, rc.hashKey }
+}
+
+// Policy for whoever the request in ctx was made by
+func redactionFor(ctx context.Context) redactionPolicy {
+	p, _ := ctx.Value(principalKey{}).(*principal)
+	return redaction.resolve(p)
+}
+
+// First letter of each word, with the rest starred out. The stars are a fixed
+// length, so the length of the value isn't given away.
+func maskWords(value string) string {
+	words := strings.Fields(value)
+	for i, word := range words {
+		first, _ := utf8.DecodeRuneInString(word)
+		words[i] = string(first) + "*****"
+	}
+	return strings.Join(words, " ")
+}
+
+func maskEmail(value string) string {
+	local, domain, ok := strings.Cut(value, "@")
+	if !ok {
+		return maskWords(value)
+	}
+	return maskWords(local) + "@" + domain
+}
+
+func (policy redactionPolicy) redact(mode string, value string, mask func(string) string) string {
+	switch mode {
+	case redactMasked:
+		return mask(value)
+	case redactHashed:
+		mac := hmac.New(sha256.New, policy.hashKey)
+		mac.Write([]byte(value))
+		return "hmac:" + hex.EncodeToString(mac.Sum(nil))[:16]
+	case redactOmitted:
+		return ""
+	}
+	return value
+}
+
+func (policy redactionPolicy) user(user User) User {
+	return User{
+		Name: policy.redact(policy.fields.Name, user.Name, maskWords),
+		Username: policy.redact(policy.fields.Username, user.Username, maskWords),
+		Email: policy.redact(policy.fields.Email, user.Email, maskEmail),
+		omitted: omittedFields{
+			name: policy.fields.Name == redactOmitted,
+			username: policy.fields.Username == redactOmitted,
+			email: policy.fields.Email == redactOmitted,
+		},
+	}
+}
+
+// A copy of userPosts with the user redacted
+func (policy redactionPolicy) userPosts(userPosts *UserPosts) *UserPosts {
+	redacted := *userPosts
+	redacted.UserInfo = policy.user(userPosts.UserInfo)
+	return &redacted
+}
+
+// Commenters get the same treatment as users
+func (policy redactionPolicy) comment(comment *Comment) *Comment {
+	redacted := *comment
+	redacted.Name = policy.redact(policy.fields.Name, comment.Name, maskWords)
+	redacted.Email = policy.redact(policy.fields.Email, comment.Email, maskEmail)
+	return &redacted
+}
+
+// A user's fields in order, less any that were omitted. Everything else,
+// empty or not, is encoded as it always has been.
+func (user User) fields() orderedObject {
+	fields := orderedObject{}
+	if !user.omitted.name {
+		fields = append(fields, orderedField{ "name", user.Name })
+	}
+	if !user.omitted.username {
+		fields = append(fields, orderedField{ "username", user.Username })
+	}
+	if !user.omitted.email {
+		fields = append(fields, orderedField{ "email", user.Email })
+	}
+	return fields
+}
+
+func (user User) MarshalJSON() ([]byte, error) {
+	return user.fields().MarshalJSON()
+}
+
+func (user User) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	err := e.EncodeToken(start)
+	if err != nil {
+		return err
+	}
+
+	for _, field := range user.fields() {
+		err = e.EncodeElement(field.val, xml.StartElement{ Name: xml.Name{ Local: field.key } })
+		if err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+// Users printed with fmt, as in log lines, are always masked
+func (user User) String() string {
+	return fmt.Sprintf("{%s %s %s}", maskWords(user.Name), maskWords(user.Username), maskEmail(user.Email))
+}
+
+func (user User) GoString() string {
+	return "User" + user.String()
+}
+
+var emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+
+// Addresses as they appear in URLs, such as the query strings in access logs,
+// with the @ percent encoded
+var encodedEmailPattern = regexp.MustCompile(`[A-Za-z0-9._%+\-]+%40[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+
+type redactingWriter struct {
+	out io.Writer
+}
+
+// Mask anything that looks like an email address on its way to out, encoded
+// or not. This is the backstop for log output, catching addresses that make
+// it into errors or request URIs.
+func redactLogs(out io.Writer) io.Writer {
+	return redactingWriter{ out }
+}
+
+func (rw redactingWriter) Write(data []byte) (int, error) {
+	redacted := emailPattern.ReplaceAllFunc(data, func(match []byte) []byte {
+		return []byte(maskEmail(string(match)))
+	})
+	redacted = encodedEmailPattern.ReplaceAllFunc(redacted, func(match []byte) []byte {
+		local, domain, _ := strings.Cut(string(match), "%40")
+		return []byte(maskWords(local) + "%40" + domain)
+	})
+
+	_, err := rw.out.Write(redacted)
+	if err != nil {
+		return 0, err
+	}
+	// Report the length given, as callers don't expect it to change
+	return len(data), nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"testing"
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var leanne = User{ Name: "Leanne Graham", Username: "Bret", Email: "Sincere@april.biz" }
+
+// Load policies for the rest of the test
+func useRedaction(t *testing.T, file redactionFile) {
+	path := filepath.Join(t.TempDir(), "redaction.json")
+	data, _ := json.Marshal(file)
+	os.WriteFile(path, data, 0644)
+
+	config, err := loadRedaction(path)
+	if err != nil {
+		t.Fatalf("Failed to load redaction: %v", err)
+	}
+
+	prev := redaction
+	redaction = config
+	t.Cleanup(func() { redaction = prev })
+}
+
+func TestRedactionModes(t *testing.T) {
+	policy := redactionPolicy{
+		fields: RedactionFields{ redactMasked, redactOmitted, redactMasked },
+		hashKey: []byte("key"),
+	}
+
+	user := policy.user(leanne)
+	expected := User{ Name: "L***** G*****", Email: "S*****@april.biz", omitted: omittedFields{ username: true } }
+	if user != expected {
+		t.Fatalf("Expected %#v, got %#v", expected, user)
+	}
+
+	// Omitted fields are left out of responses
+	data, _ := json.Marshal(user)
+	if string(data) != `{"name":"L***** G*****","email":"S*****@april.biz"}` {
+		t.Fatalf("Expected username to be omitted, got %s", data)
+	}
+	data, _ = xml.Marshal(user)
+	if string(data) != `<User><name>L***** G*****</name><email>S*****@april.biz</email></User>` {
+		t.Fatalf("Expected username to be omitted from xml, got %s", data)
+	}
+
+	// Empty fields that weren't omitted are still sent, as they always were
+	data, _ = json.Marshal(User{ Name: "Leanne Graham" })
+	if string(data) != `{"name":"Leanne Graham","username":"","email":""}` {
+		t.Fatalf("Expected empty fields to be kept, got %s", data)
+	}
+
+	policy.fields.Email = redactHashed
+	first := policy.user(leanne).Email
+	if !strings.HasPrefix(first, "hmac:") || first != policy.user(leanne).Email {
+		t.Fatalf("Expected a stable hash, got %s", first)
+	}
+
+	other := redactionPolicy{ fields: policy.fields, hashKey: []byte("other") }
+	if other.user(leanne).Email == first {
+		t.Fatalf("Expected hashes to depend on the key")
+	}
+}
+
+func TestRedactionResolve(t *testing.T) {
+	useRedaction(t, redactionFile{
+		Default: RedactionFields{ Email: redactMasked },
+		Rules: []RedactionRule{
+			{ Client: "support", Fields: RedactionFields{ Email: redactFull } },
+			{ Scope: scopeAdmin, Fields: RedactionFields{ Email: redactHashed, Name: redactMasked } },
+		},
+	})
+
+	tests := []struct {
+		name string
+		principal *principal
+		expected RedactionFields
+	}{
+		{ "anonymous", nil, RedactionFields{ redactFull, redactFull, redactMasked } },
+		{ "client", &principal{ keyId: "support" }, RedactionFields{ redactFull, redactFull, redactFull } },
+		{ "subject", &principal{ subject: "support" }, RedactionFields{ redactFull, redactFull, redactFull } },
+		{ "scope", &principal{ keyId: "ops", scopes: map[string]bool{ scopeAdmin: true } }, RedactionFields{ redactMasked, redactFull, redactHashed } },
+		{ "invalid", &principal{ keyId: "support", invalid: true }, RedactionFields{ redactFull, redactFull, redactMasked } },
+	}
+
+	for _, test := range tests {
+		policy := redaction.resolve(test.principal)
+		if policy.fields != test.expected {
+			t.Fatalf("%s: expected %+v, got %+v", test.name, test.expected, policy.fields)
+		}
+	}
+
+	// Requests pick up the policy of whoever made them
+	ctx := context.WithValue(context.TODO(), principalKey{}, &principal{ keyId: "support" })
+	if redactionFor(ctx).user(leanne).Email != leanne.Email {
+		t.Fatalf("Expected the client's policy to apply")
+	}
+}
+
+func TestRedactionDisabled(t *testing.T) {
+	if redactionFor(context.TODO()).user(leanne) != leanne {
+		t.Fatalf("Expected users in full without policies")
+	}
+}
+
+func TestLoadRedactionInvalid(t *testing.T) {
+	files := map[string]string{
+		"unknown mode": `{"default": {"email": "scrambled"}}`,
+		"no match": `{"rules": [{"fields": {"email": "full"}}]}`,
+		"unknown scope": `{"rules": [{"scope": "everything", "fields": {"email": "full"}}]}`,
+	}
+
+	for name, contents := range files {
+		path := filepath.Join(t.TempDir(), "redaction.json")
+		os.WriteFile(path, []byte(contents), 0644)
+
+		_, err := loadRedaction(path)
+		if err == nil {
+			t.Fatalf("%s: expected redaction file to be rejected", name)
+		}
+	}
+}
+
+func TestRedactLogs(t *testing.T) {
+	var out bytes.Buffer
+	logger := log.New(redactLogs(&out), "", 0)
+
+	logger.Printf("Failed to notify Sincere@april.biz about %v", UserPosts{ Id: 1, UserInfo: leanne })
+
+	line := out.String()
+	for _, value := range []string{ leanne.Name, leanne.Username, leanne.Email } {
+		if strings.Contains(line, value) {
+			t.Fatalf("Expected %s to be redacted, got %s", value, line)
+		}
+	}
+	if !strings.Contains(line, "S*****@april.biz") {
+		t.Fatalf("Expected masked email, got %s", line)
+	}
+
+	// Addresses in request URIs are percent encoded
+	out.Reset()
+	logger.Printf("GET /v1/search/posts?q=Sincere%%40april.biz 200")
+	if out.String() != "GET /v1/search/posts?q=S*****%40april.biz 200\n" {
+		t.Fatalf("Expected encoded email to be masked, got %s", out.String())
+	}
+
+	if fmt.Sprintf("%#v", leanne) != "User{L***** G***** B***** S*****@april.biz}" {
+		t.Fatalf("Got unexpected Go syntax: %#v", leanne)
+	}
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Full-text search over every upstream post. The upstream has no search of its
+// own, so all posts and users are pulled down and kept in an in-memory
+// inverted index, which is rebuilt periodically to pick up changes.
+
+// How often the background refresh rebuilds the index
+var searchRefreshInterval = 5 * time.Minute
+
+// Default and maximum number of hits returned by a search
+const defaultSearchLimit = 20
+const maxSearchLimit = 100
+
+// A post along with its author, as stored in the index
+type SearchDoc struct {
+	UserId int
+	Post Post
+}
+
+// A single search result. The author's user info is attached so callers don't
+// need a second request to find out who wrote the post.
+type SearchHit struct {
+	Post Post `json:"post"`
+	UserId int `json:"userId"`
+	User User `json:"user"`
+	Score int `json:"score"`
+}
+
+type SearchResults struct {
+	Query string `json:"query"`
+	TotalHits int `json:"totalHits"`
+	Hits []SearchHit `json:"hits"`
+}
+
+// Inverted index from term to the documents containing it, and the positions
+// at which it appears. Positions are needed to answer phrase queries.
+type SearchIndex struct {
+	mu sync.RWMutex
+	built bool
+	// The first build, while it's running
+	building *searchBuild
+	// Context builds run on, so they outlive any one request
+	ctx context.Context
+	docs []SearchDoc
+	users map[int]User
+	terms map[string]map[int][]int
+}
+
+type searchBuild struct {
+	done chan struct{}
+	err error
+}
+
+var searchIndex = &SearchIndex{}
+
+// Split text into lowercased runs of letters and digits
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// Replace the contents of the index with the given users and posts
+func (index *SearchIndex) load(users map[int]User, docs []SearchDoc) {
+	terms := map[string]map[int][]int{}
+	for i, doc := range docs {
+		// Leave a gap between the title and body so that phrases can't
+		// match across the two
+		tokens := tokenize(doc.Post.Title)
+		tokens = append(tokens, "")
+		tokens = append(tokens, tokenize(doc.Post.Body)...)
+
+		for pos, token := range tokens {
+			if token == "" {
+				continue
+			}
+			if terms[token] == nil {
+				terms[token] = map[int][]int{}
+			}
+			terms[token][i] = append(terms[token][i], pos)
+		}
+	}
+
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	index.built = true
+	index.docs = docs
+	index.users = users
+	index.terms = terms
+}
+
+// Parse a query string into single terms and quoted phrases. An unterminated
+// quote runs to the end of the query.
+func parseSearchQuery(q string) ([]string, [][]string) {
+	var terms []string
+	var phrases [][]string
+
+	parts := strings.Split(q, "\"")
+	for i, part := range parts {
+		// Odd parts were between quotes
+		if i % 2 == 1 {
+			phrase := tokenize(part)
+			switch len(phrase) {
+			case 0:
+			case 1:
+				terms = append(terms, phrase[0])
+			default:
+				phrases = append(phrases, phrase)
+			}
+			continue
+		}
+
+		terms = append(terms, tokenize(part)...)
+	}
+
+	return terms, phrases
+}
+
+// Count the occurrences of a phrase in a document, given the positions of its
+// first term
+func (index *SearchIndex) phraseCount(doc int, phrase []string) int {
+	count := 0
+	for _, start := range index.terms[phrase[0]][doc] {
+		found := true
+		for offset, term := range phrase[1:] {
+			if !containsInt(index.terms[term][doc], start+offset+1) {
+				found = false
+				break
+			}
+		}
+		if found {
+			count++
+		}
+	}
+
+	return count
+}
+
+func containsInt(list []int, val int) bool {
+	for _, item := range list {
+		if item == val {
+			return true
+		}
+	}
+	return false
+}
+
+// Find the documents matching every term and phrase in the query, ranked by
+// the total frequency of the terms and phrases in each document
+func (index *SearchIndex) search(q string) []SearchHit {
+	terms, phrases := parseSearchQuery(q)
+	if len(terms) == 0 && len(phrases) == 0 {
+		return []SearchHit{}
+	}
+
+	index.mu.RLock()
+	defer index.mu.RUnlock()
+
+	// Candidates are the documents containing the first term of the query,
+	// which every match must contain
+	first := ""
+	if len(terms) > 0 {
+		first = terms[0]
+	} else {
+		first = phrases[0][0]
+	}
+
+	hits := []SearchHit{}
+	for doc := range index.terms[first] {
+		score := 0
+		matched := true
+
+		for _, term := range terms {
+			count := len(index.terms[term][doc])
+			if count == 0 {
+				matched = false
+				break
+			}
+			score += count
+		}
+
+		for _, phrase := range phrases {
+			if !matched {
+				break
+			}
+			count := index.phraseCount(doc, phrase)
+			if count == 0 {
+				matched = false
+				break
+			}
+			score += count
+		}
+
+		if !matched {
+			continue
+		}
+
+		hits = append(hits, SearchHit{
+			Post: index.docs[doc].Post,
+			UserId: index.docs[doc].UserId,
+			User: index.users[index.docs[doc].UserId],
+			Score: score,
+		})
+	}
+
+	// Ties are broken by post id so results are stable between requests
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].Post.Id < hits[j].Post.Id
+	})
+
+	return hits
+}
+
+// Fetch every user and post from upstream and load them into the index
+func (index *SearchIndex) refresh(ctx context.Context) error {
+	usersRes, status, err := fetchJson(ctx, "/users")
+	if err != nil {
+		return err
+	}
+	if errorStatus(status) {
+		return fmt.Errorf("Got status %d fetching users", status)
+	}
+
+	postsRes, status, err := fetchJson(ctx, "/posts")
+	if err != nil {
+		return err
+	}
+	if errorStatus(status) {
+		return fmt.Errorf("Got status %d fetching posts", status)
+	}
+
+	users, err := parseUsers(usersRes)
+	if err != nil {
+		return err
+	}
+
+	docs, err := parseSearchDocs(postsRes)
+	if err != nil {
+		return err
+	}
+
+	index.load(users, docs)
+	return nil
+}
+
+// Set the context builds run on, for as long as the server is up
+func (index *SearchIndex) setContext(ctx context.Context) {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	index.ctx = ctx
+}
+
+// Build the index if it hasn't been yet, waiting for it to finish or for ctx
+// to be cancelled. Concurrent callers share a single build, which keeps going
+// if they give up, so a crawl of the upstream is never thrown away half done.
+func (index *SearchIndex) ensureBuilt(ctx context.Context) error {
+	index.mu.Lock()
+	if index.built {
+		index.mu.Unlock()
+		return nil
+	}
+
+	build := index.building
+	if build == nil {
+		build = &searchBuild{ done: make(chan struct{}) }
+		index.building = build
+
+		buildCtx := index.ctx
+		if buildCtx == nil {
+			buildCtx = context.Background()
+		}
+		go func() {
+			build.err = index.refresh(buildCtx)
+
+			// A failed build leaves the next search to try again
+			index.mu.Lock()
+			index.building = nil
+			index.mu.Unlock()
+			close(build.done)
+		}()
+	}
+	index.mu.Unlock()
+
+	select {
+	case <-build.done:
+		return build.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Unpack a list of users, keyed by their id
+func parseUsers(res interface{}) (map[int]User, error) {
+	data, ok := res.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("non-list json")
+	}
+
+	users := map[int]User{}
+	for _, userIface := range data {
+		user, err := parseUser(userIface)
+		if err != nil {
+			return nil, err
+		}
+
+		id, err := indexInt(userIface.(map[string]interface{}), "id")
+		if err != nil {
+			return nil, err
+		}
+
+		users[id] = user
+	}
+
+	return users, nil
+}
+
+// Unpack a list of posts, keeping the userId that parsePost discards
+func parseSearchDocs(res interface{}) ([]SearchDoc, error) {
+	data, ok := res.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("non-list json")
+	}
+
+	docs := make([]SearchDoc, len(data))
+	for i, postIface := range data {
+		post, err := parsePost(postIface)
+		if err != nil {
+			return nil, err
+		}
+
+		userId, err := indexInt(postIface.(map[string]interface{}), "userId")
+		if err != nil {
+			return nil, err
+		}
+
+		docs[i] = SearchDoc{ UserId: userId, Post: post }
+	}
+
+	return docs, nil
+}
+
+// Rebuild the index every searchRefreshInterval until the context is
+// cancelled. Failed refreshes are logged, and the previous index is kept.
+func runSearchRefresh(ctx context.Context, index *SearchIndex) {
+	ticker := time.NewTicker(searchRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := index.refresh(ctx)
+			if err != nil && ctx.Err() == nil {
+				log.Printf("Failed to refresh search index: %v", err)
+			}
+		}
+	}
+}
+
+func handleSearchPosts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, 404, "Not found")
+		return
+	}
+
+	q := r.URL.Query().Get("q")
+	if strings.TrimSpace(q) == "" {
+		writeError(w, 400, "Missing query")
+		return
+	}
+
+	limit := defaultSearchLimit
+	if str := r.URL.Query().Get("limit"); str != "" {
+		var err error
+		limit, err = strconv.Atoi(str)
+		if err != nil || limit < 1 || limit > maxSearchLimit {
+			writeError(w, 400, fmt.Sprintf(
+				"limit must be an integer between 1 and %d",
+				maxSearchLimit,
+			))
+			return
+		}
+	}
+
+	// The first search after startup builds the index, rather than making
+	// every server start wait on the upstream
+	err := searchIndex.ensureBuilt(r.Context())
+	if err != nil {
+		if r.Context().Err() == nil {
+			log.Printf("Failed to build search index: %v", err)
+			writeError(w, 500, "Something went wrong")
+		}
+		return
+	}
+
+	hits := searchIndex.search(q)
+	policy := redactionFor(r.Context())
+	for i := range hits {
+		hits[i].User = policy.user(hits[i].User)
+	}
+	results := SearchResults{ Query: q, TotalHits: len(hits), Hits: hits }
+	if len(hits) > limit {
+		results.Hits = hits[:limit]
+	}
+
+	writeJson(w, 200, results)
+}
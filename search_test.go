@@ -0,0 +1,149 @@
+package main
+
+import (
+	"testing"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"time"
+)
+
+func testSearchIndex() *SearchIndex {
+	index := &SearchIndex{}
+	index.load(
+		map[int]User{ 1: *expUser, 2: { Name: "Ervin Howell" } },
+		[]SearchDoc{
+			{ UserId: 1, Post: Post{ Id: 1, Title: "Quick brown fox", Body: "jumps over the lazy dog" } },
+			{ UserId: 2, Post: Post{ Id: 2, Title: "Lazy days", Body: "the dog is lazy, the fox is quick" } },
+			{ UserId: 2, Post: Post{ Id: 3, Title: "Brown", Body: "fox" } },
+		},
+	)
+	return index
+}
+
+func TestTokenize(t *testing.T) {
+	exp := []string{"hello", "world", "it", "s", "2021"}
+	res := tokenize("Hello, World! It's 2021")
+	if !reflect.DeepEqual(exp, res) {
+		t.Fatalf("\nExpected:\n%v\nGot:\n%v\n", exp, res)
+	}
+}
+
+func TestParseSearchQuery(t *testing.T) {
+	terms, phrases := parseSearchQuery(`Lazy "brown fox" "dog"`)
+
+	if !reflect.DeepEqual([]string{"lazy", "dog"}, terms) {
+		t.Fatalf("Got unexpected terms: %v", terms)
+	}
+
+	if !reflect.DeepEqual([][]string{{"brown", "fox"}}, phrases) {
+		t.Fatalf("Got unexpected phrases: %v", phrases)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	index := testSearchIndex()
+
+	// Ranked by term frequency: post 2 mentions "lazy" in both the title
+	// and body
+	hits := index.search("LAZY")
+	if len(hits) != 2 || hits[0].Post.Id != 2 || hits[1].Post.Id != 1 {
+		t.Fatalf("Got unexpected hits: %v", hits)
+	}
+
+	if hits[0].Score != 2 || hits[0].User.Name != "Ervin Howell" {
+		t.Fatalf("Got unexpected hit: %v", hits[0])
+	}
+
+	// All terms must match
+	hits = index.search("lazy brown")
+	if len(hits) != 1 || hits[0].Post.Id != 1 {
+		t.Fatalf("Got unexpected hits: %v", hits)
+	}
+
+	// Phrases must appear in order, and not across the title and body
+	hits = index.search(`"brown fox"`)
+	if len(hits) != 1 || hits[0].Post.Id != 1 {
+		t.Fatalf("Got unexpected hits: %v", hits)
+	}
+
+	hits = index.search(`"fox brown"`)
+	if len(hits) != 0 {
+		t.Fatalf("Got unexpected hits: %v", hits)
+	}
+
+	hits = index.search("")
+	if len(hits) != 0 {
+		t.Fatalf("Got unexpected hits: %v", hits)
+	}
+}
+
+func TestParseSearchDocs(t *testing.T) {
+	docs, err := parseSearchDocs(expPostsJson())
+	if err != nil {
+		t.Fatalf("Unexpected error parsing posts: %v", err)
+	}
+
+	if len(docs) != len(expPosts) || docs[0].UserId != 1 {
+		t.Fatalf("Got unexpected docs: %v", docs)
+	}
+
+	if !reflect.DeepEqual(expPosts[0], docs[0].Post) {
+		t.Fatalf("\nExpected:\n%v\nGot:\n%v\n", expPosts[0], docs[0].Post)
+	}
+}
+
+func TestSearchIndexSharedBuild(t *testing.T) {
+	var crawls atomic.Int32
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/users" {
+			crawls.Add(1)
+			<-release
+			fmt.Fprintf(w, "[%s]", expUserStr)
+			return
+		}
+		fmt.Fprint(w, expPostsStr)
+	}))
+	defer upstream.Close()
+
+	prevBaseUrl := baseUrl
+	baseUrl = upstream.URL
+	defer func() { baseUrl = prevBaseUrl }()
+
+	index := &SearchIndex{}
+
+	// A caller giving up doesn't stop the build for everyone else
+	ctx, cancel := context.WithCancel(context.Background())
+	abandoned := make(chan error)
+	go func() { abandoned <- index.ensureBuilt(ctx) }()
+
+	errs := make(chan error)
+	for i := 0; i < 5; i++ {
+		go func() { errs <- index.ensureBuilt(context.Background()) }()
+	}
+
+	for crawls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-abandoned; err != context.Canceled {
+		t.Fatalf("Expected cancelled caller to stop waiting, got %v", err)
+	}
+	close(release)
+
+	for i := 0; i < 5; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("Unexpected error building index: %v", err)
+		}
+	}
+	if crawls.Load() != 1 {
+		t.Fatalf("Expected one crawl of the upstream, got %d", crawls.Load())
+	}
+	if len(index.search("facere")) == 0 {
+		t.Fatalf("Expected the built index to be searchable")
+	}
+}
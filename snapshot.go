@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Offline mirror of the upstream. The mirror command saves the upstream's
+// users, posts and comments into a snapshot directory, as the raw json it
+// returned. Serving from a snapshot loads those files into a read only memory
+// backend, which answers the same paths the upstream does, so everything
+// parses, validates and reports missing records exactly as it would online.
+
+// Collections saved in a snapshot, each as {name}.json
+var snapshotCollections = []string{ "users", "posts", "comments" }
+
+// Written alongside the collections, recording where they came from
+type SnapshotManifest struct {
+	Source string `json:"source"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Load a directory of collections into a memory backend
+func loadFixtures(dir string) (*memoryBackend, error) {
+	collections := map[string][]interface{}{}
+
+	for _, name := range snapshotCollections {
+		data, err := os.ReadFile(filepath.Join(dir, name + ".json"))
+		if err != nil {
+			return nil, err
+		}
+
+		var collection []interface{}
+		err = json.Unmarshal(data, &collection)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid snapshot file %s.json: %v", name, err)
+		}
+		collections[name] = collection
+	}
+
+	return newMemoryBackend(collections), nil
+}
+
+// Write a file by renaming a temporary one into place, so readers never see
+// it half written
+func writeFileAtomic(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	err := os.WriteFile(tmpPath, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// Download every collection from the upstream into dir. Collections are
+// fetched in parallel, and nothing is written unless all of them succeed.
+func writeSnapshot(ctx context.Context, dir string) error {
+	results := make([][]byte, len(snapshotCollections))
+	errs := make([]error, len(snapshotCollections))
+
+	wg := &sync.WaitGroup{}
+	for i, name := range snapshotCollections {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			res, status, err := fetchJson(ctx, "/" + name)
+			if err == nil && errorStatus(status) {
+				err = fmt.Errorf("Got status %d fetching %s", status, name)
+			}
+			if err == nil {
+				if _, ok := res.([]interface{}); !ok {
+					err = fmt.Errorf("Got non-list json fetching %s", name)
+				}
+			}
+			if err == nil {
+				results[i], err = json.MarshalIndent(res, "", "  ")
+			}
+			errs[i] = err
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	for i, name := range snapshotCollections {
+		err = writeFileAtomic(filepath.Join(dir, name + ".json"), results[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	manifest, err := json.MarshalIndent(SnapshotManifest{
+		Source: baseUrl,
+		CreatedAt: time.Now().UTC(),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, "manifest.json"), manifest)
+}
+
+// The mirror command saves a snapshot for serving offline later
+func runMirrorCommand(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("mirror", flag.ExitOnError)
+	dir := flags.String("dir", "snapshot", "Directory to write the snapshot to")
+	upstreamTls := flags.String("upstream-tls", "", "File of CA, client certificate, server name and proxy settings per upstream url")
+	flags.Parse(args)
+
+	err := useUpstreamTls(*upstreamTls)
+	if err != nil {
+		return err
+	}
+
+	err = writeSnapshot(context.Background(), *dir)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "Wrote snapshot of %s to %s\n", baseUrl, *dir)
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+	"context"
+	"path/filepath"
+	"reflect"
+)
+
+// Mirror the fake upstream into a temp dir and serve from it, with baseUrl
+// pointing nowhere so nothing can be fetched over http
+func useTempSnapshot(t *testing.T) {
+	startFakeUpstream(t)
+
+	dir := filepath.Join(t.TempDir(), "snapshot")
+	err := writeSnapshot(context.TODO(), dir)
+	if err != nil {
+		t.Fatalf("Unexpected error writing snapshot: %v", err)
+	}
+
+	prevBaseUrl := baseUrl
+	baseUrl = "http://offline.invalid"
+
+	prevBackend := backend
+	err = useSource("snapshot:" + dir)
+	if err != nil {
+		t.Fatalf("Unexpected error loading snapshot: %v", err)
+	}
+
+	t.Cleanup(func() {
+		baseUrl = prevBaseUrl
+		backend = prevBackend
+	})
+}
+
+func TestSnapshotGetUserPosts(t *testing.T) {
+	useTempSnapshot(t)
+
+	userPosts, status, err := getUserPosts(1)
+	if err != nil || status != 200 {
+		t.Fatalf("Unexpected error getting user posts: %d %v", status, err)
+	}
+
+	exp := UserPosts{ Id: 1, UserInfo: *expUser, Posts: expPosts }
+	if !reflect.DeepEqual(exp, *userPosts) {
+		t.Fatalf("Expected %v, got %v", exp, *userPosts)
+	}
+
+	// Missing users are reported as they would be by the upstream
+	_, status, err = getUserPosts(2)
+	if err != nil || status != 404 {
+		t.Fatalf("Expected 404 for missing user, got %d %v", status, err)
+	}
+}
+
+func TestSnapshotFetchJson(t *testing.T) {
+	useTempSnapshot(t)
+
+	tests := []struct {
+		path string
+		status int
+		count int
+	}{
+		{ "/users", 200, 1 },
+		{ "/posts?userId=1", 200, 10 },
+		{ "/posts?userId=2", 200, 0 },
+		{ "/posts/1/comments", 200, 2 },
+		{ "/posts/1000/comments", 404, 0 },
+		{ "/users/2", 404, 0 },
+		{ "/todos", 404, 0 },
+	}
+
+	for _, test := range tests {
+		res, status, err := fetchJson(context.TODO(), test.path)
+		if err != nil || status != test.status {
+			t.Fatalf("%s: expected %d, got %d %v", test.path, test.status, status, err)
+		}
+
+		if list, ok := res.([]interface{}); ok && len(list) != test.count {
+			t.Fatalf("%s: expected %d records, got %d", test.path, test.count, len(list))
+		}
+	}
+
+	// Snapshots are read only
+	_, _, err := sendJson(context.TODO(), "DELETE", "/posts/1", nil)
+	if err == nil {
+		t.Fatalf("Expected error writing to a snapshot")
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTPS serving. The certificate and key are read from files, and read again
+// whenever either file changes, so certificates can be rotated without a
+// restart. Given a CA bundle, clients can also be asked for certificates
+// signed by it, and whoever they identify is made available to handlers.
+//
+// Without a certificate the server stays on plain http.
+
+// How often the certificate files are checked for changes
+var tlsReloadInterval = 10 * time.Second
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Whether clients must present a certificate
+const tlsClientAuthNone = "none"
+const tlsClientAuthRequest = "request"
+const tlsClientAuthRequire = "require"
+
+type TlsOptions struct {
+	CertFile string
+	KeyFile string
+	// CA bundle client certificates are checked against. Empty turns off
+	// client certificates.
+	ClientCaFile string
+	// One of none, request or require. Defaults to require when there's a
+	// client CA.
+	ClientAuth string
+	MinVersion string
+	// Names as given by tls.CipherSuites. Empty leaves Go's defaults. These
+	// only apply up to TLS 1.2, as TLS 1.3 suites aren't configurable.
+	CipherSuites []string
+}
+
+// Files as last read, and what was read from them
+type tlsFiles struct {
+	cert *tls.Certificate
+	clientCas *x509.CertPool
+	modTimes []time.Time
+}
+
+type tlsReloader struct {
+	options TlsOptions
+	base *tls.Config
+
+	mu sync.RWMutex
+	files tlsFiles
+}
+
+// TLS for the http server. nil means plain http.
+var serverTls *tlsReloader
+
+func parseTlsVersion(version string) (uint16, error) {
+	value, ok := tlsVersions[version]
+	if !ok {
+		return 0, fmt.Errorf("Unknown TLS version %s, expected one of 1.0, 1.1, 1.2 or 1.3", version)
+	}
+	return value, nil
+}
+
+// Look up suites by name. Only suites Go considers secure are allowed.
+func parseCipherSuites(names []string) ([]uint16, error) {
+	byName := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		byName[suite.Name] = suite.ID
+	}
+
+	ids := []uint16{}
+	for _, name := range names {
+		id, ok := byName[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("Unknown or insecure cipher suite %s", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (tr *tlsReloader) paths() []string {
+	paths := []string{ tr.options.CertFile, tr.options.KeyFile }
+	if tr.options.ClientCaFile != "" {
+		paths = append(paths, tr.options.ClientCaFile)
+	}
+	return paths
+}
+
+func (tr *tlsReloader) modTimes() ([]time.Time, error) {
+	times := []time.Time{}
+	for _, path := range tr.paths() {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		times = append(times, info.ModTime())
+	}
+	return times, nil
+}
+
+func (tr *tlsReloader) read() (tlsFiles, error) {
+	modTimes, err := tr.modTimes()
+	if err != nil {
+		return tlsFiles{}, err
+	}
+
+	cert, err := tls.LoadX509KeyPair(tr.options.CertFile, tr.options.KeyFile)
+	if err != nil {
+		return tlsFiles{}, err
+	}
+
+	files := tlsFiles{ cert: &cert, modTimes: modTimes }
+	if tr.options.ClientCaFile != "" {
+		data, err := os.ReadFile(tr.options.ClientCaFile)
+		if err != nil {
+			return tlsFiles{}, err
+		}
+
+		files.clientCas = x509.NewCertPool()
+		if !files.clientCas.AppendCertsFromPEM(data) {
+			return tlsFiles{}, fmt.Errorf("No certificates found in %s", tr.options.ClientCaFile)
+		}
+	}
+	return files, nil
+}
+
+func newTlsReloader(options TlsOptions) (*tlsReloader, error) {
+	if options.CertFile == "" || options.KeyFile == "" {
+		return nil, fmt.Errorf("Both a certificate and key are needed for TLS")
+	}
+
+	minVersion, err := parseTlsVersion(options.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	// Protocols are given here, rather than left to the http server, since
+	// each handshake gets a fresh config
+	base := &tls.Config{ MinVersion: minVersion, NextProtos: []string{ "h2", "http/1.1" } }
+	if len(options.CipherSuites) > 0 {
+		base.CipherSuites, err = parseCipherSuites(options.CipherSuites)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	clientAuth := options.ClientAuth
+	if clientAuth == "" && options.ClientCaFile != "" {
+		clientAuth = tlsClientAuthRequire
+	}
+
+	switch clientAuth {
+	case "", tlsClientAuthNone:
+		if options.ClientCaFile != "" {
+			return nil, fmt.Errorf("A client CA was given, but client certificates aren't asked for")
+		}
+		base.ClientAuth = tls.NoClientCert
+	case tlsClientAuthRequest:
+		base.ClientAuth = tls.VerifyClientCertIfGiven
+	case tlsClientAuthRequire:
+		base.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("Unknown client auth %s, expected none, request or require", options.ClientAuth)
+	}
+	if base.ClientAuth != tls.NoClientCert && options.ClientCaFile == "" {
+		return nil, fmt.Errorf("A client CA is needed to check client certificates")
+	}
+
+	tr := &tlsReloader{ options: options, base: base }
+	tr.files, err = tr.read()
+	if err != nil {
+		return nil, err
+	}
+	return tr, nil
+}
+
+// Read the files again if any have changed since last time. If they can't be
+// read, say mid-rotation, the previous certificate stays in use.
+func (tr *tlsReloader) reload() (bool, error) {
+	modTimes, err := tr.modTimes()
+	if err != nil {
+		return false, err
+	}
+
+	tr.mu.RLock()
+	changed := false
+	for i, modTime := range modTimes {
+		if !modTime.Equal(tr.files.modTimes[i]) {
+			changed = true
+		}
+	}
+	tr.mu.RUnlock()
+
+	if !changed {
+		return false, nil
+	}
+
+	files, err := tr.read()
+	if err != nil {
+		return false, err
+	}
+
+	tr.mu.Lock()
+	tr.files = files
+	tr.mu.Unlock()
+	return true, nil
+}
+
+func (tr *tlsReloader) run(ctx context.Context) {
+	ticker := time.NewTicker(tlsReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := tr.reload()
+			if err != nil {
+				log.Printf("Failed to reload TLS certificate: %v", err)
+			} else if reloaded {
+				log.Printf("Reloaded TLS certificate")
+			}
+		}
+	}
+}
+
+// Config for the server. Each handshake picks up whatever was read last.
+func (tr *tlsReloader) config() *tls.Config {
+	config := tr.base.Clone()
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		tr.mu.RLock()
+		defer tr.mu.RUnlock()
+
+		handshake := tr.base.Clone()
+		handshake.Certificates = []tls.Certificate{ *tr.files.cert }
+		handshake.ClientCAs = tr.files.clientCas
+		return handshake, nil
+	}
+	return config
+}
+
+// Who a verified client certificate belongs to
+type ClientIdentity struct {
+	CommonName string
+	DnsNames []string
+	// URI SANs, such as SPIFFE ids
+	Uris []string
+	// sha256 of the certificate
+	Fingerprint string
+}
+
+// Identity of the client certificate a request was made with, or nil if there
+// wasn't a verified one
+func requestClientIdentity(r *http.Request) *ClientIdentity {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+	fingerprint := sha256.Sum256(cert.Raw)
+	identity := &ClientIdentity{
+		CommonName: cert.Subject.CommonName,
+		DnsNames: cert.DNSNames,
+		Uris: []string{},
+		Fingerprint: hex.EncodeToString(fingerprint[:]),
+	}
+	for _, uri := range cert.URIs {
+		identity.Uris = append(identity.Uris, uri.String())
+	}
+	return identity
+}
+
+// How the client certificate is shown in access logs
+func (identity *ClientIdentity) describe() string {
+	if identity == nil {
+		return "cert=-"
+	}
+	if identity.CommonName != "" {
+		return "cert=" + identity.CommonName
+	}
+	return "cert=" + identity.Fingerprint[:16]
+}
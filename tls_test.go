@@ -0,0 +1,274 @@
+package main
+
+import (
+	"testing"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type testCa struct {
+	cert *x509.Certificate
+	key *ecdsa.PrivateKey
+	pem []byte
+}
+
+func newTestCa(t *testing.T) testCa {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{ CommonName: "test ca" },
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour),
+		IsCA: true,
+		BasicConstraintsValid: true,
+		KeyUsage: x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create CA: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	return testCa{ cert, key, pem.EncodeToMemory(&pem.Block{ Type: "CERTIFICATE", Bytes: der }) }
+}
+
+func (ca testCa) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// Issue a certificate for localhost, usable by servers and clients, returning
+// its cert and key as PEM
+func (ca testCa) issue(t *testing.T, commonName string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1 << 62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{ CommonName: commonName },
+		DNSNames: []string{ "localhost" },
+		IPAddresses: []net.IP{ net.ParseIP("127.0.0.1") },
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour),
+		KeyUsage: x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{ x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth },
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("Failed to issue certificate: %v", err)
+	}
+
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	return pem.EncodeToMemory(&pem.Block{ Type: "CERTIFICATE", Bytes: der }),
+		pem.EncodeToMemory(&pem.Block{ Type: "EC PRIVATE KEY", Bytes: keyDer })
+}
+
+// Write a freshly issued certificate to dir, returning the cert and key paths
+func (ca testCa) writeCert(t *testing.T, dir string, commonName string) (string, string) {
+	certPem, keyPem := ca.issue(t, commonName)
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+	os.WriteFile(certPath, certPem, 0644)
+	os.WriteFile(keyPath, keyPem, 0600)
+	return certPath, keyPath
+}
+
+func (ca testCa) writeBundle(t *testing.T, dir string) string {
+	path := filepath.Join(dir, "ca.pem")
+	os.WriteFile(path, ca.pem, 0644)
+	return path
+}
+
+func startTlsServer(t *testing.T, reloader *tlsReloader) *httptest.Server {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity := requestClientIdentity(r)
+		if identity == nil {
+			w.Write([]byte("anonymous"))
+			return
+		}
+		w.Write([]byte(identity.CommonName))
+	}))
+	srv.TLS = reloader.config()
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func tlsClient(ca testCa, certs []tls.Certificate) *http.Client {
+	return &http.Client{ Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{ RootCAs: ca.pool(), Certificates: certs },
+		ForceAttemptHTTP2: true,
+	} }
+}
+
+func TestTlsClientCertificates(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCa(t)
+	certPath, keyPath := ca.writeCert(t, dir, "server")
+
+	reloader, err := newTlsReloader(TlsOptions{
+		CertFile: certPath,
+		KeyFile: keyPath,
+		ClientCaFile: ca.writeBundle(t, dir),
+		MinVersion: "1.2",
+	})
+	if err != nil {
+		t.Fatalf("Failed to set up TLS: %v", err)
+	}
+	srv := startTlsServer(t, reloader)
+
+	clientPem, clientKey := ca.issue(t, "reporting")
+	clientCert, _ := tls.X509KeyPair(clientPem, clientKey)
+
+	res, err := tlsClient(ca, []tls.Certificate{ clientCert }).Get(srv.URL)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "reporting" {
+		t.Fatalf("Expected handler to see the client, got %s", body)
+	}
+	if res.ProtoMajor != 2 {
+		t.Fatalf("Expected http/2 to be negotiated, got %s", res.Proto)
+	}
+
+	// Client certificates are required by default
+	_, err = tlsClient(ca, nil).Get(srv.URL)
+	if err == nil {
+		t.Fatalf("Expected request without a client certificate to fail")
+	}
+
+	// And must come from the CA
+	otherPem, otherKey := newTestCa(t).issue(t, "stranger")
+	otherCert, _ := tls.X509KeyPair(otherPem, otherKey)
+	_, err = tlsClient(ca, []tls.Certificate{ otherCert }).Get(srv.URL)
+	if err == nil {
+		t.Fatalf("Expected request with an unknown client certificate to fail")
+	}
+}
+
+func TestTlsReload(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCa(t)
+	certPath, keyPath := ca.writeCert(t, dir, "first")
+
+	reloader, err := newTlsReloader(TlsOptions{ CertFile: certPath, KeyFile: keyPath, MinVersion: "1.2" })
+	if err != nil {
+		t.Fatalf("Failed to set up TLS: %v", err)
+	}
+	srv := startTlsServer(t, reloader)
+
+	servedName := func() string {
+		conn, err := tls.Dial("tcp", srv.Listener.Addr().String(), &tls.Config{ RootCAs: ca.pool(), ServerName: "localhost" })
+		if err != nil {
+			t.Fatalf("Handshake failed: %v", err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+
+	if reloaded, _ := reloader.reload(); reloaded {
+		t.Fatalf("Expected nothing to reload before the files change")
+	}
+
+	ca.writeCert(t, dir, "second")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certPath, later, later)
+
+	reloaded, err := reloader.reload()
+	if !reloaded || err != nil {
+		t.Fatalf("Expected certificate to reload, got %v", err)
+	}
+	if name := servedName(); name != "second" {
+		t.Fatalf("Expected new certificate to be served, got %s", name)
+	}
+
+	// A broken certificate leaves the last good one in place
+	os.WriteFile(certPath, []byte("garbage"), 0644)
+	later = later.Add(time.Minute)
+	os.Chtimes(certPath, later, later)
+
+	_, err = reloader.reload()
+	if err == nil {
+		t.Fatalf("Expected broken certificate to fail to load")
+	}
+	if name := servedName(); name != "second" {
+		t.Fatalf("Expected previous certificate to stay in use, got %s", name)
+	}
+}
+
+func TestTlsMinVersion(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCa(t)
+	certPath, keyPath := ca.writeCert(t, dir, "server")
+
+	reloader, err := newTlsReloader(TlsOptions{ CertFile: certPath, KeyFile: keyPath, MinVersion: "1.3" })
+	if err != nil {
+		t.Fatalf("Failed to set up TLS: %v", err)
+	}
+	srv := startTlsServer(t, reloader)
+
+	_, err = tls.Dial("tcp", srv.Listener.Addr().String(), &tls.Config{
+		RootCAs: ca.pool(),
+		ServerName: "localhost",
+		MaxVersion: tls.VersionTLS12,
+	})
+	if err == nil {
+		t.Fatalf("Expected TLS 1.2 to be refused")
+	}
+}
+
+func TestTlsOptionsInvalid(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCa(t)
+	certPath, keyPath := ca.writeCert(t, dir, "server")
+	caPath := ca.writeBundle(t, dir)
+
+	tests := map[string]TlsOptions{
+		"missing key": { CertFile: certPath, MinVersion: "1.2" },
+		"unknown version": { CertFile: certPath, KeyFile: keyPath, MinVersion: "1.4" },
+		"insecure cipher": { CertFile: certPath, KeyFile: keyPath, MinVersion: "1.2", CipherSuites: []string{ "TLS_RSA_WITH_RC4_128_SHA" } },
+		"client auth without CA": { CertFile: certPath, KeyFile: keyPath, MinVersion: "1.2", ClientAuth: "require" },
+		"CA without client auth": { CertFile: certPath, KeyFile: keyPath, MinVersion: "1.2", ClientCaFile: caPath, ClientAuth: "none" },
+	}
+
+	for name, options := range tests {
+		_, err := newTlsReloader(options)
+		if err == nil {
+			t.Fatalf("%s: expected options to be rejected", name)
+		}
+	}
+
+	reloader, err := newTlsReloader(TlsOptions{
+		CertFile: certPath,
+		KeyFile: keyPath,
+		MinVersion: "1.2",
+		CipherSuites: []string{ "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256" },
+	})
+	if err != nil || len(reloader.base.CipherSuites) != 1 {
+		t.Fatalf("Expected cipher suite to be accepted, got %v", err)
+	}
+}
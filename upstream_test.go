@@ -0,0 +1,113 @@
+package main
+
+import (
+	"testing"
+	"fmt"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+var fakePostStr = `{
+  "userId": 1,
+  "id": 1,
+  "title": "sunt aut facere repellat provident occaecati excepturi optio reprehenderit",
+  "body": "quia et suscipit\nsuscipit recusandae consequuntur expedita et cum\nreprehenderit molestiae ut ut quas totam\nnostrum rerum est autem sunt rem eveniet architecto"
+}`
+
+var fakeCommentsStr = `[
+  {
+    "postId": 1,
+    "id": 1,
+    "name": "id labore ex et quam laborum",
+    "email": "Eliseo@gardner.biz",
+    "body": "laudantium enim quasi est quidem magnam voluptate ipsam eos"
+  },
+  {
+    "postId": 1,
+    "id": 2,
+    "name": "quo vero reiciendis velit similique earum",
+    "email": "Jayne_Kuhic@sydney.com",
+    "body": "est natus enim nihil est dolore omnis voluptatem numquam"
+  }
+]`
+
+// Stand in for jsonplaceholder, serving the user and post fixtures from
+// main_test.go, so tests of the newer endpoints don't need network access.
+// Only user 1 exists. baseUrl is restored when the test finishes.
+func startFakeUpstream(t *testing.T) *httptest.Server {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method != "GET":
+			fakeUpstreamWrite(w, r)
+		case r.URL.Path == "/users":
+			fmt.Fprintf(w, "[%s]", expUserStr)
+		case r.URL.Path == "/users/1":
+			fmt.Fprint(w, expUserStr)
+		case r.URL.Path == "/posts" && r.URL.Query().Get("userId") == "":
+			fmt.Fprint(w, expPostsStr)
+		case r.URL.Path == "/posts" && r.URL.Query().Get("userId") == "1":
+			fmt.Fprint(w, expPostsStr)
+		case r.URL.Path == "/posts":
+			fmt.Fprint(w, "[]")
+		case r.URL.Path == "/posts/1":
+			fmt.Fprint(w, fakePostStr)
+		case r.URL.Path == "/posts/1/comments" || r.URL.Path == "/comments":
+			fmt.Fprint(w, fakeCommentsStr)
+		default:
+			w.WriteHeader(404)
+			fmt.Fprint(w, "{}")
+		}
+	}))
+
+	prevBaseUrl := baseUrl
+	baseUrl = upstream.URL
+
+	t.Cleanup(func() {
+		baseUrl = prevBaseUrl
+		upstream.Close()
+	})
+
+	return upstream
+}
+
+// Writes behave like jsonplaceholder's: nothing is stored, and the post that
+// would have been written is echoed back
+func fakeUpstreamWrite(w http.ResponseWriter, r *http.Request) {
+	post := map[string]interface{}{}
+	if r.Method == "PATCH" {
+		json.Unmarshal([]byte(fakePostStr), &post)
+	}
+	json.NewDecoder(r.Body).Decode(&post)
+
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/posts":
+		post["id"] = 101
+		w.WriteHeader(201)
+		json.NewEncoder(w).Encode(post)
+	case (r.Method == "PUT" || r.Method == "PATCH") && r.URL.Path == "/posts/1":
+		json.NewEncoder(w).Encode(post)
+	case r.Method == "DELETE" && r.URL.Path == "/posts/1":
+		fmt.Fprint(w, "{}")
+	default:
+		w.WriteHeader(404)
+		fmt.Fprint(w, "{}")
+	}
+}
+
+// Servers are started in a goroutine, so wait until they accept connections
+// before sending requests
+func waitForServer(t *testing.T, addr string) {
+	for i := 0; i < 50; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("Server at %s did not start", addr)
+}
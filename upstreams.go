@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Several copies of the upstream, tried in turn. Requests go to the upstreams
+// in an order picked by the balancing strategy, moving on to the next when
+// one fails with a 5xx, a network error or a timeout. Upstreams that keep
+// failing are marked down for a while, and only tried once the healthy ones
+// have failed too.
+
+// How requests are spread over healthy upstreams: "failover" always prefers
+// the first, "round-robin" rotates through them, and "least-latency" prefers
+// the quickest recently
+var upstreamBalance = "failover"
+
+// Each attempt at a request is abandoned after this long
+var upstreamTimeout = 10 * time.Second
+
+// An upstream is marked down after this many failures in a row, for
+// upstreamCooldown, after which it is tried again
+const upstreamFailureThreshold = 3
+var upstreamCooldown = 30 * time.Second
+
+// Weight given to the latest successful request in the latency average
+const upstreamLatencyWeight = 0.2
+
+type upstream struct {
+	url string
+
+	// Guarded by the pool's lock
+	requests int
+	failures int
+	consecutiveFailures int
+	downUntil time.Time
+	latency time.Duration
+	lastError string
+}
+
+// Metrics for a single upstream, as shown by /v1/admin/upstreams
+type UpstreamStats struct {
+	Url string `json:"url"`
+	Healthy bool `json:"healthy"`
+	Requests int `json:"requests"`
+	Failures int `json:"failures"`
+	ConsecutiveFailures int `json:"consecutiveFailures"`
+	LatencyMs float64 `json:"latencyMs"`
+	LastError string `json:"lastError,omitempty"`
+}
+
+type upstreamPool struct {
+	mu sync.Mutex
+	upstreams []*upstream
+	balance string
+	next int
+}
+
+func newUpstreamPool(urls []string, balance string) (*upstreamPool, error) {
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("Expected at least one upstream")
+	}
+
+	switch balance {
+	case "failover", "round-robin", "least-latency":
+	default:
+		return nil, fmt.Errorf("Unknown balancing strategy %q", balance)
+	}
+
+	pool := &upstreamPool{ balance: balance }
+	for _, url := range urls {
+		pool.upstreams = append(pool.upstreams, &upstream{ url: strings.TrimSuffix(url, "/") })
+	}
+	return pool, nil
+}
+
+// The order to try upstreams in for the next request. Upstreams that are down
+// come last, in case everything else fails too.
+func (pool *upstreamPool) order() []*upstream {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	ordered := append([]*upstream{}, pool.upstreams...)
+
+	switch pool.balance {
+	case "round-robin":
+		start := pool.next % len(ordered)
+		pool.next++
+		ordered = append(append([]*upstream{}, ordered[start:]...), ordered[:start]...)
+
+	case "least-latency":
+		// Upstreams with no requests yet sort first, so each gets measured
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return ordered[i].latency < ordered[j].latency
+		})
+	}
+
+	now := time.Now()
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return !now.Before(ordered[i].downUntil) && now.Before(ordered[j].downUntil)
+	})
+
+	return ordered
+}
+
+func (pool *upstreamPool) record(up *upstream, elapsed time.Duration, failure error) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	up.requests++
+
+	// Failures are often quick, so they'd only flatter the average
+	if failure == nil {
+		if up.latency == 0 {
+			up.latency = elapsed
+		} else {
+			up.latency += time.Duration(upstreamLatencyWeight * float64(elapsed - up.latency))
+		}
+
+		up.consecutiveFailures = 0
+		up.downUntil = time.Time{}
+		return
+	}
+
+	up.failures++
+	up.consecutiveFailures++
+	up.lastError = failure.Error()
+	if up.consecutiveFailures >= upstreamFailureThreshold {
+		up.downUntil = time.Now().Add(upstreamCooldown)
+	}
+}
+
+// Send a request, failing over to the next upstream when one fails. Requests
+// that aren't idempotent are only sent once, since a failed attempt may still
+// have been applied.
+func (pool *upstreamPool) request(ctx context.Context, method string, path string, body interface{}) (interface{}, int, error) {
+	idempotent := method == "GET" || method == "PUT" || method == "DELETE"
+
+	var res interface{}
+	var status int
+	var err error
+
+	for _, up := range pool.order() {
+		// Queue for a token first, so a long pause after a 429 doesn't time
+		// out the attempt, or count against the upstream's latency
+		err = upstreamLimiter.wait(ctx)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		attemptCtx, cancel := context.WithTimeout(ctx, upstreamTimeout)
+		start := time.Now()
+		res, status, err = requestJson(attemptCtx, method, up.url + path, body)
+		elapsed := time.Since(start)
+		cancel()
+
+		// The caller giving up isn't the upstream's fault
+		if ctx.Err() != nil {
+			return nil, 0, ctx.Err()
+		}
+
+		var failure error
+		switch {
+		case err != nil && status == 0:
+			failure = err
+		case status >= 500:
+			failure = fmt.Errorf("Got status %d", status)
+		}
+		pool.record(up, elapsed, failure)
+
+		if failure == nil || !idempotent {
+			break
+		}
+	}
+
+	return res, status, err
+}
+
+func (pool *upstreamPool) stats() []UpstreamStats {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	now := time.Now()
+	stats := []UpstreamStats{}
+	for _, up := range pool.upstreams {
+		stats = append(stats, UpstreamStats{
+			Url: up.url,
+			Healthy: !now.Before(up.downUntil),
+			Requests: up.requests,
+			Failures: up.failures,
+			ConsecutiveFailures: up.consecutiveFailures,
+			LatencyMs: float64(up.latency) / float64(time.Millisecond),
+			LastError: up.lastError,
+		})
+	}
+	return stats
+}
+
+// Serve /v1/admin/upstreams, showing the health and metrics of each upstream
+func handleUpstreams(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		writeError(w, 405, "Method not allowed")
+		return
+	}
+
+	upstreams, ok := backend.(*httpBackend)
+	if !ok || upstreams.pool == nil {
+		writeJson(w, 200, []UpstreamStats{})
+		return
+	}
+
+	writeJson(w, 200, upstreams.pool.stats())
+}
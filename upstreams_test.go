@@ -0,0 +1,129 @@
+package main
+
+import (
+	"testing"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+// Serve every request with the given status
+func startFailingUpstream(t *testing.T, status int) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func useUpstreamPool(t *testing.T, urls []string, balance string) *upstreamPool {
+	pool, err := newUpstreamPool(urls, balance)
+	if err != nil {
+		t.Fatalf("Unexpected error creating pool: %v", err)
+	}
+
+	prevBackend := backend
+	backend = &httpBackend{ pool: pool }
+	t.Cleanup(func() { backend = prevBackend })
+
+	return pool
+}
+
+func TestUpstreamFailover(t *testing.T) {
+	good := startFakeUpstream(t)
+	bad := startFailingUpstream(t, 503)
+	pool := useUpstreamPool(t, []string{ bad.URL, good.URL }, "failover")
+
+	for i := 0; i < upstreamFailureThreshold; i++ {
+		_, status, err := getUserPosts(1)
+		if err != nil || status != 200 {
+			t.Fatalf("Expected failover to succeed, got %d %v", status, err)
+		}
+	}
+
+	stats := pool.stats()
+	// Each call makes two requests in parallel, so exactly how many reach
+	// the first upstream before it's marked down depends on timing
+	if stats[0].Healthy || stats[0].Failures < upstreamFailureThreshold {
+		t.Fatalf("Expected first upstream to be down, got %+v", stats[0])
+	}
+	if !stats[1].Healthy || stats[1].Requests != upstreamFailureThreshold * 2 {
+		t.Fatalf("Expected second upstream to serve every request, got %+v", stats[1])
+	}
+
+	// Once down, the first upstream is tried last
+	order := pool.order()
+	if order[0].url != good.URL {
+		t.Fatalf("Expected healthy upstream first, got %s", order[0].url)
+	}
+}
+
+func TestUpstreamNoFailoverForPost(t *testing.T) {
+	good := startFakeUpstream(t)
+	bad := startFailingUpstream(t, 500)
+	pool := useUpstreamPool(t, []string{ bad.URL, good.URL }, "failover")
+
+	_, status, _ := sendJson(context.TODO(), "POST", "/posts", map[string]interface{}{ "title": "new" })
+	if status != 500 {
+		t.Fatalf("Expected 500 from first upstream, got %d", status)
+	}
+	if pool.stats()[1].Requests != 0 {
+		t.Fatalf("Expected POST not to be retried")
+	}
+}
+
+func TestUpstreamTimeout(t *testing.T) {
+	good := startFakeUpstream(t)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer slow.Close()
+
+	prevTimeout := upstreamTimeout
+	upstreamTimeout = 50 * time.Millisecond
+	defer func() { upstreamTimeout = prevTimeout }()
+
+	pool := useUpstreamPool(t, []string{ slow.URL, good.URL }, "failover")
+
+	_, status, err := fetchJson(context.TODO(), "/users/1")
+	if err != nil || status != 200 {
+		t.Fatalf("Expected failover after timeout, got %d %v", status, err)
+	}
+	if pool.stats()[0].Failures != 1 {
+		t.Fatalf("Expected timeout to count as a failure, got %+v", pool.stats()[0])
+	}
+}
+
+func TestUpstreamBalance(t *testing.T) {
+	pool, _ := newUpstreamPool([]string{ "http://a", "http://b", "http://c" }, "round-robin")
+
+	firsts := ""
+	for i := 0; i < 4; i++ {
+		firsts += pool.order()[0].url[len("http://"):]
+	}
+	if firsts != "abca" {
+		t.Fatalf("Expected round robin order abca, got %s", firsts)
+	}
+
+	pool, _ = newUpstreamPool([]string{ "http://a", "http://b", "http://c" }, "least-latency")
+	pool.record(pool.upstreams[0], 30 * time.Millisecond, nil)
+	pool.record(pool.upstreams[1], 10 * time.Millisecond, nil)
+	pool.record(pool.upstreams[2], 20 * time.Millisecond, nil)
+
+	order := ""
+	for _, up := range pool.order() {
+		order += up.url[len("http://"):]
+	}
+	if order != "bca" {
+		t.Fatalf("Expected least latency order bca, got %s", order)
+	}
+
+	_, err := newUpstreamPool([]string{ "http://a" }, "random")
+	if err == nil {
+		t.Fatalf("Expected error for unknown strategy")
+	}
+}
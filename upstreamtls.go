@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Connection settings for upstreams that need more than the system defaults:
+// a private CA, a client certificate, a different server name to present and
+// verify, or a particular proxy. Settings are given per base url, and apply to
+// every request made under it. Requests elsewhere use the default client.
+
+type UpstreamTls struct {
+	Url string `json:"url"`
+	// PEM bundle trusted on top of the system roots
+	CaFile string `json:"caFile,omitempty"`
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile string `json:"keyFile,omitempty"`
+	// Name sent as SNI and checked against the certificate, in place of the
+	// url's host
+	ServerName string `json:"serverName,omitempty"`
+	// Proxy url, or "direct" to skip proxies. Empty uses the environment, as
+	// the default client does.
+	Proxy string `json:"proxy,omitempty"`
+}
+
+type upstreamTlsFile struct {
+	Upstreams []UpstreamTls `json:"upstreams"`
+}
+
+type upstreamClient struct {
+	prefix string
+	client *http.Client
+}
+
+// Clients by base url, longest first, so the most specific match wins
+var upstreamClients []upstreamClient
+
+var defaultUpstreamClient = &http.Client{}
+
+func newUpstreamTlsClient(settings UpstreamTls) (*http.Client, error) {
+	config := &tls.Config{ ServerName: settings.ServerName }
+
+	if settings.CaFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		data, err := os.ReadFile(settings.CaFile)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("No certificates found in %s", settings.CaFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if (settings.CertFile == "") != (settings.KeyFile == "") {
+		return nil, fmt.Errorf("Both a certificate and key are needed for %s", settings.Url)
+	}
+	if settings.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(settings.CertFile, settings.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{ cert }
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	// A custom TLS config turns off http/2 unless asked for
+	transport.ForceAttemptHTTP2 = true
+
+	switch settings.Proxy {
+	case "":
+	case "direct":
+		transport.Proxy = nil
+	default:
+		proxyUrl, err := url.Parse(settings.Proxy)
+		if err != nil || proxyUrl.Host == "" {
+			return nil, fmt.Errorf("Invalid proxy %q for %s", settings.Proxy, settings.Url)
+		}
+		transport.Proxy = http.ProxyURL(proxyUrl)
+	}
+
+	return &http.Client{ Transport: transport }, nil
+}
+
+func loadUpstreamTls(path string) ([]upstreamClient, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file := upstreamTlsFile{}
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid upstream TLS file %s: %v", path, err)
+	}
+
+	clients := []upstreamClient{}
+	for _, settings := range file.Upstreams {
+		parsed, err := url.Parse(settings.Url)
+		if err != nil || parsed.Host == "" {
+			return nil, fmt.Errorf("Invalid upstream TLS file %s: bad url %q", path, settings.Url)
+		}
+
+		client, err := newUpstreamTlsClient(settings)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid upstream TLS file %s: %v", path, err)
+		}
+		clients = append(clients, upstreamClient{ strings.TrimSuffix(settings.Url, "/"), client })
+	}
+
+	sort.SliceStable(clients, func(i, j int) bool {
+		return len(clients[i].prefix) > len(clients[j].prefix)
+	})
+	return clients, nil
+}
+
+// Load settings from path, if given, for the commands that talk to the
+// upstream
+func useUpstreamTls(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	clients, err := loadUpstreamTls(path)
+	if err != nil {
+		return err
+	}
+	upstreamClients = clients
+	return nil
+}
+
+// Client to make a request to rawUrl with. Base urls only match on whole path
+// segments, so https://a/api doesn't cover https://a/apiv2.
+func upstreamClientFor(rawUrl string) *http.Client {
+	for _, entry := range upstreamClients {
+		rest, ok := strings.CutPrefix(rawUrl, entry.prefix)
+		if ok && (rest == "" || strings.HasPrefix(rest, "/") || strings.HasPrefix(rest, "?")) {
+			return entry.client
+		}
+	}
+	return defaultUpstreamClient
+}
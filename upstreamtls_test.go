@@ -0,0 +1,137 @@
+package main
+
+import (
+	"testing"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// Load upstream settings for the rest of the test
+func useUpstreamTlsFile(t *testing.T, upstreams []UpstreamTls) {
+	path := filepath.Join(t.TempDir(), "upstream-tls.json")
+	data, _ := json.Marshal(upstreamTlsFile{ upstreams })
+	os.WriteFile(path, data, 0644)
+
+	prev := upstreamClients
+	t.Cleanup(func() { upstreamClients = prev })
+
+	err := useUpstreamTls(path)
+	if err != nil {
+		t.Fatalf("Failed to load upstream TLS: %v", err)
+	}
+}
+
+func TestUpstreamMutualTls(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCa(t)
+
+	var serverName atomic.Value
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id": 1}`))
+	}))
+	serverPem, serverKey := ca.issue(t, "mirror")
+	serverCert, _ := tls.X509KeyPair(serverPem, serverKey)
+	upstream.TLS = &tls.Config{
+		Certificates: []tls.Certificate{ serverCert },
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs: ca.pool(),
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName.Store(hello.ServerName)
+			return nil, nil
+		},
+	}
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	// Without the CA or a client certificate, the upstream can't be used
+	_, _, err := getJson(context.TODO(), upstream.URL + "/users/1")
+	if err == nil {
+		t.Fatalf("Expected request to an unknown CA to fail")
+	}
+
+	certPath, keyPath := ca.writeCert(t, dir, "client")
+	useUpstreamTlsFile(t, []UpstreamTls{ {
+		Url: upstream.URL,
+		CaFile: ca.writeBundle(t, dir),
+		CertFile: certPath,
+		KeyFile: keyPath,
+		ServerName: "localhost",
+	} })
+
+	res, status, err := getJson(context.TODO(), upstream.URL + "/users/1")
+	if err != nil || status != 200 {
+		t.Fatalf("Request failed: %d %v", status, err)
+	}
+	if res.(map[string]interface{})["id"] != 1.0 {
+		t.Fatalf("Got unexpected response: %v", res)
+	}
+	if serverName.Load() != "localhost" {
+		t.Fatalf("Expected SNI to be overridden, got %v", serverName.Load())
+	}
+}
+
+func TestUpstreamProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`"direct"`))
+	}))
+	defer upstream.Close()
+
+	// Proxies are sent the full url, and answer in the upstream's place
+	var proxied atomic.Value
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied.Store(r.URL.String())
+		w.Write([]byte(`"proxied"`))
+	}))
+	defer proxy.Close()
+
+	useUpstreamTlsFile(t, []UpstreamTls{
+		{ Url: upstream.URL + "/via-proxy", Proxy: proxy.URL },
+		{ Url: upstream.URL, Proxy: "direct" },
+	})
+
+	res, _, err := getJson(context.TODO(), upstream.URL + "/via-proxy/users")
+	if err != nil || res != "proxied" {
+		t.Fatalf("Expected request through the proxy, got %v %v", res, err)
+	}
+	if proxied.Load() != upstream.URL + "/via-proxy/users" {
+		t.Fatalf("Got unexpected proxied url: %v", proxied.Load())
+	}
+
+	// Only whole path segments match
+	res, _, err = getJson(context.TODO(), upstream.URL + "/via-proxy-not/users")
+	if err != nil || res != "direct" {
+		t.Fatalf("Expected request straight to the upstream, got %v %v", res, err)
+	}
+}
+
+func TestLoadUpstreamTlsInvalid(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCa(t)
+	certPath, _ := ca.writeCert(t, dir, "client")
+	emptyPath := filepath.Join(dir, "empty.pem")
+	os.WriteFile(emptyPath, []byte{}, 0644)
+
+	tests := map[string]UpstreamTls{
+		"relative url": { Url: "/users" },
+		"cert without key": { Url: "https://mirror", CertFile: certPath },
+		"empty CA": { Url: "https://mirror", CaFile: emptyPath },
+		"bad proxy": { Url: "https://mirror", Proxy: "not a url" },
+	}
+
+	for name, settings := range tests {
+		path := filepath.Join(t.TempDir(), "upstream-tls.json")
+		data, _ := json.Marshal(upstreamTlsFile{ []UpstreamTls{ settings } })
+		os.WriteFile(path, data, 0644)
+
+		_, err := loadUpstreamTls(path)
+		if err == nil {
+			t.Fatalf("%s: expected settings to be rejected", name)
+		}
+	}
+}
@@ -0,0 +1,592 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Outbound webhooks, for downstream systems that want changes pushed to them.
+// Webhooks are registered through the admin API for a list of users, or for
+// every user. A background poller snapshots the watched users' UserPosts,
+// diffs each poll against the last, and delivers every change as a signed
+// json POST to the matching webhooks, retrying with exponential backoff.
+//
+// Each delivery is signed with the webhook's secret. Receivers should compute
+// HMAC-SHA256 over the X-Webhook-Timestamp header, a ".", and the raw body,
+// and compare it to the hex digest in X-Webhook-Signature, after the
+// "sha256=" prefix.
+//
+// Webhooks are only sent to public addresses, so they can't be pointed at
+// the server itself or anything else on its network. Private, loopback and
+// link-local addresses are refused, both when a webhook is registered and
+// when connecting, which also covers names that resolve to them and
+// redirects. Networks can be let through with webhookAllowedNets.
+
+var webhookPollInterval = time.Minute
+
+// Delivery retries back off exponentially from webhookRetryBase, giving up
+// after webhookMaxAttempts
+var webhookRetryBase = time.Second
+const webhookMaxAttempts = 5
+
+var webhookTimeout = 10 * time.Second
+
+// Number of deliveries kept in each webhook's log
+const webhookLogSize = 100
+
+// Most webhooks that can be registered at once
+const maxWebhooks = 100
+
+var errTooManyWebhooks = fmt.Errorf("No more than %d webhooks can be registered", maxWebhooks)
+
+// Networks webhooks may be sent to even though they aren't public
+var webhookAllowedNets []*net.IPNet
+
+type Webhook struct {
+	Id string `json:"id"`
+	Url string `json:"url"`
+	// Users whose changes are delivered. Empty means every user.
+	UserIds []int `json:"userIds"`
+	// Only returned when the webhook is created
+	Secret string `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func (hook *Webhook) watches(userId int) bool {
+	if len(hook.UserIds) == 0 {
+		return true
+	}
+	for _, id := range hook.UserIds {
+		if id == userId {
+			return true
+		}
+	}
+	return false
+}
+
+// The body POSTed to a webhook for a single change
+type WebhookPayload struct {
+	Id string `json:"id"`
+	Event string `json:"event"`
+	UserId int `json:"userId"`
+	Post *Post `json:"post,omitempty"`
+	User *User `json:"user,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// An entry in a webhook's delivery log
+type WebhookDelivery struct {
+	Id string `json:"id"`
+	WebhookId string `json:"webhookId"`
+	Event string `json:"event"`
+	UserId int `json:"userId"`
+	// One of "pending", "succeeded" or "failed"
+	Status string `json:"status"`
+	Attempts int `json:"attempts"`
+	ResponseCode int `json:"responseCode,omitempty"`
+	Error string `json:"error,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+type webhookRegistry struct {
+	mu sync.Mutex
+	hooks map[string]*Webhook
+	deliveries map[string][]*WebhookDelivery
+	snapshots map[int]*UserPosts
+	client *http.Client
+
+	// Deliveries in flight, so tests can wait for them
+	inflight sync.WaitGroup
+}
+
+func newWebhookRegistry() *webhookRegistry {
+	// Every connection is checked, whatever the name resolved to. Proxies
+	// would hide where requests end up, so they aren't used.
+	dialer := &net.Dialer{
+		Timeout: webhookTimeout,
+		Control: func(network string, address string, conn syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			return checkWebhookIp(net.ParseIP(host))
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &webhookRegistry{
+		hooks: map[string]*Webhook{},
+		deliveries: map[string][]*WebhookDelivery{},
+		snapshots: map[int]*UserPosts{},
+		client: &http.Client{ Timeout: webhookTimeout, Transport: transport },
+	}
+}
+
+var webhooks = newWebhookRegistry()
+
+func randomId(n int) string {
+	buf := make([]byte, n)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// Compute the value of the X-Webhook-Signature header
+func signWebhook(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Parse a comma separated list of CIDRs for webhookAllowedNets
+func parseWebhookAllowedNets(list string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, cidr := range strings.Split(list, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid network %q for webhooks", cidr)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// Refuse addresses that aren't public, unless they've been allowed
+func checkWebhookIp(ip net.IP) error {
+	if ip == nil {
+		return fmt.Errorf("Webhook address is not an IP")
+	}
+
+	public := ip.IsGlobalUnicast() && !ip.IsPrivate()
+	if public {
+		return nil
+	}
+	for _, ipNet := range webhookAllowedNets {
+		if ipNet.Contains(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("Webhooks can't be sent to %s, as it isn't a public address", ip)
+}
+
+// Check what can be checked of a url without resolving it. Names are checked
+// once they resolve, when connecting.
+func checkWebhookUrl(hookUrl string) error {
+	parsed, err := url.Parse(hookUrl)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("url must be an absolute http or https url")
+	}
+
+	host := strings.ToLower(parsed.Hostname())
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return checkWebhookIp(net.IPv4(127, 0, 0, 1))
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return checkWebhookIp(ip)
+	}
+	return nil
+}
+
+func (reg *webhookRegistry) add(hookUrl string, userIds []int, secret string) (*Webhook, error) {
+	err := checkWebhookUrl(hookUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range userIds {
+		if id < 0 {
+			return nil, fmt.Errorf("userIds must be non-negative")
+		}
+	}
+
+	if secret == "" {
+		secret = randomId(32)
+	}
+
+	hook := &Webhook{
+		Id: randomId(8),
+		Url: hookUrl,
+		UserIds: userIds,
+		Secret: secret,
+		CreatedAt: time.Now().UTC(),
+	}
+	if hook.UserIds == nil {
+		hook.UserIds = []int{}
+	}
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if len(reg.hooks) >= maxWebhooks {
+		return nil, errTooManyWebhooks
+	}
+	reg.hooks[hook.Id] = hook
+
+	return hook, nil
+}
+
+func (reg *webhookRegistry) remove(id string) bool {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	_, ok := reg.hooks[id]
+	delete(reg.hooks, id)
+	delete(reg.deliveries, id)
+	return ok
+}
+
+// Copy of a webhook, with the secret left out, safe to hand to clients
+func (reg *webhookRegistry) get(id string) (Webhook, bool) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	hook, ok := reg.hooks[id]
+	if !ok {
+		return Webhook{}, false
+	}
+
+	copied := *hook
+	copied.Secret = ""
+	return copied, true
+}
+
+func (reg *webhookRegistry) list() []Webhook {
+	reg.mu.Lock()
+	ids := make([]string, 0, len(reg.hooks))
+	for id := range reg.hooks {
+		ids = append(ids, id)
+	}
+	reg.mu.Unlock()
+
+	hooks := []Webhook{}
+	for _, id := range ids {
+		if hook, ok := reg.get(id); ok {
+			hooks = append(hooks, hook)
+		}
+	}
+
+	sort.Slice(hooks, func(i, j int) bool {
+		return hooks[i].CreatedAt.Before(hooks[j].CreatedAt)
+	})
+	return hooks
+}
+
+func (reg *webhookRegistry) deliveryLog(id string) []WebhookDelivery {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	entries := []WebhookDelivery{}
+	for _, delivery := range reg.deliveries[id] {
+		entries = append(entries, *delivery)
+	}
+	return entries
+}
+
+// The users any webhook is interested in. If a webhook watches every user,
+// the full list is fetched from upstream.
+func (reg *webhookRegistry) watchedIds(ctx context.Context) ([]int, error) {
+	reg.mu.Lock()
+	all := false
+	idSet := map[int]bool{}
+	for _, hook := range reg.hooks {
+		if len(hook.UserIds) == 0 {
+			all = true
+		}
+		for _, id := range hook.UserIds {
+			idSet[id] = true
+		}
+	}
+	reg.mu.Unlock()
+
+	if all {
+		return getUserIds(ctx)
+	}
+
+	ids := []int{}
+	for id := range idSet {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// Turn the difference between two snapshots of a user into payloads
+func diffUserPosts(prev *UserPosts, next *UserPosts) []WebhookPayload {
+	payloads := []WebhookPayload{}
+
+	if prev.UserInfo != next.UserInfo {
+		// Webhooks aren't tied to a client, so get the default policy
+		user := redaction.resolve(nil).user(next.UserInfo)
+		payloads = append(payloads, WebhookPayload{
+			Event: "user.updated",
+			UserId: next.Id,
+			User: &user,
+		})
+	}
+
+	for _, event := range diffPosts(prev.Posts, next.Posts) {
+		post := event.Post
+		payloads = append(payloads, WebhookPayload{
+			Event: event.Type,
+			UserId: next.Id,
+			Post: &post,
+		})
+	}
+
+	return payloads
+}
+
+// Fetch every watched user and queue deliveries for anything that changed
+// since the last poll. Users seen for the first time only record a baseline,
+// and users that fail to fetch keep their previous snapshot.
+func (reg *webhookRegistry) poll(ctx context.Context) error {
+	ids, err := reg.watchedIds(ctx)
+	if err != nil {
+		return err
+	}
+
+	current := map[int]*UserPosts{}
+	err = exportUserPosts(ctx, ids, exportConcurrency, func(record interface{}) error {
+		if userPosts, ok := record.(*UserPosts); ok {
+			current[userPosts.Id] = userPosts
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	for id, userPosts := range current {
+		prev := reg.snapshots[id]
+		reg.snapshots[id] = userPosts
+		if prev == nil {
+			continue
+		}
+
+		for _, payload := range diffUserPosts(prev, userPosts) {
+			for _, hook := range reg.hooks {
+				if hook.watches(id) {
+					reg.enqueue(ctx, *hook, payload)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Record a delivery in the log and start sending it. Must be called with the
+// registry locked.
+func (reg *webhookRegistry) enqueue(ctx context.Context, hook Webhook, payload WebhookPayload) {
+	now := time.Now().UTC()
+	payload.Id = randomId(8)
+	payload.Timestamp = now
+
+	delivery := &WebhookDelivery{
+		Id: payload.Id,
+		WebhookId: hook.Id,
+		Event: payload.Event,
+		UserId: payload.UserId,
+		Status: "pending",
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	deliveries := append(reg.deliveries[hook.Id], delivery)
+	if len(deliveries) > webhookLogSize {
+		deliveries = deliveries[1:]
+	}
+	reg.deliveries[hook.Id] = deliveries
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		delivery.Status = "failed"
+		delivery.Error = err.Error()
+		return
+	}
+
+	reg.inflight.Add(1)
+	go func() {
+		defer reg.inflight.Done()
+		reg.deliver(ctx, hook, delivery, body)
+	}()
+}
+
+// Send a delivery, retrying until it succeeds, runs out of attempts, or the
+// context is cancelled
+func (reg *webhookRegistry) deliver(ctx context.Context, hook Webhook, delivery *WebhookDelivery, body []byte) {
+	backoff := webhookRetryBase
+
+	for attempt := 1; attempt <= webhookMaxAttempts; attempt++ {
+		code, err := reg.send(ctx, hook, delivery, body)
+
+		reg.mu.Lock()
+		delivery.Attempts = attempt
+		delivery.ResponseCode = code
+		delivery.Error = ""
+		if err != nil {
+			delivery.Error = err.Error()
+		}
+		delivery.UpdatedAt = time.Now().UTC()
+
+		succeeded := err == nil && !errorStatus(code)
+		if succeeded {
+			delivery.Status = "succeeded"
+		} else if attempt == webhookMaxAttempts {
+			delivery.Status = "failed"
+		}
+		reg.mu.Unlock()
+
+		if succeeded || attempt == webhookMaxAttempts {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			reg.mu.Lock()
+			delivery.Status = "failed"
+			delivery.Error = "Delivery cancelled"
+			reg.mu.Unlock()
+			return
+		case <-time.After(backoff):
+			backoff *= 2
+		}
+	}
+}
+
+func (reg *webhookRegistry) send(ctx context.Context, hook Webhook, delivery *WebhookDelivery, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", hook.Url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Id", hook.Id)
+	req.Header.Set("X-Webhook-Delivery", delivery.Id)
+	req.Header.Set("X-Webhook-Event", delivery.Event)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", signWebhook(hook.Secret, timestamp, body))
+
+	res, err := reg.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64 * 1024))
+
+	return res.StatusCode, nil
+}
+
+func (reg *webhookRegistry) run(ctx context.Context) {
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := reg.poll(ctx)
+			if err != nil && ctx.Err() == nil {
+				log.Printf("Failed to poll for webhooks: %v", err)
+			}
+		}
+	}
+}
+
+type webhookRequest struct {
+	Url string `json:"url"`
+	UserIds []int `json:"userIds"`
+	Secret string `json:"secret"`
+}
+
+// Serve /v1/admin/webhooks, for listing and registering webhooks
+func handleWebhooks(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		writeJson(w, 200, webhooks.list())
+
+	case "POST":
+		req := webhookRequest{}
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64 * 1024)).Decode(&req)
+		if err != nil {
+			writeError(w, 400, "Invalid request body")
+			return
+		}
+
+		hook, err := webhooks.add(req.Url, req.UserIds, req.Secret)
+		if err == errTooManyWebhooks {
+			writeError(w, 409, err.Error())
+			return
+		}
+		if err != nil {
+			writeError(w, 400, err.Error())
+			return
+		}
+
+		// The secret is only ever returned here
+		writeJson(w, 201, hook)
+
+	default:
+		writeError(w, 405, "Method not allowed")
+	}
+}
+
+// Serve /v1/admin/webhooks/{id} and /v1/admin/webhooks/{id}/deliveries
+func handleWebhook(w http.ResponseWriter, r *http.Request) {
+	subpath := strings.TrimPrefix(r.URL.Path, "/v1/admin/webhooks/")
+	id := strings.TrimSuffix(subpath, "/deliveries")
+
+	hook, ok := webhooks.get(id)
+	if !ok {
+		writeError(w, 404, "Not found")
+		return
+	}
+
+	if id != subpath {
+		if r.Method != "GET" {
+			writeError(w, 405, "Method not allowed")
+			return
+		}
+		writeJson(w, 200, webhooks.deliveryLog(id))
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		writeJson(w, 200, hook)
+	case "DELETE":
+		webhooks.remove(id)
+		w.WriteHeader(204)
+	default:
+		writeError(w, 405, "Method not allowed")
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"testing"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+func TestDiffUserPosts(t *testing.T) {
+	prev := &UserPosts{
+		Id: 1,
+		UserInfo: User{ Name: "a", Username: "a", Email: "a@example.com" },
+		Posts: []Post{ { 1, "one", "" }, { 2, "two", "" } },
+	}
+	next := &UserPosts{
+		Id: 1,
+		UserInfo: User{ Name: "b", Username: "a", Email: "a@example.com" },
+		Posts: []Post{ { 1, "one", "" }, { 3, "three", "" } },
+	}
+
+	payloads := diffUserPosts(prev, next)
+	events := []string{}
+	for _, payload := range payloads {
+		events = append(events, payload.Event)
+	}
+
+	expected := "user.updated,post.deleted,post.created"
+	if strings.Join(events, ",") != expected {
+		t.Fatalf("Expected events %s, got %v", expected, events)
+	}
+
+	if payloads[0].User.Name != "b" {
+		t.Fatalf("Expected updated user, got %v", payloads[0].User)
+	}
+}
+
+// Let webhooks reach test receivers on loopback for the rest of the test
+func allowLoopbackWebhooks(t *testing.T) {
+	prev := webhookAllowedNets
+	webhookAllowedNets, _ = parseWebhookAllowedNets("127.0.0.0/8, ::1/128")
+	t.Cleanup(func() { webhookAllowedNets = prev })
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	startFakeUpstream(t)
+	allowLoopbackWebhooks(t)
+
+	prevRetryBase := webhookRetryBase
+	webhookRetryBase = 10 * time.Millisecond
+	defer func() { webhookRetryBase = prevRetryBase }()
+
+	// Fail the first attempt at each delivery, so every one is retried
+	mu := sync.Mutex{}
+	seen := map[string]bool{}
+	received := []WebhookPayload{}
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		timestamp := r.Header.Get("X-Webhook-Timestamp")
+		if r.Header.Get("X-Webhook-Signature") != signWebhook("secret", timestamp, body) {
+			t.Errorf("Got bad signature %s", r.Header.Get("X-Webhook-Signature"))
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		deliveryId := r.Header.Get("X-Webhook-Delivery")
+		if !seen[deliveryId] {
+			seen[deliveryId] = true
+			w.WriteHeader(500)
+			return
+		}
+
+		payload := WebhookPayload{}
+		json.Unmarshal(body, &payload)
+		received = append(received, payload)
+	}))
+	defer receiver.Close()
+
+	reg := newWebhookRegistry()
+	hook, err := reg.add(receiver.URL, []int{1}, "secret")
+	if err != nil {
+		t.Fatalf("Unexpected error adding webhook: %v", err)
+	}
+
+	// Seed the baseline with an edited and an extra post, as if upstream
+	// changed since the last poll
+	userPosts, _, _ := getUserPosts(1)
+	baseline := *userPosts
+	baseline.Posts = append([]Post{}, userPosts.Posts...)
+	baseline.Posts[0].Title = "old title"
+	baseline.Posts = append(baseline.Posts, Post{ Id: 999, Title: "gone" })
+	reg.snapshots[1] = &baseline
+
+	err = reg.poll(context.TODO())
+	if err != nil {
+		t.Fatalf("Unexpected error polling: %v", err)
+	}
+	reg.inflight.Wait()
+
+	// Deliveries are sent concurrently, so may arrive in any order
+	sort.Slice(received, func(i, j int) bool {
+		return received[i].Post.Id < received[j].Post.Id
+	})
+
+	if len(received) != 2 {
+		t.Fatalf("Expected 2 deliveries, got %v", received)
+	}
+	if received[0].Event != "post.updated" || received[0].Post.Id != userPosts.Posts[0].Id {
+		t.Fatalf("Got unexpected first delivery: %v", received[0])
+	}
+	if received[1].Event != "post.deleted" || received[1].Post.Id != 999 {
+		t.Fatalf("Got unexpected second delivery: %v", received[1])
+	}
+
+	deliveries := reg.deliveryLog(hook.Id)
+	if len(deliveries) != 2 {
+		t.Fatalf("Expected 2 log entries, got %v", deliveries)
+	}
+	for _, delivery := range deliveries {
+		if delivery.Status != "succeeded" || delivery.Attempts != 2 || delivery.ResponseCode != 200 {
+			t.Fatalf("Got unexpected log entry: %v", delivery)
+		}
+	}
+
+	// Nothing changed since, so nothing more is sent
+	reg.poll(context.TODO())
+	reg.inflight.Wait()
+	if len(reg.deliveryLog(hook.Id)) != 2 {
+		t.Fatalf("Expected no new deliveries")
+	}
+}
+
+func TestWebhookDeliveryFails(t *testing.T) {
+	allowLoopbackWebhooks(t)
+	prevRetryBase := webhookRetryBase
+	webhookRetryBase = time.Millisecond
+	defer func() { webhookRetryBase = prevRetryBase }()
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(503)
+	}))
+	defer receiver.Close()
+
+	reg := newWebhookRegistry()
+	hook, _ := reg.add(receiver.URL, nil, "")
+
+	reg.mu.Lock()
+	reg.enqueue(context.TODO(), *hook, WebhookPayload{ Event: "post.created", UserId: 1 })
+	reg.mu.Unlock()
+	reg.inflight.Wait()
+
+	deliveries := reg.deliveryLog(hook.Id)
+	if len(deliveries) != 1 {
+		t.Fatalf("Expected 1 log entry, got %v", deliveries)
+	}
+	delivery := deliveries[0]
+	if delivery.Status != "failed" || delivery.Attempts != webhookMaxAttempts || delivery.ResponseCode != 503 {
+		t.Fatalf("Got unexpected log entry: %v", delivery)
+	}
+}
+
+func TestWebhookAdminApi(t *testing.T) {
+	prevWebhooks := webhooks
+	webhooks = newWebhookRegistry()
+	defer func() { webhooks = prevWebhooks }()
+
+	w := httptest.NewRecorder()
+	body := strings.NewReader(`{"url": "http://203.0.113.10/hook", "userIds": [1, 2]}`)
+	handleWebhooks(w, httptest.NewRequest("POST", "/v1/admin/webhooks", body))
+	if w.Code != 201 {
+		t.Fatalf("Expected 201 creating webhook, got %d: %s", w.Code, w.Body)
+	}
+
+	created := Webhook{}
+	json.Unmarshal(w.Body.Bytes(), &created)
+	if created.Id == "" || created.Secret == "" {
+		t.Fatalf("Expected id and secret in %s", w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	handleWebhooks(w, httptest.NewRequest("GET", "/v1/admin/webhooks", nil))
+	listed := []Webhook{}
+	json.Unmarshal(w.Body.Bytes(), &listed)
+	if len(listed) != 1 || listed[0].Id != created.Id || listed[0].Secret != "" {
+		t.Fatalf("Got unexpected webhook list: %s", w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	handleWebhook(w, httptest.NewRequest("GET", "/v1/admin/webhooks/" + created.Id + "/deliveries", nil))
+	if w.Code != 200 || strings.TrimSpace(w.Body.String()) != "[]" {
+		t.Fatalf("Expected empty delivery log, got %d: %s", w.Code, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	handleWebhook(w, httptest.NewRequest("DELETE", "/v1/admin/webhooks/" + created.Id, nil))
+	if w.Code != 204 {
+		t.Fatalf("Expected 204 deleting webhook, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handleWebhook(w, httptest.NewRequest("GET", "/v1/admin/webhooks/" + created.Id, nil))
+	if w.Code != 404 {
+		t.Fatalf("Expected 404 after deleting, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	body = strings.NewReader(`{"url": "ftp://example.com"}`)
+	handleWebhooks(w, httptest.NewRequest("POST", "/v1/admin/webhooks", body))
+	if w.Code != 400 {
+		t.Fatalf("Expected 400 for bad url, got %d", w.Code)
+	}
+}
+
+func TestWebhookTargets(t *testing.T) {
+	reg := newWebhookRegistry()
+
+	refused := []string{
+		"http://localhost:8080/hook",
+		"http://127.0.0.1/hook",
+		"http://[::1]/hook",
+		"http://10.1.2.3/hook",
+		"http://192.168.0.1/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://0.0.0.0/hook",
+		"ftp://203.0.113.10/hook",
+	}
+	for _, hookUrl := range refused {
+		_, err := reg.add(hookUrl, nil, "")
+		if err == nil {
+			t.Fatalf("Expected %s to be refused", hookUrl)
+		}
+	}
+
+	_, err := reg.add("https://hooks.example.com/hook", nil, "")
+	if err != nil {
+		t.Fatalf("Expected public url to be accepted, got %v", err)
+	}
+
+	// Unless the network has been allowed
+	allowLoopbackWebhooks(t)
+	_, err = reg.add("http://127.0.0.1/hook", nil, "")
+	if err != nil {
+		t.Fatalf("Expected allowed network to be accepted, got %v", err)
+	}
+	if checkWebhookIp(net.ParseIP("10.1.2.3")) == nil {
+		t.Fatalf("Expected other private networks to stay refused")
+	}
+
+	for len(reg.hooks) < maxWebhooks {
+		reg.add("https://hooks.example.com/hook", nil, "")
+	}
+	_, err = reg.add("https://hooks.example.com/hook", nil, "")
+	if err != errTooManyWebhooks {
+		t.Fatalf("Expected registrations to be capped, got %v", err)
+	}
+}
+
+func TestWebhookConnectionChecked(t *testing.T) {
+	hit := false
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hit = true
+	}))
+	defer receiver.Close()
+
+	// Names, and anything else not caught at registration, are checked when
+	// connecting
+	reg := newWebhookRegistry()
+	hook := Webhook{ Id: "hook", Url: receiver.URL, Secret: "secret" }
+	delivery := &WebhookDelivery{ Id: "delivery", Event: "post.created" }
+	_, err := reg.send(context.TODO(), hook, delivery, []byte("{}"))
+	if err == nil || !strings.Contains(err.Error(), "public address") || hit {
+		t.Fatalf("Expected connection to loopback to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// WebSocket subscription API, for clients that want updates for several users
+// over one connection. Clients send commands:
+//
+//	{"type": "subscribe", "userId": 1}
+//	{"type": "unsubscribe", "userId": 1}
+//
+// On subscribing the client gets a "snapshot" message with the user's full
+// UserPosts, followed by "post.created", "post.updated" and "post.deleted"
+// messages as the posts change. Changes come from the same per-user feeds as
+// the SSE endpoint, so all subscribers to a user share one polling loop.
+
+// Maximum number of users a single connection can subscribe to
+const maxWsSubscriptions = 50
+
+type WsCommand struct {
+	Type string `json:"type"`
+	UserId int `json:"userId"`
+}
+
+type WsMessage struct {
+	Type string `json:"type"`
+	UserId int `json:"userId"`
+	Data *UserPosts `json:"data,omitempty"`
+	Post *Post `json:"post,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// A single client connection and its subscriptions
+type wsSession struct {
+	ws *wsConn
+	hub *feedHub
+
+	mu sync.Mutex
+	subs map[int]*wsSubscription
+	// How the client may see users
+	policy redactionPolicy
+}
+
+type wsSubscription struct {
+	unsubscribe func()
+}
+
+func (session *wsSession) send(msg WsMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return session.ws.writeText(data)
+}
+
+func (session *wsSession) sendError(userId int, message string) error {
+	return session.send(WsMessage{ Type: "error", UserId: userId, Message: message })
+}
+
+func (session *wsSession) subscribe(userId int) {
+	session.mu.Lock()
+	_, exists := session.subs[userId]
+	count := len(session.subs)
+	session.mu.Unlock()
+
+	if exists {
+		session.sendError(userId, "Already subscribed")
+		return
+	}
+
+	if count >= maxWsSubscriptions {
+		session.sendError(userId, "Too many subscriptions")
+		return
+	}
+
+	if userId < 0 {
+		session.sendError(userId, "Not found")
+		return
+	}
+
+	// Join the feed before taking the snapshot, so no change can slip in
+	// between the two. Events queue up on the channel until the snapshot
+	// has been sent.
+	ch, _, unsubscribe := session.hub.subscribe(userId, "")
+	sub := &wsSubscription{ unsubscribe: unsubscribe }
+
+	userPosts, status, err := getUserPosts(userId)
+	if status == 404 {
+		unsubscribe()
+		session.sendError(userId, "Not found")
+		return
+	}
+	if err != nil || errorStatus(status) {
+		unsubscribe()
+		session.sendError(userId, "Something went wrong")
+		return
+	}
+
+	session.mu.Lock()
+	session.subs[userId] = sub
+	session.mu.Unlock()
+
+	session.send(WsMessage{ Type: "snapshot", UserId: userId, Data: session.policy.userPosts(userPosts) })
+
+	go func() {
+		for event := range ch {
+			post := event.Post
+			session.send(WsMessage{ Type: event.Type, UserId: userId, Post: &post })
+		}
+
+		// The channel is closed both when the client unsubscribes, and
+		// when the feed drops us for falling behind. Only the latter
+		// leaves the subscription in place.
+		session.mu.Lock()
+		dropped := session.subs[userId] == sub
+		if dropped {
+			delete(session.subs, userId)
+		}
+		session.mu.Unlock()
+
+		if dropped {
+			unsubscribe()
+			session.sendError(userId, "Subscription dropped, resubscribe to continue")
+		}
+	}()
+}
+
+func (session *wsSession) unsubscribe(userId int) {
+	session.mu.Lock()
+	sub, exists := session.subs[userId]
+	delete(session.subs, userId)
+	session.mu.Unlock()
+
+	if !exists {
+		session.sendError(userId, "Not subscribed")
+		return
+	}
+
+	sub.unsubscribe()
+	session.send(WsMessage{ Type: "unsubscribed", UserId: userId })
+}
+
+func (session *wsSession) unsubscribeAll() {
+	session.mu.Lock()
+	subs := session.subs
+	session.subs = map[int]*wsSubscription{}
+	session.mu.Unlock()
+
+	for _, sub := range subs {
+		sub.unsubscribe()
+	}
+}
+
+func handleWebsocket(w http.ResponseWriter, r *http.Request) {
+	ws, err := upgradeWebsocket(w, r)
+	if err != nil {
+		return
+	}
+
+	// Clients must answer our pings, so a connection that goes quiet for
+	// two heartbeats is dead
+	ws.readTimeout = 2 * eventHeartbeatInterval
+
+	session := &wsSession{
+		ws: ws,
+		hub: postsFeeds,
+		subs: map[int]*wsSubscription{},
+		policy: redactionFor(r.Context()),
+	}
+	defer session.unsubscribeAll()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		ticker := time.NewTicker(eventHeartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				ws.writeFrame(wsPing, nil)
+			}
+		}
+	}()
+
+	for {
+		message, err := ws.readMessage()
+		if err != nil {
+			code := wsCloseNormal
+			if closeErr, ok := err.(*wsCloseError); ok {
+				code = closeErr.code
+			}
+			ws.close(code, "")
+			return
+		}
+
+		cmd := WsCommand{}
+		err = json.Unmarshal(message, &cmd)
+		if err != nil {
+			session.sendError(0, "Invalid command")
+			continue
+		}
+
+		switch cmd.Type {
+		case "subscribe":
+			session.subscribe(cmd.UserId)
+		case "unsubscribe":
+			session.unsubscribe(cmd.UserId)
+		default:
+			session.sendError(cmd.UserId, "Unknown command type")
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Minimal server side of the WebSocket protocol (RFC 6455), covering what the
+// subscription API needs: the handshake, text messages, fragmentation, ping,
+// pong and close. Extensions such as compression are not negotiated.
+
+const wsGuid = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Messages larger than this are rejected. Client messages are small commands,
+// so this only guards against abuse.
+const maxWsMessageSize = 64 * 1024
+
+// Frame opcodes
+const (
+	wsContinuation = 0x0
+	wsText = 0x1
+	wsBinary = 0x2
+	wsClose = 0x8
+	wsPing = 0x9
+	wsPong = 0xa
+)
+
+// Close status codes
+const (
+	wsCloseNormal = 1000
+	wsCloseProtocolError = 1002
+	wsCloseUnsupported = 1003
+	wsCloseInvalidData = 1007
+	wsCloseTooBig = 1009
+)
+
+type wsConn struct {
+	conn net.Conn
+	reader *bufio.Reader
+	// If set, the connection is dropped when no frame arrives within this
+	// long. Callers relying on it should ping more often than this.
+	readTimeout time.Duration
+
+	// Frames may be written from several goroutines, but must not be
+	// interleaved
+	writeMu sync.Mutex
+}
+
+// Error returned from readMessage once the connection is closed, by either
+// side. code is the status to close with, if we haven't already.
+type wsCloseError struct {
+	code int
+	reason string
+}
+
+func (err *wsCloseError) Error() string {
+	return fmt.Sprintf("websocket closed: %d %s", err.code, err.reason)
+}
+
+func headerContainsToken(header http.Header, name string, token string) bool {
+	for _, val := range header.Values(name) {
+		for _, part := range strings.Split(val, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Complete the opening handshake, taking over the underlying connection. On
+// failure an error response has already been written.
+func upgradeWebsocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	validRequest := r.Method == "GET" &&
+		headerContainsToken(r.Header, "Connection", "upgrade") &&
+		headerContainsToken(r.Header, "Upgrade", "websocket") &&
+		key != ""
+
+	if !validRequest {
+		writeError(w, 400, "Expected a websocket upgrade")
+		return nil, fmt.Errorf("Not a websocket upgrade")
+	}
+
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		writeError(w, 426, "Unsupported websocket version")
+		return nil, fmt.Errorf("Unsupported websocket version")
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		writeError(w, 500, "Something went wrong")
+		return nil, fmt.Errorf("Connection cannot be hijacked")
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha1.Sum([]byte(key + wsGuid))
+	accept := base64.StdEncoding.EncodeToString(hash[:])
+
+	_, err = fmt.Fprintf(
+		conn,
+		"HTTP/1.1 101 Switching Protocols\r\n" +
+			"Upgrade: websocket\r\n" +
+			"Connection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: %s\r\n\r\n",
+		accept,
+	)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &wsConn{ conn: conn, reader: rw.Reader }, nil
+}
+
+type wsFrame struct {
+	fin bool
+	opcode int
+	payload []byte
+}
+
+func (ws *wsConn) readFrame() (wsFrame, error) {
+	if ws.readTimeout > 0 {
+		ws.conn.SetReadDeadline(time.Now().Add(ws.readTimeout))
+	}
+
+	header := make([]byte, 2)
+	_, err := io.ReadFull(ws.reader, header)
+	if err != nil {
+		return wsFrame{}, err
+	}
+
+	frame := wsFrame{
+		fin: header[0] & 0x80 != 0,
+		opcode: int(header[0] & 0x0f),
+	}
+
+	if header[0] & 0x70 != 0 {
+		return frame, &wsCloseError{ wsCloseProtocolError, "Reserved bits set" }
+	}
+
+	// Clients must mask every frame they send
+	if header[1] & 0x80 == 0 {
+		return frame, &wsCloseError{ wsCloseProtocolError, "Unmasked client frame" }
+	}
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		_, err = io.ReadFull(ws.reader, ext)
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		_, err = io.ReadFull(ws.reader, ext)
+		length = binary.BigEndian.Uint64(ext)
+	}
+	if err != nil {
+		return frame, err
+	}
+
+	if length > maxWsMessageSize {
+		return frame, &wsCloseError{ wsCloseTooBig, "Message too big" }
+	}
+
+	mask := make([]byte, 4)
+	_, err = io.ReadFull(ws.reader, mask)
+	if err != nil {
+		return frame, err
+	}
+
+	frame.payload = make([]byte, length)
+	_, err = io.ReadFull(ws.reader, frame.payload)
+	if err != nil {
+		return frame, err
+	}
+
+	for i := range frame.payload {
+		frame.payload[i] ^= mask[i % 4]
+	}
+
+	return frame, nil
+}
+
+// Read the next complete text message, reassembling fragments and answering
+// control frames along the way
+func (ws *wsConn) readMessage() ([]byte, error) {
+	var message []byte
+	fragmented := false
+
+	for {
+		frame, err := ws.readFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		switch frame.opcode {
+		case wsPing:
+			if !frame.fin || len(frame.payload) > 125 {
+				return nil, &wsCloseError{ wsCloseProtocolError, "Invalid control frame" }
+			}
+			ws.writeFrame(wsPong, frame.payload)
+			continue
+
+		case wsPong:
+			continue
+
+		case wsClose:
+			code := wsCloseNormal
+			if len(frame.payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(frame.payload))
+			}
+			return nil, &wsCloseError{ code, "Closed by client" }
+
+		case wsBinary:
+			return nil, &wsCloseError{ wsCloseUnsupported, "Binary messages are not supported" }
+
+		case wsText:
+			if fragmented {
+				return nil, &wsCloseError{ wsCloseProtocolError, "Expected a continuation frame" }
+			}
+			message = frame.payload
+			fragmented = !frame.fin
+
+		case wsContinuation:
+			if !fragmented {
+				return nil, &wsCloseError{ wsCloseProtocolError, "Unexpected continuation frame" }
+			}
+			if len(message) + len(frame.payload) > maxWsMessageSize {
+				return nil, &wsCloseError{ wsCloseTooBig, "Message too big" }
+			}
+			message = append(message, frame.payload...)
+			fragmented = !frame.fin
+
+		default:
+			return nil, &wsCloseError{ wsCloseProtocolError, "Unknown opcode" }
+		}
+
+		if !fragmented {
+			if !utf8.Valid(message) {
+				return nil, &wsCloseError{ wsCloseInvalidData, "Invalid utf-8" }
+			}
+			return message, nil
+		}
+	}
+}
+
+// Write a single unfragmented frame. Server frames are never masked.
+func (ws *wsConn) writeFrame(opcode int, payload []byte) error {
+	header := []byte{ 0x80 | byte(opcode) }
+
+	switch {
+	case len(payload) < 126:
+		header = append(header, byte(len(payload)))
+	case len(payload) <= 0xffff:
+		header = append(header, 126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(len(payload)))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(len(payload)))
+	}
+
+	ws.writeMu.Lock()
+	defer ws.writeMu.Unlock()
+
+	_, err := ws.conn.Write(append(header, payload...))
+	return err
+}
+
+func (ws *wsConn) writeText(message []byte) error {
+	return ws.writeFrame(wsText, message)
+}
+
+// Send a close frame and shut the connection. Errors are ignored, since the
+// connection is going away regardless.
+func (ws *wsConn) close(code int, reason string) {
+	payload := make([]byte, 2, 2 + len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+
+	ws.writeFrame(wsClose, payload)
+	ws.conn.Close()
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"testing"
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+)
+
+// Just enough of a websocket client to drive the server in tests
+type testWsClient struct {
+	conn net.Conn
+	reader *bufio.Reader
+}
+
+func dialTestWs(t *testing.T, url string) *testWsClient {
+	addr := strings.TrimPrefix(url, "http://")
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial websocket: %v", err)
+	}
+
+	conn.Write([]byte(
+		"GET /v1/ws HTTP/1.1\r\n" +
+			"Host: " + addr + "\r\n" +
+			"Upgrade: websocket\r\n" +
+			"Connection: keep-alive, Upgrade\r\n" +
+			"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+			"Sec-WebSocket-Version: 13\r\n\r\n",
+	))
+
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("Failed to read handshake response: %v", err)
+	}
+
+	// Expected accept key for the sample nonce, from RFC 6455
+	if res.StatusCode != 101 || res.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Unexpected handshake response: %d %v", res.StatusCode, res.Header)
+	}
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &testWsClient{ conn: conn, reader: reader }
+}
+
+func (client *testWsClient) writeFrame(fin bool, opcode int, payload []byte) {
+	first := byte(opcode)
+	if fin {
+		first |= 0x80
+	}
+
+	mask := []byte{ 1, 2, 3, 4 }
+	frame := []byte{ first, 0x80 | byte(len(payload)) }
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b ^ mask[i % 4])
+	}
+
+	client.conn.Write(frame)
+}
+
+func (client *testWsClient) send(t *testing.T, cmd WsCommand) {
+	data, _ := json.Marshal(cmd)
+	client.writeFrame(true, wsText, data)
+}
+
+// Read the next frame from the server, skipping pings
+func (client *testWsClient) readFrame(t *testing.T) (int, []byte) {
+	for {
+		header := make([]byte, 2)
+		_, err := client.reader.Read(header[:1])
+		if err == nil {
+			_, err = client.reader.Read(header[1:])
+		}
+		if err != nil {
+			t.Fatalf("Failed to read frame: %v", err)
+		}
+
+		length := int(header[1] & 0x7f)
+		switch length {
+		case 126:
+			ext := make([]byte, 2)
+			client.reader.Read(ext)
+			length = int(binary.BigEndian.Uint16(ext))
+		case 127:
+			ext := make([]byte, 8)
+			client.reader.Read(ext)
+			length = int(binary.BigEndian.Uint64(ext))
+		}
+
+		payload := make([]byte, length)
+		for read := 0; read < length; {
+			n, err := client.reader.Read(payload[read:])
+			if err != nil {
+				t.Fatalf("Failed to read frame: %v", err)
+			}
+			read += n
+		}
+
+		opcode := int(header[0] & 0x0f)
+		if opcode != wsPing {
+			return opcode, payload
+		}
+	}
+}
+
+func (client *testWsClient) read(t *testing.T) WsMessage {
+	opcode, payload := client.readFrame(t)
+	if opcode != wsText {
+		t.Fatalf("Expected a text frame, got opcode %d", opcode)
+	}
+
+	msg := WsMessage{}
+	json.Unmarshal(payload, &msg)
+	return msg
+}
+
+func TestWebsocketSubscriptions(t *testing.T) {
+	startFakeUpstream(t)
+
+	fake := &fakePostsFetch{}
+	fake.set(Post{ Id: 1, Title: "one" })
+
+	prevFeeds := postsFeeds
+	postsFeeds = newFeedHub()
+	postsFeeds.fetch = fake.fetch
+
+	prevInterval := eventPollInterval
+	eventPollInterval = 10 * time.Millisecond
+
+	defer func() {
+		postsFeeds = prevFeeds
+		eventPollInterval = prevInterval
+	}()
+
+	srv := httptest.NewServer(http.HandlerFunc(handleWebsocket))
+	defer srv.Close()
+
+	client := dialTestWs(t, srv.URL)
+	other := dialTestWs(t, srv.URL)
+
+	client.send(t, WsCommand{ Type: "subscribe", UserId: 1 })
+	msg := client.read(t)
+	if msg.Type != "snapshot" || msg.Data == nil || msg.Data.UserInfo != *expUser {
+		t.Fatalf("Got unexpected message: %v", msg)
+	}
+
+	// A command split across fragments
+	data, _ := json.Marshal(WsCommand{ Type: "subscribe", UserId: 1 })
+	other.writeFrame(false, wsText, data[:5])
+	other.writeFrame(true, wsContinuation, data[5:])
+	if msg := other.read(t); msg.Type != "snapshot" {
+		t.Fatalf("Got unexpected message: %v", msg)
+	}
+
+	client.send(t, WsCommand{ Type: "subscribe", UserId: 1 })
+	if msg := client.read(t); msg.Type != "error" {
+		t.Fatalf("Expected error for duplicate subscription, got: %v", msg)
+	}
+
+	client.send(t, WsCommand{ Type: "subscribe", UserId: 2 })
+	if msg := client.read(t); msg.Type != "error" || msg.Message != "Not found" {
+		t.Fatalf("Expected error for missing user, got: %v", msg)
+	}
+
+	// Both connections get the change, from a single shared feed
+	waitForBaseline(t, postsFeeds, 1)
+	fake.set(Post{ Id: 1, Title: "one" }, Post{ Id: 2, Title: "two" })
+
+	for _, c := range []*testWsClient{client, other} {
+		msg := c.read(t)
+		if msg.Type != "post.created" || msg.UserId != 1 || msg.Post == nil || msg.Post.Id != 2 {
+			t.Fatalf("Got unexpected message: %v", msg)
+		}
+	}
+
+	if len(postsFeeds.feeds) != 1 {
+		t.Fatalf("Expected one shared feed, got %d", len(postsFeeds.feeds))
+	}
+
+	client.send(t, WsCommand{ Type: "unsubscribe", UserId: 1 })
+	if msg := client.read(t); msg.Type != "unsubscribed" {
+		t.Fatalf("Got unexpected message: %v", msg)
+	}
+
+	// Closing is echoed back
+	client.writeFrame(true, wsClose, []byte{ 0x03, 0xe8 })
+	opcode, payload := client.readFrame(t)
+	if opcode != wsClose || binary.BigEndian.Uint16(payload) != wsCloseNormal {
+		t.Fatalf("Got unexpected close: %d %v", opcode, payload)
+	}
+}
+
+func TestWebsocketRejectsPlainRequests(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(handleWebsocket))
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL)
+	if err != nil || res.StatusCode != 400 {
+		t.Fatalf("Expected 400 for plain request: %v %v", res, err)
+	}
+}
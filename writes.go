@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Write-through proxy for posts. Requests are validated against the Post
+// type and forwarded to the upstream's write endpoints. The upstream doesn't
+// keep what it's sent, so once it accepts a write the result is recorded in
+// the local overlay, which is what's returned. Posts that only exist in the
+// overlay are edited there without going to the upstream at all.
+
+const maxPostTitleLen = 256
+const maxPostBodyLen = 10000
+const maxPostRequestSize = 64 * 1024
+
+// A post as sent by clients. Fields are pointers so that missing fields can be
+// told apart from empty ones.
+type PostInput struct {
+	Id *int `json:"id"`
+	Title *string `json:"title"`
+	Body *string `json:"body"`
+}
+
+// Decode a post from a request body, rejecting anything that isn't a single
+// json object of Post fields
+func readPostInput(w http.ResponseWriter, r *http.Request) (PostInput, error) {
+	input := PostInput{}
+
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPostRequestSize))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&input)
+	if err != nil {
+		return input, fmt.Errorf("Invalid request body")
+	}
+	if dec.More() {
+		return input, fmt.Errorf("Invalid request body")
+	}
+
+	return input, nil
+}
+
+// Check the fields of a post. If partial is set, as for PATCH, fields may be
+// left out, but at least one must be given. postId is the id from the url, or
+// 0 when creating, in which case the body must not set one.
+func (input PostInput) validate(postId int, partial bool) error {
+	if input.Id != nil {
+		if postId == 0 {
+			return fmt.Errorf("id is assigned by the server")
+		}
+		if *input.Id != postId {
+			return fmt.Errorf("id does not match the url")
+		}
+	}
+
+	if !partial && (input.Title == nil || input.Body == nil) {
+		return fmt.Errorf("title and body are required")
+	}
+	if partial && input.Title == nil && input.Body == nil {
+		return fmt.Errorf("Expected title or body")
+	}
+
+	if input.Title != nil {
+		if strings.TrimSpace(*input.Title) == "" {
+			return fmt.Errorf("title must not be empty")
+		}
+		if len(*input.Title) > maxPostTitleLen {
+			return fmt.Errorf("title must be at most %d bytes", maxPostTitleLen)
+		}
+	}
+
+	if input.Body != nil && len(*input.Body) > maxPostBodyLen {
+		return fmt.Errorf("body must be at most %d bytes", maxPostBodyLen)
+	}
+
+	return nil
+}
+
+// The upstream request body for a post. Only the fields given are sent.
+func (input PostInput) upstreamBody(userId int) map[string]interface{} {
+	body := map[string]interface{}{ "userId": userId }
+	if input.Title != nil {
+		body["title"] = *input.Title
+	}
+	if input.Body != nil {
+		body["body"] = *input.Body
+	}
+	return body
+}
+
+// Nothing caches UserPosts responses, but live feeds hold a snapshot of each
+// user's posts. Refresh it so a write shows up for subscribers promptly.
+func invalidateUserPosts(userId int) {
+	postsFeeds.refresh(userId)
+}
+
+// The post as it currently reads, with the overlay applied, along with its
+// owner and whether it only exists in the overlay
+type currentPost struct {
+	post Post
+	userId int
+	local bool
+}
+
+func getCurrentPost(ctx context.Context, postId int) (currentPost, int, error) {
+	if entry, ok := overlays.get(postId); ok {
+		if entry.Op == "deleted" {
+			return currentPost{}, 404, nil
+		}
+		return currentPost{ *entry.Post, entry.UserId, entry.Op == "created" }, 200, nil
+	}
+
+	res, status, err := fetchJson(ctx, fmt.Sprintf("/posts/%d", postId))
+	if err != nil || errorStatus(status) {
+		return currentPost{}, status, err
+	}
+
+	data, ok := res.(map[string]interface{})
+	if !ok {
+		return currentPost{}, status, fmt.Errorf("returned non-object json")
+	}
+
+	userId, err := indexInt(data, "userId")
+	if err != nil {
+		return currentPost{}, status, err
+	}
+
+	post, err := parsePost(data)
+	return currentPost{ post, userId, false }, status, err
+}
+
+// Write an upstream failure as one of our errors
+func writeUpstreamError(w http.ResponseWriter, status int) {
+	if status == 404 {
+		writeError(w, 404, "Not found")
+		return
+	}
+	writeError(w, 500, "Something went wrong")
+}
+
+// Send a write upstream and return the resulting post
+func writePost(ctx context.Context, method string, path string, body interface{}) (Post, int, error) {
+	res, status, err := sendJson(ctx, method, path, body)
+	if err != nil || errorStatus(status) {
+		return Post{}, status, err
+	}
+
+	post, err := parsePost(res)
+	return post, status, err
+}
+
+// Serve POST /v1/users/{id}/posts
+func handleCreatePost(w http.ResponseWriter, r *http.Request) {
+	subpath := strings.TrimPrefix(r.URL.Path, "/v1/users/")
+	if !strings.HasSuffix(subpath, "/posts") {
+		writeError(w, 404, "Not found")
+		return
+	}
+
+	userId, err := strconv.Atoi(strings.TrimSuffix(subpath, "/posts"))
+	if err != nil || userId < 0 {
+		writeError(w, 404, "Not found")
+		return
+	}
+
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeError(w, 405, "Method not allowed")
+		return
+	}
+
+	input, err := readPostInput(w, r)
+	if err == nil {
+		err = input.validate(0, false)
+	}
+	if err != nil {
+		writeError(w, 400, err.Error())
+		return
+	}
+
+	// The upstream will happily create posts for users that don't exist
+	userRes := getUser(r.Context(), userId)
+	if userRes.err != nil || errorStatus(userRes.status) {
+		writeUpstreamError(w, userRes.status)
+		return
+	}
+
+	post, status, err := writePost(
+		r.Context(),
+		"POST",
+		"/posts",
+		input.upstreamBody(userId),
+	)
+	if err != nil || errorStatus(status) {
+		writeError(w, 500, "Something went wrong")
+		return
+	}
+
+	post, err = overlays.create(userId, post)
+	if err != nil {
+		writeError(w, 500, "Something went wrong")
+		return
+	}
+
+	invalidateUserPosts(userId)
+
+	w.Header().Set("Location", fmt.Sprintf("/v1/posts/%d", post.Id))
+	setOverlayHeader(w, userId)
+	writeJson(w, 201, post)
+}
+
+// Serve PUT, PATCH and DELETE on /v1/posts/{postId}
+func handlePost(w http.ResponseWriter, r *http.Request) {
+	postId, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/v1/posts/"))
+	if err != nil || postId <= 0 {
+		writeError(w, 404, "Not found")
+		return
+	}
+
+	if r.Method != "PUT" && r.Method != "PATCH" && r.Method != "DELETE" {
+		w.Header().Set("Allow", "PUT, PATCH, DELETE")
+		writeError(w, 405, "Method not allowed")
+		return
+	}
+
+	var input PostInput
+	if r.Method != "DELETE" {
+		input, err = readPostInput(w, r)
+		if err == nil {
+			err = input.validate(postId, r.Method == "PATCH")
+		}
+		if err != nil {
+			writeError(w, 400, err.Error())
+			return
+		}
+	}
+
+	current, status, err := getCurrentPost(r.Context(), postId)
+	if err != nil || errorStatus(status) {
+		writeUpstreamError(w, status)
+		return
+	}
+
+	path := fmt.Sprintf("/posts/%d", postId)
+
+	if r.Method == "DELETE" {
+		if !current.local {
+			_, status, err = sendJson(r.Context(), "DELETE", path, nil)
+			if err != nil || errorStatus(status) {
+				writeUpstreamError(w, status)
+				return
+			}
+		}
+
+		err = overlays.delete(current.userId, postId)
+		if err != nil {
+			writeError(w, 500, "Something went wrong")
+			return
+		}
+
+		invalidateUserPosts(current.userId)
+		w.WriteHeader(204)
+		return
+	}
+
+	post := current.post
+	if input.Title != nil {
+		post.Title = *input.Title
+	}
+	if input.Body != nil {
+		post.Body = *input.Body
+	}
+
+	if !current.local {
+		// A PATCH only sends the fields being changed
+		body := input.upstreamBody(current.userId)
+		body["id"] = postId
+
+		_, status, err = sendJson(r.Context(), r.Method, path, body)
+		if err != nil || errorStatus(status) {
+			writeUpstreamError(w, status)
+			return
+		}
+	}
+
+	err = overlays.update(current.userId, post)
+	if err != nil {
+		writeError(w, 500, "Something went wrong")
+		return
+	}
+
+	invalidateUserPosts(current.userId)
+	setOverlayHeader(w, current.userId)
+	writeJson(w, 200, post)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"testing"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+)
+
+func TestPostInputValidate(t *testing.T) {
+	title := "title"
+	empty := " "
+	id := 1
+	other := 2
+
+	tests := []struct {
+		name string
+		input PostInput
+		postId int
+		partial bool
+		valid bool
+	}{
+		{ "create", PostInput{ Title: &title, Body: &empty }, 0, false, true },
+		{ "create with id", PostInput{ Id: &id, Title: &title, Body: &title }, 0, false, false },
+		{ "create missing body", PostInput{ Title: &title }, 0, false, false },
+		{ "empty title", PostInput{ Title: &empty, Body: &title }, 0, false, false },
+		{ "replace with id", PostInput{ Id: &id, Title: &title, Body: &title }, 1, false, true },
+		{ "replace mismatched id", PostInput{ Id: &other, Title: &title, Body: &title }, 1, false, false },
+		{ "patch title", PostInput{ Title: &title }, 1, true, true },
+		{ "patch nothing", PostInput{}, 1, true, false },
+	}
+
+	for _, test := range tests {
+		err := test.input.validate(test.postId, test.partial)
+		if (err == nil) != test.valid {
+			t.Fatalf("%s: expected valid=%v, got %v", test.name, test.valid, err)
+		}
+	}
+}
+
+func TestCreatePost(t *testing.T) {
+	startFakeUpstream(t)
+	useTempOverlay(t)
+
+	w := httptest.NewRecorder()
+	body := strings.NewReader(`{"title": "new", "body": "post"}`)
+	handleCreatePost(w, httptest.NewRequest("POST", "/v1/users/1/posts", body))
+	if w.Code != 201 {
+		t.Fatalf("Expected 201, got %d: %s", w.Code, w.Body)
+	}
+
+	post := Post{}
+	json.Unmarshal(w.Body.Bytes(), &post)
+	if post != (Post{ Id: 101, Title: "new", Body: "post" }) {
+		t.Fatalf("Got unexpected post: %s", w.Body)
+	}
+	if w.Header().Get("Location") != "/v1/posts/101" {
+		t.Fatalf("Got unexpected Location: %s", w.Header().Get("Location"))
+	}
+
+	// Unknown fields are rejected
+	w = httptest.NewRecorder()
+	body = strings.NewReader(`{"title": "new", "body": "post", "userId": 2}`)
+	handleCreatePost(w, httptest.NewRequest("POST", "/v1/users/1/posts", body))
+	if w.Code != 400 {
+		t.Fatalf("Expected 400 for unknown field, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	body = strings.NewReader(`{"title": "new", "body": "post"}`)
+	handleCreatePost(w, httptest.NewRequest("POST", "/v1/users/2/posts", body))
+	if w.Code != 404 {
+		t.Fatalf("Expected 404 for missing user, got %d", w.Code)
+	}
+}
+
+func TestUpdatePost(t *testing.T) {
+	startFakeUpstream(t)
+	useTempOverlay(t)
+
+	w := httptest.NewRecorder()
+	body := strings.NewReader(`{"id": 1, "title": "new", "body": "post"}`)
+	handlePost(w, httptest.NewRequest("PUT", "/v1/posts/1", body))
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body)
+	}
+
+	post := Post{}
+	json.Unmarshal(w.Body.Bytes(), &post)
+	if post != (Post{ Id: 1, Title: "new", Body: "post" }) {
+		t.Fatalf("Got unexpected post: %s", w.Body)
+	}
+
+	// Fields left out of a PATCH keep their values from the previous edit
+	w = httptest.NewRecorder()
+	body = strings.NewReader(`{"title": "patched"}`)
+	handlePost(w, httptest.NewRequest("PATCH", "/v1/posts/1", body))
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body)
+	}
+
+	post = Post{}
+	json.Unmarshal(w.Body.Bytes(), &post)
+	if post != (Post{ Id: 1, Title: "patched", Body: "post" }) {
+		t.Fatalf("Got unexpected post: %s", w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	body = strings.NewReader(`{"title": "new", "body": "post"}`)
+	handlePost(w, httptest.NewRequest("PUT", "/v1/posts/2", body))
+	if w.Code != 404 {
+		t.Fatalf("Expected 404 for missing post, got %d", w.Code)
+	}
+}
+
+func TestDeletePost(t *testing.T) {
+	startFakeUpstream(t)
+	useTempOverlay(t)
+
+	w := httptest.NewRecorder()
+	handlePost(w, httptest.NewRequest("DELETE", "/v1/posts/1", nil))
+	if w.Code != 204 {
+		t.Fatalf("Expected 204, got %d: %s", w.Code, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	handlePost(w, httptest.NewRequest("GET", "/v1/posts/1", nil))
+	if w.Code != 405 || w.Header().Get("Allow") != "PUT, PATCH, DELETE" {
+		t.Fatalf("Expected 405 for GET, got %d", w.Code)
+	}
+}